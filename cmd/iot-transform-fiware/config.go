@@ -1,6 +1,13 @@
 package main
 
 import (
+	"context"
+
+	"github.com/diwise/iot-transform-fiware/internal/application/devices"
+	"github.com/diwise/iot-transform-fiware/internal/application/measurements"
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
+	"github.com/diwise/iot-transform-fiware/internal/application/things"
+	"github.com/diwise/iot-transform-fiware/internal/application/watermeter"
 	"github.com/diwise/messaging-golang/pkg/messaging"
 	"github.com/diwise/service-chassis/pkg/infrastructure/servicerunner"
 )
@@ -14,17 +21,50 @@ const (
 	controlPort
 	contextbrokerUrl
 
+	deviceMgmtUrl
+	deviceMgmtCacheTTL
+
 	oauth2ClientId
 	oauth2ClientSecret
 	oauth2TokenUrl
 	oauth2InsecureURL
 
+	stateStorePath
+
+	datasetNamesPath
+
+	leakNightStart
+	leakNightEnd
+	leakMinDuration
+	leakTimeZone
+
+	thingIDStrategy
+	thingDeletionMode
+	thingDecodingMode
+	thingTimeZone
+	pointOfInterestTypesPath
+
+	containerFullThreshold
+	containerOverflowingThreshold
+	containerEmptiedThreshold
+
+	lifebuoyMissingAlert
+
+	alertRulesPath
+
 	logLevel
 )
 
 type AppConfig struct {
 	messenger  messaging.MsgContext
 	cbClientFn ContextBrokerClientFactoryFunc
+	store      state.Store
+	registry   devices.Registry
+	datasets   measurements.DatasetNames
+	leaks      watermeter.LeakDetection
+	things     things.Config
+	// stopWatching stops what is watched in the background, such as missing lifebuoys
+	stopWatching context.CancelFunc
 }
 
 var onstarting = servicerunner.OnStarting[AppConfig]
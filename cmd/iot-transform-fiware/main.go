@@ -8,11 +8,18 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/diwise/context-broker/pkg/ngsild/client"
+	"github.com/diwise/iot-transform-fiware/internal/application/alerts"
+	"github.com/diwise/iot-transform-fiware/internal/application/devices"
+	"github.com/diwise/iot-transform-fiware/internal/application/functions"
 	"github.com/diwise/iot-transform-fiware/internal/application/measurements"
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
 	"github.com/diwise/iot-transform-fiware/internal/application/things"
+	"github.com/diwise/iot-transform-fiware/internal/application/watermeter"
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/clientcredentials"
@@ -36,17 +43,45 @@ func defaultFlags() FlagMap {
 		controlPort:      "8000",
 		contextbrokerUrl: "http://context-broker",
 
+		deviceMgmtUrl:      "",
+		deviceMgmtCacheTTL: "5m",
+
 		oauth2ClientId:     "",
 		oauth2ClientSecret: "",
 		oauth2TokenUrl:     "",
 		oauth2InsecureURL:  "true",
 
+		stateStorePath: "state.db",
+
+		datasetNamesPath: "",
+
+		leakNightStart:  "0",
+		leakNightEnd:    "4",
+		leakMinDuration: "2h",
+		leakTimeZone:    watermeter.DefaultTimeZone,
+
+		thingIDStrategy:   string(things.ThingIDs),
+		thingDeletionMode: string(things.DeactivateEntities),
+		thingDecodingMode: string(things.LenientDecoding),
+		thingTimeZone:     things.DefaultTimeZone,
+
+		pointOfInterestTypesPath: "",
+
+		containerFullThreshold:        "80",
+		containerOverflowingThreshold: "100",
+		containerEmptiedThreshold:     "30",
+
+		lifebuoyMissingAlert: "10m",
+
+		alertRulesPath: "",
+
 		logLevel: "debug",
 	}
 }
 
 const (
 	ThingUpdatedTopic    string = "thing.updated"
+	ThingDeletedTopic    string = "thing.deleted"
 	FunctionUpdatedTopic string = "function.updated"
 	MessageAcceptedTopic string = "message.accepted"
 )
@@ -65,11 +100,40 @@ func main() {
 	)
 	exitIf(err, logger, "failed to init messenger")
 
-	factory := newContextBrokerClientFactory(ctx, flags[contextbrokerUrl], serviceName, serviceVersion, flags[oauth2ClientId], flags[oauth2ClientSecret], flags[oauth2TokenUrl], flags[oauth2InsecureURL] == "true")
+	tokenSource := newTokenSource(ctx, flags[oauth2ClientId], flags[oauth2ClientSecret], flags[oauth2TokenUrl], flags[oauth2InsecureURL] == "true")
+	factory := newContextBrokerClientFactory(ctx, flags[contextbrokerUrl], serviceName, serviceVersion, tokenSource)
+
+	registry, err := newDeviceRegistry(ctx, flags[deviceMgmtUrl], flags[deviceMgmtCacheTTL], tokenSource)
+	exitIf(err, logger, "failed to init device registry")
+
+	store, err := newStateStore(flags[stateStorePath])
+	exitIf(err, logger, "failed to init state store", "path", flags[stateStorePath])
+
+	datasets, err := loadDatasetNames(flags[datasetNamesPath])
+	exitIf(err, logger, "failed to load dataset names", "path", flags[datasetNamesPath])
+
+	// the device type that dataset names are configured by is only known from the device registry
+	if len(datasets) > 0 && registry == nil {
+		logger.Warn("dataset names are configured but DEV_MGMT_URL is not set, so they will not be used", "path", flags[datasetNamesPath])
+	}
+
+	leaks, err := newLeakDetection(flags)
+	exitIf(err, logger, "failed to configure leak detection")
+
+	thingsCfg, err := newThingsConfig(flags)
+	exitIf(err, logger, "failed to configure things")
+
+	rules, err := loadAlertRules(flags[alertRulesPath])
+	exitIf(err, logger, "failed to load alert rules", "path", flags[alertRulesPath])
 
 	cfg := &AppConfig{
 		messenger:  messenger,
-		cbClientFn: factory,
+		cbClientFn: alerts.NewClientFactory(factory, rules),
+		store:      store,
+		registry:   registry,
+		datasets:   datasets,
+		leaks:      leaks,
+		things:     thingsCfg,
 	}
 
 	runner, _ := initialize(ctx, flags, cfg)
@@ -79,20 +143,6 @@ func main() {
 }
 
 func initialize(ctx context.Context, flags FlagMap, cfg *AppConfig) (servicerunner.Runner[AppConfig], error) {
-
-	var (
-		building        = messaging.MatchContentType("application/vnd.diwise.building+json")
-		container       = messaging.MatchContentType("application/vnd.diwise.container+json")
-		lifebuoy        = messaging.MatchContentType("application/vnd.diwise.lifebuoy+json")
-		passage         = messaging.MatchContentType("application/vnd.diwise.passage+json")
-		pointofinterest = messaging.MatchContentType("application/vnd.diwise.pointofinterest+json")
-		pumpingstation  = messaging.MatchContentType("application/vnd.diwise.pumpingstation+json")
-		room            = messaging.MatchContentType("application/vnd.diwise.room+json")
-		sewer           = messaging.MatchContentType("application/vnd.diwise.sewer+json")
-		//watermeter      = messaging.MatchContentType("application/vnd.diwise.watermeter+json")
-		desk = messaging.MatchContentType("application/vnd.diwise.desk+json")
-	)
-
 	probes := map[string]k8shandlers.ServiceProber{
 		"rabbitmq": func(context.Context) (string, error) { return "ok", nil },
 	}
@@ -106,25 +156,38 @@ func initialize(ctx context.Context, flags FlagMap, cfg *AppConfig) (servicerunn
 		onstarting(func(ctx context.Context, svcCfg *AppConfig) error {
 			svcCfg.messenger.Start()
 
+			// make the state store, and how water meters are checked for leaks, available to every handler through its context
+			withStore := func(handler messaging.TopicMessageHandler) messaging.TopicMessageHandler {
+				return func(ctx context.Context, itm messaging.IncomingTopicMessage, l *slog.Logger) {
+					ctx = watermeter.NewContextWithLeakDetection(ctx, svcCfg.leaks)
+					handler(state.NewContextWithStore(ctx, svcCfg.store), itm, l)
+				}
+			}
+
 			// things
-			svcCfg.messenger.RegisterTopicMessageHandlerWithFilter(ThingUpdatedTopic, things.NewBuildingTopicMessageHandler(svcCfg.messenger, svcCfg.cbClientFn), building)
-			svcCfg.messenger.RegisterTopicMessageHandlerWithFilter(ThingUpdatedTopic, things.NewContainerTopicMessageHandler(svcCfg.messenger, svcCfg.cbClientFn), container)
-			svcCfg.messenger.RegisterTopicMessageHandlerWithFilter(ThingUpdatedTopic, things.NewLifebuoyTopicMessageHandler(svcCfg.messenger, svcCfg.cbClientFn), lifebuoy)
-			svcCfg.messenger.RegisterTopicMessageHandlerWithFilter(ThingUpdatedTopic, things.NewPassageTopicMessageHandler(svcCfg.messenger, svcCfg.cbClientFn), passage)
-			svcCfg.messenger.RegisterTopicMessageHandlerWithFilter(ThingUpdatedTopic, things.NewPointOfInterestTopicMessageHandler(svcCfg.messenger, svcCfg.cbClientFn), pointofinterest)
-			svcCfg.messenger.RegisterTopicMessageHandlerWithFilter(ThingUpdatedTopic, things.NewPumpingstationTopicMessageHandler(svcCfg.messenger, svcCfg.cbClientFn), pumpingstation)
-			svcCfg.messenger.RegisterTopicMessageHandlerWithFilter(ThingUpdatedTopic, things.NewRoomTopicMessageHandler(svcCfg.messenger, svcCfg.cbClientFn), room)
-			svcCfg.messenger.RegisterTopicMessageHandlerWithFilter(ThingUpdatedTopic, things.NewSewerTopicMessageHandler(svcCfg.messenger, svcCfg.cbClientFn), sewer)
-			//svcCfg.messenger.RegisterTopicMessageHandlerWithFilter(ThingUpdatedTopic, things.NewWaterMeterTopicMessageHandler(svcCfg.messenger, svcCfg.cbClientFn), watermeter)
-			svcCfg.messenger.RegisterTopicMessageHandlerWithFilter(ThingUpdatedTopic, things.NewDeskTopicMessageHandler(svcCfg.messenger, svcCfg.cbClientFn), desk)
+			svcCfg.messenger.RegisterTopicMessageHandler(ThingUpdatedTopic, withStore(things.NewThingTopicMessageHandler(svcCfg.messenger, svcCfg.cbClientFn, svcCfg.things)))
+			svcCfg.messenger.RegisterTopicMessageHandler(ThingDeletedTopic, withStore(things.NewThingDeletedTopicMessageHandler(svcCfg.messenger, svcCfg.cbClientFn, svcCfg.things)))
+			// functions
+			svcCfg.messenger.RegisterTopicMessageHandlerWithFilter(FunctionUpdatedTopic, withStore(functions.NewCounterTopicMessageHandler(svcCfg.messenger, svcCfg.cbClientFn)), functions.MatchFunctionType(functions.CounterFunctionType))
+			svcCfg.messenger.RegisterTopicMessageHandlerWithFilter(FunctionUpdatedTopic, withStore(functions.NewLevelTopicMessageHandler(svcCfg.messenger, svcCfg.cbClientFn)), functions.MatchFunctionType(functions.LevelFunctionType))
+			svcCfg.messenger.RegisterTopicMessageHandlerWithFilter(FunctionUpdatedTopic, withStore(functions.NewPresenceTopicMessageHandler(svcCfg.messenger, svcCfg.cbClientFn)), functions.MatchFunctionType(functions.PresenceFunctionType))
+			svcCfg.messenger.RegisterTopicMessageHandlerWithFilter(FunctionUpdatedTopic, withStore(functions.NewTimerTopicMessageHandler(svcCfg.messenger, svcCfg.cbClientFn)), functions.MatchFunctionType(functions.TimerFunctionType))
+			svcCfg.messenger.RegisterTopicMessageHandlerWithFilter(FunctionUpdatedTopic, withStore(functions.NewWaterQualityTopicMessageHandler(svcCfg.messenger, svcCfg.cbClientFn)), functions.MatchFunctionType(functions.WaterQualityFunctionType))
 			// measurements
-			svcCfg.messenger.RegisterTopicMessageHandler(MessageAcceptedTopic, measurements.NewMeasurementTopicMessageHandler(svcCfg.messenger, svcCfg.cbClientFn))
+			svcCfg.messenger.RegisterTopicMessageHandler(MessageAcceptedTopic, withStore(measurements.NewMeasurementTopicMessageHandler(svcCfg.messenger, svcCfg.cbClientFn, svcCfg.registry, svcCfg.datasets)))
+
+			// lifebuoys that go missing and stop reporting are alerted about without waiting for their next report
+			ctx, svcCfg.stopWatching = context.WithCancel(state.NewContextWithStore(ctx, svcCfg.store))
+			go things.WatchMissingLifebuoys(ctx, svcCfg.cbClientFn, svcCfg.things, time.Minute)
 
 			return nil
 		}),
 		onshutdown(func(ctx context.Context, svcCfg *AppConfig) error {
+			if svcCfg.stopWatching != nil {
+				svcCfg.stopWatching()
+			}
 			svcCfg.messenger.Close()
-			return nil
+			return svcCfg.store.Close()
 		}))
 
 	return runner, nil
@@ -136,10 +199,28 @@ func parseExternalConfig(ctx context.Context, flags FlagMap) (context.Context, F
 
 	flags[servicePort] = envOrDef(ctx, "SERVICE_PORT", flags[servicePort])
 	flags[contextbrokerUrl] = envOrDef(ctx, "NGSI_CB_URL", flags[contextbrokerUrl])
+	flags[deviceMgmtUrl] = envOrDef(ctx, "DEV_MGMT_URL", flags[deviceMgmtUrl])
+	flags[deviceMgmtCacheTTL] = envOrDef(ctx, "DEV_MGMT_CACHE_TTL", flags[deviceMgmtCacheTTL])
 	flags[oauth2TokenUrl] = envOrDef(ctx, "OAUTH2_TOKEN_URL", flags[oauth2TokenUrl])
 	flags[oauth2ClientId] = envOrDef(ctx, "OAUTH2_CLIENT_ID", flags[oauth2ClientId])
 	flags[oauth2ClientSecret] = envOrDef(ctx, "OAUTH2_CLIENT_SECRET", flags[oauth2ClientSecret])
 	flags[oauth2InsecureURL] = envOrDef(ctx, "OAUTH2_REALM_INSECURE", flags[oauth2InsecureURL])
+	flags[stateStorePath] = envOrDef(ctx, "STATE_STORE_PATH", flags[stateStorePath])
+	flags[datasetNamesPath] = envOrDef(ctx, "DATASET_NAMES_PATH", flags[datasetNamesPath])
+	flags[leakNightStart] = envOrDef(ctx, "WATERMETER_NIGHT_START", flags[leakNightStart])
+	flags[leakNightEnd] = envOrDef(ctx, "WATERMETER_NIGHT_END", flags[leakNightEnd])
+	flags[leakMinDuration] = envOrDef(ctx, "WATERMETER_LEAK_DURATION", flags[leakMinDuration])
+	flags[leakTimeZone] = envOrDef(ctx, "WATERMETER_TIME_ZONE", flags[leakTimeZone])
+	flags[thingIDStrategy] = envOrDef(ctx, "THING_ID_STRATEGY", flags[thingIDStrategy])
+	flags[thingDeletionMode] = envOrDef(ctx, "THING_DELETION_MODE", flags[thingDeletionMode])
+	flags[thingDecodingMode] = envOrDef(ctx, "THING_DECODING_MODE", flags[thingDecodingMode])
+	flags[thingTimeZone] = envOrDef(ctx, "THING_TIME_ZONE", flags[thingTimeZone])
+	flags[pointOfInterestTypesPath] = envOrDef(ctx, "POINT_OF_INTEREST_TYPES_PATH", flags[pointOfInterestTypesPath])
+	flags[containerFullThreshold] = envOrDef(ctx, "WASTE_CONTAINER_FULL", flags[containerFullThreshold])
+	flags[containerOverflowingThreshold] = envOrDef(ctx, "WASTE_CONTAINER_OVERFLOWING", flags[containerOverflowingThreshold])
+	flags[containerEmptiedThreshold] = envOrDef(ctx, "WASTE_CONTAINER_EMPTIED", flags[containerEmptiedThreshold])
+	flags[lifebuoyMissingAlert] = envOrDef(ctx, "LIFEBUOY_MISSING_ALERT", flags[lifebuoyMissingAlert])
+	flags[alertRulesPath] = envOrDef(ctx, "ALERT_RULES_PATH", flags[alertRulesPath])
 	flags[logLevel] = envOrDef(ctx, "LOG_LEVEL", flags[logLevel])
 
 	apply := func(f FlagType) func(string) error {
@@ -170,6 +251,44 @@ func parseLogLevel(level string) slog.Level {
 	}
 }
 
+func newStateStore(path string) (state.Store, error) {
+	if path == "" {
+		return state.NewInMemoryStore(), nil
+	}
+
+	return state.NewFileStore(path)
+}
+
+// loadDatasetNames reads the datasetIds to use for object instances per device type, if a file has been configured
+func loadDatasetNames(path string) (measurements.DatasetNames, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return measurements.LoadDatasetNames(f)
+}
+
+// loadAlertRules reads the rules that alerts are opened by, if a file has been configured, or else the default rules
+func loadAlertRules(path string) ([]alerts.Rule, error) {
+	if path == "" {
+		return alerts.DefaultRules(), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return alerts.LoadRules(f)
+}
+
 func exitIf(err error, logger *slog.Logger, msg string, args ...any) {
 	if err != nil {
 		logger.With(args...).Error(msg, "err", err.Error())
@@ -179,37 +298,39 @@ func exitIf(err error, logger *slog.Logger, msg string, args ...any) {
 
 type ContextBrokerClientFactoryFunc func(string) client.ContextBrokerClient
 
-func newContextBrokerClientFactory(ctx context.Context, contextBrokerUrl, serviceName, serviceVersion, oauth2ClientId, oauth2ClientSecret, oauth2TokenUrl string, oauthInsecureURL bool) ContextBrokerClientFactoryFunc {
-	log := logging.GetFromContext(ctx)
-
-	var tokenSource oauth2.TokenSource
+func newTokenSource(ctx context.Context, oauth2ClientId, oauth2ClientSecret, oauth2TokenUrl string, oauthInsecureURL bool) oauth2.TokenSource {
+	if oauth2ClientId == "" || oauth2ClientSecret == "" || oauth2TokenUrl == "" {
+		return nil
+	}
 
-	if oauth2ClientId != "" && oauth2ClientSecret != "" && oauth2TokenUrl != "" {
-		oauthConfig := &clientcredentials.Config{
-			ClientID:     oauth2ClientId,
-			ClientSecret: oauth2ClientSecret,
-			TokenURL:     oauth2TokenUrl,
-		}
+	oauthConfig := &clientcredentials.Config{
+		ClientID:     oauth2ClientId,
+		ClientSecret: oauth2ClientSecret,
+		TokenURL:     oauth2TokenUrl,
+	}
 
-		httpTransport := http.DefaultTransport
-		if oauthInsecureURL {
-			trans, ok := httpTransport.(*http.Transport)
-			if ok {
-				if trans.TLSClientConfig == nil {
-					trans.TLSClientConfig = &tls.Config{}
-				}
-				trans.TLSClientConfig.InsecureSkipVerify = true
+	httpTransport := http.DefaultTransport
+	if oauthInsecureURL {
+		trans, ok := httpTransport.(*http.Transport)
+		if ok {
+			if trans.TLSClientConfig == nil {
+				trans.TLSClientConfig = &tls.Config{}
 			}
+			trans.TLSClientConfig.InsecureSkipVerify = true
 		}
+	}
 
-		httpClient := &http.Client{
-			Transport: otelhttp.NewTransport(httpTransport),
-		}
+	httpClient := &http.Client{
+		Transport: otelhttp.NewTransport(httpTransport),
+	}
 
-		ctx = context.WithValue(ctx, oauth2.HTTPClient, httpClient)
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, httpClient)
 
-		tokenSource = oauthConfig.TokenSource(ctx)
-	}
+	return oauthConfig.TokenSource(ctx)
+}
+
+func newContextBrokerClientFactory(ctx context.Context, contextBrokerUrl, serviceName, serviceVersion string, tokenSource oauth2.TokenSource) ContextBrokerClientFactoryFunc {
+	log := logging.GetFromContext(ctx)
 
 	return func(tenant string) client.ContextBrokerClient {
 		if tokenSource != nil {
@@ -234,3 +355,128 @@ func newContextBrokerClientFactory(ctx context.Context, contextBrokerUrl, servic
 		)
 	}
 }
+
+// newLeakDetection returns how water meters are checked for leaks
+func newLeakDetection(flags FlagMap) (watermeter.LeakDetection, error) {
+	var err error
+
+	ld := watermeter.DefaultLeakDetection()
+
+	ld.NightStart, err = strconv.Atoi(flags[leakNightStart])
+	if err != nil {
+		return ld, fmt.Errorf("invalid start of night %s: %w", flags[leakNightStart], err)
+	}
+
+	ld.NightEnd, err = strconv.Atoi(flags[leakNightEnd])
+	if err != nil {
+		return ld, fmt.Errorf("invalid end of night %s: %w", flags[leakNightEnd], err)
+	}
+
+	ld.MinDuration, err = time.ParseDuration(flags[leakMinDuration])
+	if err != nil {
+		return ld, fmt.Errorf("invalid leak duration %s: %w", flags[leakMinDuration], err)
+	}
+
+	ld.Location, err = time.LoadLocation(flags[leakTimeZone])
+	if err != nil {
+		return ld, fmt.Errorf("invalid time zone %s: %w", flags[leakTimeZone], err)
+	}
+
+	return ld, ld.Validate()
+}
+
+// newThingsConfig returns the configuration that things are handled with
+func newThingsConfig(flags FlagMap) (things.Config, error) {
+	var err error
+
+	cfg := things.DefaultConfig()
+
+	cfg.IDs, err = things.ParseIDStrategy(flags[thingIDStrategy])
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.Deletion, err = things.ParseDeletionMode(flags[thingDeletionMode])
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.Decoding, err = things.ParseDecodingMode(flags[thingDecodingMode])
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.Location, err = time.LoadLocation(flags[thingTimeZone])
+	if err != nil {
+		return cfg, fmt.Errorf("invalid time zone %s: %w", flags[thingTimeZone], err)
+	}
+
+	thresholds := map[FlagType]*float64{
+		containerFullThreshold:        &cfg.Containers.Full,
+		containerOverflowingThreshold: &cfg.Containers.Overflowing,
+		containerEmptiedThreshold:     &cfg.Containers.Emptied,
+	}
+
+	for f, threshold := range thresholds {
+		*threshold, err = strconv.ParseFloat(flags[f], 64)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid waste container threshold %s: %w", flags[f], err)
+		}
+	}
+
+	err = cfg.Containers.Validate()
+	if err != nil {
+		return cfg, fmt.Errorf("invalid waste container thresholds: %w", err)
+	}
+
+	cfg.MissingLifebuoyAlert, err = time.ParseDuration(flags[lifebuoyMissingAlert])
+	if err != nil {
+		return cfg, fmt.Errorf("invalid missing lifebuoy alert time %s: %w", flags[lifebuoyMissingAlert], err)
+	}
+
+	if path := flags[pointOfInterestTypesPath]; path != "" {
+		cfg.PointsOfInterest, err = loadPointOfInterestTypes(path)
+		if err != nil {
+			return cfg, fmt.Errorf("failed to load point of interest types from %s: %w", path, err)
+		}
+	}
+
+	return cfg, nil
+}
+
+// loadPointOfInterestTypes reads how the sub types of points of interest are published from the file at path
+func loadPointOfInterestTypes(path string) (things.PointOfInterestTypes, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return things.LoadPointOfInterestTypes(f)
+}
+
+// newDeviceRegistry returns a registry backed by iot-device-mgmt, or nil if no url has been configured
+func newDeviceRegistry(ctx context.Context, deviceMgmtUrl, cacheTTL string, tokenSource oauth2.TokenSource) (devices.Registry, error) {
+	if deviceMgmtUrl == "" {
+		return nil, nil
+	}
+
+	ttl, err := time.ParseDuration(cacheTTL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache ttl %s: %w", cacheTTL, err)
+	}
+
+	httpClient := &http.Client{
+		Transport: otelhttp.NewTransport(http.DefaultTransport),
+		Timeout:   10 * time.Second,
+	}
+
+	if tokenSource != nil {
+		httpClient.Transport = &oauth2.Transport{
+			Source: tokenSource,
+			Base:   httpClient.Transport,
+		}
+	}
+
+	return devices.NewRegistry(deviceMgmtUrl, httpClient, ttl), nil
+}
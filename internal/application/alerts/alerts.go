@@ -0,0 +1,322 @@
+package alerts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/diwise/context-broker/pkg/ngsild"
+	"github.com/diwise/context-broker/pkg/ngsild/client"
+	"github.com/diwise/context-broker/pkg/ngsild/types"
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities"
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities/decorators"
+	"github.com/diwise/context-broker/pkg/ngsild/types/relationships"
+	"github.com/diwise/iot-transform-fiware/internal/application/cip"
+	helpers "github.com/diwise/iot-transform-fiware/internal/application/decorators"
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+)
+
+const (
+	AlertTypeName string = "Alert"
+	AlertIDPrefix string = "urn:ngsi-ld:" + AlertTypeName + ":"
+)
+
+// The severities of the Alert data model
+var severities = []string{"informational", "low", "medium", "high", "critical"}
+
+// Rule is a condition on a property of the entities written by the transformers. An alert is opened when an
+// entity is written with the property equal to Value, and closed when it is written with any other value.
+type Rule struct {
+	// Name identifies the rule, and is part of the ids of the alerts it opens
+	Name string `json:"name"`
+	// Kinds are the kinds of things that the rule applies to, such as watermeter or sewer, every kind if empty
+	Kinds    []string `json:"kinds,omitempty"`
+	Property string   `json:"property"`
+	Value    any      `json:"value"`
+
+	Category    string `json:"category"`
+	SubCategory string `json:"subCategory,omitempty"`
+	Severity    string `json:"severity"`
+	Description string `json:"description,omitempty"`
+}
+
+func (r Rule) appliesTo(kind string) bool {
+	return len(r.Kinds) == 0 || slices.Contains(r.Kinds, kind)
+}
+
+func (r Rule) validate() error {
+	if r.Name == "" || r.Property == "" || r.Value == nil || r.Category == "" {
+		return fmt.Errorf("rule %q must have a name, property, value and category", r.Name)
+	}
+
+	if !slices.Contains(severities, r.Severity) {
+		return fmt.Errorf("rule %q has unknown severity %q, expected one of %s", r.Name, r.Severity, strings.Join(severities, ", "))
+	}
+
+	return nil
+}
+
+// DefaultRules returns the rules that alerts are opened by unless configured otherwise, i.e. for the alarms of
+// water meters and overflowing sewers
+func DefaultRules() []Rule {
+	return []Rule{
+		{Name: "leakage", Kinds: []string{"watermeter"}, Property: "alarmStopsLeaks", Value: 1.0, Category: "environment", SubCategory: "waterLeakage", Severity: "high", Description: "Water meter reports a leak"},
+		{Name: "tamper", Kinds: []string{"watermeter"}, Property: "alarmTamper", Value: 1.0, Category: "security", SubCategory: "tampering", Severity: "medium", Description: "Water meter has been tampered with"},
+		{Name: "backflow", Kinds: []string{"watermeter"}, Property: "alarmWaterQuality", Value: 1.0, Category: "health", SubCategory: "waterBackflow", Severity: "high", Description: "Water meter reports backflow"},
+		{Name: "burst", Kinds: []string{"watermeter"}, Property: "alarmBurst", Value: 1.0, Category: "environment", SubCategory: "pipeBurst", Severity: "critical", Description: "Water meter reports a burst pipe"},
+		{Name: "overflow", Kinds: []string{"sewer"}, Property: "status", Value: "true", Category: "environment", SubCategory: "sewerOverflow", Severity: "high", Description: "Sewer is overflowing"},
+	}
+}
+
+// LoadRules reads rules from a JSON array
+func LoadRules(r io.Reader) ([]Rule, error) {
+	rules := []Rule{}
+
+	err := json.NewDecoder(r).Decode(&rules)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode alert rules: %w", err)
+	}
+
+	names := map[string]bool{}
+
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return nil, err
+		}
+
+		if names[rule.Name] {
+			return nil, fmt.Errorf("rule %q is declared more than once", rule.Name)
+		}
+		names[rule.Name] = true
+	}
+
+	return rules, nil
+}
+
+// NewClientFactory returns a factory for context broker clients that evaluate rules against every entity that is
+// created or merged through them, and open and close alerts accordingly. Without rules cbClientFn is returned as is.
+func NewClientFactory(cbClientFn func(string) client.ContextBrokerClient, rules []Rule) func(string) client.ContextBrokerClient {
+	if len(rules) == 0 {
+		return cbClientFn
+	}
+
+	a := &alerting{rules: rules}
+
+	return func(tenant string) client.ContextBrokerClient {
+		return &alertingClient{ContextBrokerClient: cbClientFn(tenant), tenant: tenant, alerting: a}
+	}
+}
+
+// alerting is shared by every client from the same factory
+type alerting struct {
+	rules []Rule
+}
+
+type kindContextKey struct{}
+
+// NewContextWithKind returns a copy of ctx in which the entities that are written are those of a thing of kind,
+// such as watermeter or sewer, that the rules are matched against
+func NewContextWithKind(ctx context.Context, kind string) context.Context {
+	return context.WithValue(ctx, kindContextKey{}, kind)
+}
+
+func kindFromContext(ctx context.Context) string {
+	kind, _ := ctx.Value(kindContextKey{}).(string)
+	return kind
+}
+
+type alertingClient struct {
+	client.ContextBrokerClient
+	tenant   string
+	alerting *alerting
+}
+
+func (c *alertingClient) CreateEntity(ctx context.Context, entity types.Entity, headers map[string][]string) (*ngsild.CreateEntityResult, error) {
+	result, err := c.ContextBrokerClient.CreateEntity(ctx, entity, headers)
+	if err == nil {
+		c.evaluate(ctx, entity.ID(), entity)
+	}
+	return result, err
+}
+
+func (c *alertingClient) MergeEntity(ctx context.Context, entityID string, fragment types.EntityFragment, headers map[string][]string) (*ngsild.MergeEntityResult, error) {
+	result, err := c.ContextBrokerClient.MergeEntity(ctx, entityID, fragment, headers)
+	if err == nil {
+		c.evaluate(ctx, entityID, fragment)
+	}
+	return result, err
+}
+
+// property is a property as it is written to the context broker
+type property struct {
+	Value      any    `json:"value"`
+	ObservedAt string `json:"observedAt,omitempty"`
+}
+
+// evaluate opens and closes the alerts of entityID according to the properties in fragment and the kind of thing
+// that it is written for. Alerts are written without evaluating them in turn, and a failure to do so is only
+// logged since the entity itself has been written.
+func (c *alertingClient) evaluate(ctx context.Context, entityID string, fragment types.EntityFragment) {
+	if strings.HasPrefix(entityID, AlertIDPrefix) {
+		return
+	}
+
+	kind := kindFromContext(ctx)
+
+	log := logging.GetFromContext(ctx).With(slog.String("entity_id", entityID))
+
+	var props map[string]json.RawMessage
+
+	b, err := fragment.MarshalJSON()
+	if err == nil {
+		err = json.Unmarshal(b, &props)
+	}
+	if err != nil {
+		log.Error("failed to read properties for alert rules", "err", err.Error())
+		return
+	}
+
+	for _, rule := range c.alerting.rules {
+		raw, ok := props[rule.Property]
+		if !ok || !rule.appliesTo(kind) {
+			continue
+		}
+
+		p := property{}
+		if json.Unmarshal(raw, &p) != nil {
+			continue
+		}
+
+		at := time.Now().UTC()
+		if ts, err := time.Parse(time.RFC3339, p.ObservedAt); err == nil {
+			at = ts.UTC()
+		}
+
+		err := c.apply(ctx, rule, entityID, reflect.DeepEqual(p.Value, rule.Value), at)
+		if err != nil {
+			log.Error("failed to write alert", slog.String("rule", rule.Name), "err", err.Error())
+		}
+	}
+}
+
+// openAlert is an alert that has been opened and not yet closed
+type openAlert struct {
+	ID       string    `json:"id"`
+	OpenedAt time.Time `json:"openedAt"`
+}
+
+// apply opens an alert by rule about entityID if active and there is none open, and closes the open alert if
+// not active. An alarm that is reported again while its alert is open is thus not reported twice. The alert is
+// locked while its state changes, but not while it is written, so that other alerts are not held up by the
+// context broker. Its state is restored if it could not be written, so that the next report tries again.
+func (c *alertingClient) apply(ctx context.Context, rule Rule, entityID string, active bool, at time.Time) error {
+	key := state.NewKey(c.tenant, entityID, "alert:"+rule.Name)
+
+	open, changed, err := transition(ctx, key, active, AlertID(rule.Name, entityID, at), at)
+	if err != nil || !changed {
+		return err
+	}
+
+	if !active {
+		err = cip.MergeIfExists(ctx, c.ContextBrokerClient, open.ID, []entities.EntityDecoratorFunc{
+			decorators.DateTime("validTo", helpers.FormatTime(at)),
+		})
+	} else {
+		props := Properties(rule.Category, rule.SubCategory, rule.Severity, rule.Description, entityID, at, at)
+		props = append(props, helpers.Name(rule.Name))
+
+		err = cip.MergeOrCreate(ctx, c.ContextBrokerClient, open.ID, AlertTypeName, props)
+	}
+
+	if err != nil {
+		return errors.Join(err, restore(ctx, key, open, active))
+	}
+
+	return nil
+}
+
+// transition opens, or closes, the alert stored for key unless it already is, and returns the alert and whether
+// it was changed
+func transition(ctx context.Context, key state.Key, active bool, id string, at time.Time) (openAlert, bool, error) {
+	store := state.GetFromContext(ctx)
+
+	unlock := state.Lock(key)
+	defer unlock()
+
+	open := openAlert{}
+	found, err := store.Get(ctx, key, &open)
+	if err != nil {
+		return open, false, fmt.Errorf("failed to load open alert: %w", err)
+	}
+
+	if active == found {
+		return open, false, nil
+	}
+
+	if !active {
+		return open, true, store.Delete(ctx, key)
+	}
+
+	open = openAlert{ID: id, OpenedAt: at}
+
+	return open, true, store.Set(ctx, key, open, 0)
+}
+
+// restore undoes the transition of the alert stored for key to open, or closed if not active, unless the alert
+// has changed since
+func restore(ctx context.Context, key state.Key, open openAlert, active bool) error {
+	store := state.GetFromContext(ctx)
+
+	unlock := state.Lock(key)
+	defer unlock()
+
+	current := openAlert{}
+	found, err := store.Get(ctx, key, &current)
+	if err != nil {
+		return fmt.Errorf("failed to load open alert: %w", err)
+	}
+
+	if active && found && current.ID == open.ID {
+		return store.Delete(ctx, key)
+	}
+
+	if !active && !found {
+		return store.Set(ctx, key, open, 0)
+	}
+
+	return nil
+}
+
+// AlertID returns the id of an alert named name about the entity sourceID that was opened at openedAt
+func AlertID(name, sourceID string, openedAt time.Time) string {
+	return fmt.Sprintf("%s%s:%s:%s", AlertIDPrefix, name, strings.TrimPrefix(sourceID, "urn:ngsi-ld:"), openedAt.UTC().Format("20060102T150405Z"))
+}
+
+// Properties returns the properties of an alert about the entity sourceID, valid from validFrom and issued at issuedAt
+func Properties(category, subCategory, severity, description, sourceID string, validFrom, issuedAt time.Time) []entities.EntityDecoratorFunc {
+	props := []entities.EntityDecoratorFunc{
+		decorators.Text("category", category),
+		decorators.Text("severity", severity),
+		entities.R("alertSource", relationships.NewSingleObjectRelationship(sourceID)),
+		decorators.DateTime("dateIssued", helpers.FormatTime(issuedAt)),
+		decorators.DateTime("validFrom", helpers.FormatTime(validFrom)),
+	}
+
+	if subCategory != "" {
+		props = append(props, decorators.Text("subCategory", subCategory))
+	}
+
+	if description != "" {
+		props = append(props, decorators.Description(description))
+	}
+
+	return props
+}
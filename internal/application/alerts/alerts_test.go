@@ -0,0 +1,175 @@
+package alerts
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/diwise/context-broker/pkg/ngsild"
+	"github.com/diwise/context-broker/pkg/ngsild/client"
+	"github.com/diwise/context-broker/pkg/ngsild/types"
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities"
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities/decorators"
+	testClient "github.com/diwise/context-broker/pkg/test"
+	"github.com/diwise/iot-transform-fiware/internal/application/cip"
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
+	"github.com/matryer/is"
+
+	. "github.com/diwise/context-broker/pkg/ngsild/types/properties"
+)
+
+func TestThatRepeatedAlarmsOpenOneAlertThatIsClosed(t *testing.T) {
+	is := is.New(t)
+
+	merged := map[string][]string{}
+	cb := &testClient.ContextBrokerClientMock{
+		MergeEntityFunc: func(ctx context.Context, entityID string, fragment types.EntityFragment, headers map[string][]string) (*ngsild.MergeEntityResult, error) {
+			b, _ := json.Marshal(fragment)
+			merged[entityID] = append(merged[entityID], string(b))
+			return &ngsild.MergeEntityResult{}, nil
+		},
+	}
+
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+	cbClientFn := NewClientFactory(func(string) client.ContextBrokerClient { return cb }, DefaultRules())
+
+	meter := func(leak float64, observedAt string) {
+		err := cip.MergeOrCreate(NewContextWithKind(ctx, "watermeter"), cbClientFn("default"), "urn:ngsi-ld:WaterConsumptionObserved:wm-1", "WaterConsumptionObserved", []entities.EntityDecoratorFunc{
+			decorators.Number("alarmStopsLeaks", leak, ObservedAt(observedAt)),
+		})
+		is.NoErr(err)
+	}
+
+	meter(0, "2024-11-19T06:00:00Z")
+	meter(1, "2024-11-19T07:00:00Z")
+	meter(1, "2024-11-19T08:00:00Z")
+	meter(0, "2024-11-19T09:00:00Z")
+
+	const alertID = "urn:ngsi-ld:Alert:leakage:WaterConsumptionObserved:wm-1:20241119T070000Z"
+
+	is.Equal(len(merged), 2)          // the water meter and one alert
+	is.Equal(len(merged[alertID]), 2) // opened and closed
+	is.True(strings.Contains(merged[alertID][0], `"alertSource":{"type":"Relationship","object":"urn:ngsi-ld:WaterConsumptionObserved:wm-1"}`))
+	is.True(strings.Contains(merged[alertID][0], `"severity":{"type":"Property","value":"high"}`))
+	is.True(strings.Contains(merged[alertID][0], `"validFrom":{"type":"Property","value":{"@type":"DateTime","@value":"2024-11-19T07:00:00Z"}}`))
+	is.True(strings.Contains(merged[alertID][1], `"validTo":{"type":"Property","value":{"@type":"DateTime","@value":"2024-11-19T09:00:00Z"}}`))
+}
+
+func TestThatRulesOnlyApplyToTheirKinds(t *testing.T) {
+	is := is.New(t)
+
+	merged := []string{}
+	cb := &testClient.ContextBrokerClientMock{
+		MergeEntityFunc: func(ctx context.Context, entityID string, fragment types.EntityFragment, headers map[string][]string) (*ngsild.MergeEntityResult, error) {
+			merged = append(merged, entityID)
+			return &ngsild.MergeEntityResult{}, nil
+		},
+	}
+
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+	cbClientFn := NewClientFactory(func(string) client.ContextBrokerClient { return cb }, DefaultRules())
+
+	err := cip.MergeOrCreate(NewContextWithKind(ctx, "desk"), cbClientFn("default"), "urn:ngsi-ld:Device:desk-1", "Device", []entities.EntityDecoratorFunc{
+		decorators.Status("true"),
+	})
+	is.NoErr(err)
+
+	is.Equal(merged, []string{"urn:ngsi-ld:Device:desk-1"}) // the overflow rule only applies to sewers
+
+	err = cip.MergeOrCreate(NewContextWithKind(ctx, "sewer"), cbClientFn("default"), "urn:ngsi-ld:Sewer:s-1", "Sewer", []entities.EntityDecoratorFunc{
+		decorators.Status("true"),
+	})
+	is.NoErr(err)
+
+	is.Equal(len(merged), 3) // the sewer and its alert
+}
+
+func TestThatAnAlertThatFailedToBeWrittenIsRetried(t *testing.T) {
+	is := is.New(t)
+
+	failing := true
+	alerts := []string{}
+	cb := &testClient.ContextBrokerClientMock{
+		MergeEntityFunc: func(ctx context.Context, entityID string, fragment types.EntityFragment, headers map[string][]string) (*ngsild.MergeEntityResult, error) {
+			if strings.HasPrefix(entityID, AlertIDPrefix) {
+				if failing {
+					return nil, errors.New("unavailable")
+				}
+				alerts = append(alerts, entityID)
+			}
+			return &ngsild.MergeEntityResult{}, nil
+		},
+	}
+
+	ctx := NewContextWithKind(state.NewContextWithStore(context.Background(), state.NewInMemoryStore()), "watermeter")
+	cbClientFn := NewClientFactory(func(string) client.ContextBrokerClient { return cb }, DefaultRules())
+
+	burst := func(observedAt string) {
+		err := cip.MergeOrCreate(ctx, cbClientFn("default"), "urn:ngsi-ld:WaterConsumptionObserved:wm-1", "WaterConsumptionObserved", []entities.EntityDecoratorFunc{
+			decorators.Number("alarmBurst", 1, ObservedAt(observedAt)),
+		})
+		is.NoErr(err)
+	}
+
+	burst("2024-11-19T07:00:00Z")
+	failing = false
+	burst("2024-11-19T08:00:00Z")
+	burst("2024-11-19T09:00:00Z")
+
+	is.Equal(alerts, []string{"urn:ngsi-ld:Alert:burst:WaterConsumptionObserved:wm-1:20241119T080000Z"})
+}
+
+func TestThatConcurrentAlarmsOpenOneAlert(t *testing.T) {
+	is := is.New(t)
+
+	var mu sync.Mutex
+	alerts := map[string]int{}
+	cb := &testClient.ContextBrokerClientMock{
+		MergeEntityFunc: func(ctx context.Context, entityID string, fragment types.EntityFragment, headers map[string][]string) (*ngsild.MergeEntityResult, error) {
+			if strings.HasPrefix(entityID, AlertIDPrefix) {
+				mu.Lock()
+				alerts[entityID]++
+				mu.Unlock()
+			}
+			return &ngsild.MergeEntityResult{}, nil
+		},
+	}
+
+	ctx := NewContextWithKind(state.NewContextWithStore(context.Background(), state.NewInMemoryStore()), "watermeter")
+	cbClientFn := NewClientFactory(func(string) client.ContextBrokerClient { return cb }, DefaultRules())
+
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := cip.MergeOrCreate(ctx, cbClientFn("default"), "urn:ngsi-ld:WaterConsumptionObserved:wm-1", "WaterConsumptionObserved", []entities.EntityDecoratorFunc{
+				decorators.Number("alarmTamper", 1, ObservedAt(fmt.Sprintf("2024-11-19T07:%02d:00Z", i))),
+			})
+			is.NoErr(err)
+		}()
+	}
+	wg.Wait()
+
+	is.Equal(len(alerts), 1)
+}
+
+func TestLoadRules(t *testing.T) {
+	is := is.New(t)
+
+	rules, err := LoadRules(strings.NewReader(`[{"name":"full","kinds":["container"],"property":"status","value":"full","category":"environment","severity":"low"}]`))
+	is.NoErr(err)
+	is.Equal(len(rules), 1)
+	is.True(rules[0].appliesTo("container"))
+	is.True(!rules[0].appliesTo("sewer"))
+
+	_, err = LoadRules(strings.NewReader(`[{"name":"full","property":"status","value":"full","category":"environment","severity":"urgent"}]`))
+	is.True(err != nil)
+
+	_, err = LoadRules(strings.NewReader(`[{"name":"full","property":"status","category":"environment","severity":"low"}]`))
+	is.True(err != nil) // without a value
+}
@@ -87,6 +87,47 @@ func MergeOrCreate(ctx context.Context, cbClient client.ContextBrokerClient, id
 	return nil
 }
 
+// MergeIfExists merges properties into the entity with the given id, but unlike MergeOrCreate it does not
+// create the entity if it does not exist
+func MergeIfExists(ctx context.Context, cbClient client.ContextBrokerClient, id string, properties []entities.EntityDecoratorFunc) error {
+	unlock := locks.lock(id)
+	defer unlock()
+
+	log := logging.GetFromContext(ctx).With("entity_id", id)
+	ctx = logging.NewContextWithLogger(ctx, log)
+
+	err := mergeEntity(ctx, cbClient, id, properties)
+	if errors.Is(err, errEntityNotFound) {
+		log.Debug("entity does not exist, nothing to merge")
+		return nil
+	}
+
+	return err
+}
+
+// Delete deletes the entity with the given id, holding the same lock as MergeOrCreate so that a deletion is not
+// interleaved with a write to the same entity. Deleting an entity that does not exist is not an error.
+func Delete(ctx context.Context, cbClient client.ContextBrokerClient, id string) error {
+	unlock := locks.lock(id)
+	defer unlock()
+
+	log := logging.GetFromContext(ctx).With("entity_id", id)
+
+	_, err := cbClient.DeleteEntity(ctx, id)
+	if err != nil {
+		if errors.Is(err, ngsilderrors.ErrNotFound) {
+			log.Debug("entity does not exist, nothing to delete")
+			return nil
+		}
+
+		return fmt.Errorf("failed to delete entity %s: %w", id, err)
+	}
+
+	log.Debug("entity deleted")
+
+	return nil
+}
+
 /*func CreateIfNotExists(ctx context.Context, cbClient client.ContextBrokerClient, id string, typeName string, properties []entities.EntityDecoratorFunc) error {
 	unlock := locks.lock(id)
 	defer unlock()
@@ -1,8 +1,17 @@
 package cip
 
 import (
+	"context"
+	"errors"
 	"testing"
 	"time"
+
+	"github.com/diwise/context-broker/pkg/ngsild"
+	ngsilderrors "github.com/diwise/context-broker/pkg/ngsild/errors"
+	"github.com/diwise/context-broker/pkg/ngsild/types"
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities"
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities/decorators"
+	testClient "github.com/diwise/context-broker/pkg/test"
 )
 
 func TestKeyedLocksSerializesSameKey(t *testing.T) {
@@ -84,3 +93,46 @@ func TestKeyedLocksRemovesEntryAfterLastUnlock(t *testing.T) {
 		t.Fatalf("expected lock entry to be removed after unlock, got %d entries", len(kl.locks))
 	}
 }
+
+func TestDeleteIgnoresEntitiesThatDoNotExist(t *testing.T) {
+	cb := &testClient.ContextBrokerClientMock{
+		DeleteEntityFunc: func(ctx context.Context, entityID string) (*ngsild.DeleteEntityResult, error) {
+			return nil, ngsilderrors.ErrNotFound
+		},
+	}
+
+	err := Delete(context.Background(), cb, "urn:ngsi-ld:Sewer:01")
+	if err != nil {
+		t.Fatalf("expected no error when deleting an entity that does not exist, got %s", err.Error())
+	}
+}
+
+func TestDeleteReturnsOtherErrors(t *testing.T) {
+	cb := &testClient.ContextBrokerClientMock{
+		DeleteEntityFunc: func(ctx context.Context, entityID string) (*ngsild.DeleteEntityResult, error) {
+			return nil, errors.New("unavailable")
+		},
+	}
+
+	err := Delete(context.Background(), cb, "urn:ngsi-ld:Sewer:01")
+	if err == nil {
+		t.Fatal("expected an error when the context broker fails")
+	}
+}
+
+func TestMergeIfExistsDoesNotCreateEntities(t *testing.T) {
+	cb := &testClient.ContextBrokerClientMock{
+		MergeEntityFunc: func(ctx context.Context, entityID string, fragment types.EntityFragment, headers map[string][]string) (*ngsild.MergeEntityResult, error) {
+			return nil, ngsilderrors.ErrNotFound
+		},
+	}
+
+	err := MergeIfExists(context.Background(), cb, "urn:ngsi-ld:Sewer:01", []entities.EntityDecoratorFunc{decorators.Text("operationalStatus", "inactive")})
+	if err != nil {
+		t.Fatalf("expected no error when merging into an entity that does not exist, got %s", err.Error())
+	}
+
+	if len(cb.CreateEntityCalls()) != 0 {
+		t.Fatal("expected no entity to be created")
+	}
+}
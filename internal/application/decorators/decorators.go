@@ -1,6 +1,7 @@
 package decorators
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/diwise/context-broker/pkg/ngsild/types/entities"
@@ -80,3 +81,74 @@ func RefLocation(entityID string) entities.EntityDecoratorFunc {
 func FormatTime(ts time.Time) string {
 	return ts.UTC().Format(time.RFC3339)
 }
+
+// NumberInstance is one instance of a number property that is distinguished from
+// the other instances of the same property by its datasetId
+type NumberInstance struct {
+	DatasetID  string
+	Value      float64
+	ObservedAt time.Time
+}
+
+type numberInstance struct {
+	properties.NumberProperty
+	DatasetID string `json:"datasetId,omitempty"`
+}
+
+type multiAttribute []numberInstance
+
+func (ma multiAttribute) Type() string {
+	return "Property"
+}
+
+func (ma multiAttribute) Value() any {
+	return []numberInstance(ma)
+}
+
+func (ma multiAttribute) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]numberInstance(ma))
+}
+
+// Numbers returns a number property with one value per instance. A single instance without
+// a datasetId becomes an ordinary property, otherwise the instances are published as an
+// NGSI-LD multi-attribute.
+func Numbers(name string, instances []NumberInstance, propDecorators ...properties.NumberPropertyDecoratorFunc) entities.EntityDecoratorFunc {
+	if len(instances) == 1 && instances[0].DatasetID == "" {
+		propDecorators = append(propDecorators, properties.ObservedAt(FormatTime(instances[0].ObservedAt)))
+		return decorators.Number(name, instances[0].Value, propDecorators...)
+	}
+
+	ma := make(multiAttribute, 0, len(instances))
+
+	for _, i := range instances {
+		np := properties.NewNumberProperty(i.Value)
+		for _, decorate := range append(propDecorators, properties.ObservedAt(FormatTime(i.ObservedAt))) {
+			decorate(np)
+		}
+
+		ma = append(ma, numberInstance{NumberProperty: *np, DatasetID: i.DatasetID})
+	}
+
+	return entities.P(name, ma)
+}
+
+type structuredProperty struct {
+	properties.PropertyImpl
+	Val any `json:"value"`
+}
+
+func (sp *structuredProperty) Type() string {
+	return sp.PropertyImpl.Type
+}
+
+func (sp *structuredProperty) Value() any {
+	return sp.Val
+}
+
+// Structured returns a property whose value is a json object, such as an address
+func Structured(name string, value any) entities.EntityDecoratorFunc {
+	return entities.P(name, &structuredProperty{
+		PropertyImpl: properties.PropertyImpl{Type: "Property"},
+		Val:          value,
+	})
+}
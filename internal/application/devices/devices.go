@@ -0,0 +1,175 @@
+package devices
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Device is the subset of the device metadata in iot-device-mgmt that is used to enrich entities
+type Device struct {
+	DeviceID      string        `json:"deviceID"`
+	SensorID      string        `json:"sensorID,omitempty"`
+	Tenant        string        `json:"tenant"`
+	Name          string        `json:"name,omitempty"`
+	Description   string        `json:"description,omitempty"`
+	Location      Location      `json:"location"`
+	Environment   string        `json:"environment,omitempty"`
+	DeviceProfile DeviceProfile `json:"deviceProfile"`
+	// Things are the ids of the things that the device is linked to
+	Things []string `json:"things,omitempty"`
+}
+
+// DeviceProfile describes the type of a device
+type DeviceProfile struct {
+	Name string `json:"name"`
+}
+
+type Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+func (l Location) IsZero() bool {
+	return l.Latitude == 0 && l.Longitude == 0
+}
+
+// Registry looks up metadata about devices
+type Registry interface {
+	Find(ctx context.Context, deviceID string) (Device, error)
+}
+
+var (
+	ErrNotFound    = errors.New("device not found")
+	ErrUnavailable = errors.New("device registry is unavailable")
+)
+
+// retryAfter is how long the registry is left alone after it failed to respond, so that messages are not held up
+// waiting for a registry that is down
+const retryAfter = 30 * time.Second
+
+type cacheEntry struct {
+	device    Device
+	err       error
+	fetchedAt time.Time
+}
+
+type client struct {
+	url        string
+	httpClient *http.Client
+	ttl        time.Duration
+	now        func() time.Time
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+	// unavailableUntil is when the registry is asked again after it failed to respond
+	unavailableUntil time.Time
+}
+
+// NewRegistry returns a registry that fetches devices from the iot-device-mgmt API at url and
+// caches them for ttl. If the API is unavailable a previously fetched device is returned even
+// if it is older than ttl, and the API is not asked again until retryAfter has passed.
+func NewRegistry(url string, httpClient *http.Client, ttl time.Duration) Registry {
+	return &client{
+		url:        strings.TrimSuffix(url, "/"),
+		httpClient: httpClient,
+		ttl:        ttl,
+		now:        time.Now,
+		cache:      make(map[string]cacheEntry),
+	}
+}
+
+func (c *client) Find(ctx context.Context, deviceID string) (Device, error) {
+	c.mu.Lock()
+	cached, ok := c.cache[deviceID]
+	unavailable := c.now().Before(c.unavailableUntil)
+	c.mu.Unlock()
+
+	if ok && c.now().Sub(cached.fetchedAt) < c.ttl {
+		return cached.device, cached.err
+	}
+
+	var d Device
+	var err error
+
+	if unavailable {
+		err = ErrUnavailable
+	} else {
+		d, err = c.fetch(ctx, deviceID)
+	}
+
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		if !unavailable {
+			c.mu.Lock()
+			c.unavailableUntil = c.now().Add(retryAfter)
+			c.mu.Unlock()
+		}
+
+		if ok && cached.err == nil {
+			return cached.device, nil
+		}
+
+		return Device{}, err
+	}
+
+	c.mu.Lock()
+	c.cache[deviceID] = cacheEntry{device: d, err: err, fetchedAt: c.now()}
+	c.mu.Unlock()
+
+	return d, err
+}
+
+func (c *client) fetch(ctx context.Context, deviceID string) (Device, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/api/v0/devices/%s", c.url, url.PathEscape(deviceID)), nil)
+	if err != nil {
+		return Device{}, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return Device{}, fmt.Errorf("failed to retrieve device %s: %w", deviceID, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return Device{}, ErrNotFound
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return Device{}, fmt.Errorf("failed to retrieve device %s, unexpected response code %d", deviceID, resp.StatusCode)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Device{}, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	d := Device{}
+	err = json.Unmarshal(b, &d)
+	if err != nil {
+		return Device{}, fmt.Errorf("failed to unmarshal device %s: %w", deviceID, err)
+	}
+
+	return d, nil
+}
+
+type deviceContextKey struct{}
+
+func NewContextWithDevice(ctx context.Context, d Device) context.Context {
+	return context.WithValue(ctx, deviceContextKey{}, d)
+}
+
+// GetFromContext returns the device metadata attached to ctx, if any
+func GetFromContext(ctx context.Context) (Device, bool) {
+	d, ok := ctx.Value(deviceContextKey{}).(Device)
+	return d, ok
+}
@@ -0,0 +1,160 @@
+package devices
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func testServer(t *testing.T, available *atomic.Bool, requests *atomic.Int32) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+
+		if !available.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		if r.URL.Path != "/api/v0/devices/watermeter-01" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(deviceJson))
+	}))
+
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func TestThatDeviceIsRetrievedAndCached(t *testing.T) {
+	is := is.New(t)
+
+	available := &atomic.Bool{}
+	available.Store(true)
+	requests := &atomic.Int32{}
+
+	s := testServer(t, available, requests)
+	r := NewRegistry(s.URL, s.Client(), time.Minute)
+
+	d, err := r.Find(context.Background(), "watermeter-01")
+	is.NoErr(err)
+	is.Equal(d.Name, "Vattenmätare 1")
+	is.Equal(d.Tenant, "default")
+	is.Equal(d.Environment, "water")
+	is.Equal(d.Location.Latitude, 62.39)
+	is.Equal(d.Things, []string{"pumphuset"})
+
+	_, err = r.Find(context.Background(), "watermeter-01")
+	is.NoErr(err)
+	is.Equal(requests.Load(), int32(1)) // second lookup should be served from the cache
+}
+
+func TestThatUnknownDeviceIsNotFound(t *testing.T) {
+	is := is.New(t)
+
+	available := &atomic.Bool{}
+	available.Store(true)
+	requests := &atomic.Int32{}
+
+	s := testServer(t, available, requests)
+	r := NewRegistry(s.URL, s.Client(), time.Minute)
+
+	_, err := r.Find(context.Background(), "unknown")
+	is.True(errors.Is(err, ErrNotFound))
+
+	_, err = r.Find(context.Background(), "unknown")
+	is.True(errors.Is(err, ErrNotFound))
+	is.Equal(requests.Load(), int32(1)) // not found should also be cached
+}
+
+func TestThatStaleDeviceIsUsedWhenRegistryIsUnavailable(t *testing.T) {
+	is := is.New(t)
+
+	available := &atomic.Bool{}
+	available.Store(true)
+	requests := &atomic.Int32{}
+
+	now := time.Now()
+
+	s := testServer(t, available, requests)
+	r := NewRegistry(s.URL, s.Client(), time.Minute).(*client)
+	r.now = func() time.Time { return now }
+
+	_, err := r.Find(context.Background(), "watermeter-01")
+	is.NoErr(err)
+
+	available.Store(false)
+	now = now.Add(2 * time.Minute)
+
+	d, err := r.Find(context.Background(), "watermeter-01")
+	is.NoErr(err)
+	is.Equal(d.Name, "Vattenmätare 1")
+	is.Equal(requests.Load(), int32(2)) // the expired entry should have been refreshed
+}
+
+func TestThatUnavailableRegistryReturnsError(t *testing.T) {
+	is := is.New(t)
+
+	available := &atomic.Bool{}
+	requests := &atomic.Int32{}
+
+	s := testServer(t, available, requests)
+	r := NewRegistry(s.URL, s.Client(), time.Minute)
+
+	_, err := r.Find(context.Background(), "watermeter-01")
+	is.True(err != nil)
+	is.True(!errors.Is(err, ErrNotFound))
+}
+
+const deviceJson string = `{
+	"active": true,
+	"sensorID": "00000000",
+	"deviceID": "watermeter-01",
+	"tenant": "default",
+	"name": "Vattenmätare 1",
+	"description": "Vattenmätare i pumphuset",
+	"location": {
+		"latitude": 62.39,
+		"longitude": 17.30
+	},
+	"environment": "water",
+	"types": ["urn:oma:lwm2m:ext:3424"],
+	"things": ["pumphuset"]
+}`
+
+func TestThatUnavailableRegistryIsNotAskedAgainUntilLater(t *testing.T) {
+	is := is.New(t)
+
+	available := &atomic.Bool{}
+	requests := &atomic.Int32{}
+
+	now := time.Now()
+
+	s := testServer(t, available, requests)
+	r := NewRegistry(s.URL, s.Client(), time.Minute).(*client)
+	r.now = func() time.Time { return now }
+
+	_, err := r.Find(context.Background(), "watermeter-01")
+	is.True(err != nil)
+
+	_, err = r.Find(context.Background(), "watermeter-02")
+	is.True(errors.Is(err, ErrUnavailable))
+	is.Equal(requests.Load(), int32(1)) // the registry is not asked while it is unavailable
+
+	available.Store(true)
+	now = now.Add(retryAfter)
+
+	d, err := r.Find(context.Background(), "watermeter-01")
+	is.NoErr(err)
+	is.Equal(d.Name, "Vattenmätare 1")
+	is.Equal(requests.Load(), int32(2))
+}
@@ -0,0 +1,302 @@
+package functions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/diwise/context-broker/pkg/datamodels/fiware"
+	"github.com/diwise/context-broker/pkg/ngsild/client"
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities"
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities/decorators"
+	"github.com/diwise/iot-transform-fiware/internal/application/cip"
+	helpers "github.com/diwise/iot-transform-fiware/internal/application/decorators"
+	"github.com/diwise/iot-transform-fiware/internal/application/things"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+
+	. "github.com/diwise/context-broker/pkg/ngsild/types/properties"
+)
+
+// The function types of iot-core
+const (
+	CounterFunctionType      string = "counter"
+	LevelFunctionType        string = "level"
+	PresenceFunctionType     string = "presence"
+	TimerFunctionType        string = "timer"
+	WaterQualityFunctionType string = "waterquality"
+)
+
+const (
+	DeviceMeasurementTypeName string = "DeviceMeasurement"
+	DeviceMeasurementIDPrefix string = "urn:ngsi-ld:" + DeviceMeasurementTypeName + ":"
+)
+
+// function is a function in iot-core, as sent on function.updated
+type function struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	SubType   string    `json:"subtype"`
+	DeviceID  string    `json:"deviceID"`
+	Location  *location `json:"location,omitempty"`
+	Tenant    string    `json:"tenant"`
+	Source    string    `json:"source,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+
+	Counter      *counter      `json:"counter,omitempty"`
+	Level        *level        `json:"level,omitempty"`
+	Presence     *presence     `json:"presence,omitempty"`
+	Timer        *timer        `json:"timer,omitempty"`
+	WaterQuality *waterQuality `json:"waterquality,omitempty"`
+}
+
+type location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+type counter struct {
+	Count int  `json:"count"`
+	State bool `json:"state"`
+}
+
+type level struct {
+	Current float64  `json:"current"`
+	Percent *float64 `json:"percent,omitempty"`
+	Offset  *float64 `json:"offset,omitempty"`
+}
+
+type presence struct {
+	State bool `json:"state"`
+}
+
+type timer struct {
+	StartTime     time.Time      `json:"startTime"`
+	EndTime       *time.Time     `json:"endTime,omitempty"`
+	Duration      *time.Duration `json:"duration,omitempty"`
+	State         bool           `json:"state"`
+	TotalDuration time.Duration  `json:"totalDuration"`
+}
+
+type waterQuality struct {
+	Temperature float64   `json:"temperature"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+// MatchFunctionType returns a filter for updated functions of functionType, of any sub type. The content type of
+// a function is application/vnd.diwise.<type>+json, or application/vnd.diwise.<type>.<sub type>+json.
+func MatchFunctionType(functionType string) messaging.MessageFilter {
+	prefix := "application/vnd.diwise." + strings.ToLower(functionType)
+
+	return func(m messaging.Message) bool {
+		ct := strings.ToLower(m.ContentType())
+		return ct == prefix+"+json" || (strings.HasPrefix(ct, prefix+".") && strings.HasSuffix(ct, "+json"))
+	}
+}
+
+func NewCounterTopicMessageHandler(messenger messaging.MsgContext, cbClientFn func(string) client.ContextBrokerClient) messaging.TopicMessageHandler {
+	return handler(CounterFunctionType, counterEntity, cbClientFn)
+}
+
+func NewLevelTopicMessageHandler(messenger messaging.MsgContext, cbClientFn func(string) client.ContextBrokerClient) messaging.TopicMessageHandler {
+	return handler(LevelFunctionType, levelEntity, cbClientFn)
+}
+
+func NewPresenceTopicMessageHandler(messenger messaging.MsgContext, cbClientFn func(string) client.ContextBrokerClient) messaging.TopicMessageHandler {
+	return handler(PresenceFunctionType, presenceEntity, cbClientFn)
+}
+
+func NewTimerTopicMessageHandler(messenger messaging.MsgContext, cbClientFn func(string) client.ContextBrokerClient) messaging.TopicMessageHandler {
+	return handler(TimerFunctionType, timerEntity, cbClientFn)
+}
+
+func NewWaterQualityTopicMessageHandler(messenger messaging.MsgContext, cbClientFn func(string) client.ContextBrokerClient) messaging.TopicMessageHandler {
+	return handler(WaterQualityFunctionType, waterQualityEntity, cbClientFn)
+}
+
+// entityFunc maps a function to the id, type and properties of the entity it is published as
+type entityFunc func(f function, observedAt time.Time) (string, string, []entities.EntityDecoratorFunc, error)
+
+// handler returns a handler for functions of functionType that publishes every function as the entity given by fn
+func handler(functionType string, fn entityFunc, cbClientFn func(string) client.ContextBrokerClient) messaging.TopicMessageHandler {
+	return func(ctx context.Context, itm messaging.IncomingTopicMessage, l *slog.Logger) {
+		log := l.With(slog.String("content_type", itm.ContentType()))
+
+		f := function{}
+		err := json.Unmarshal(itm.Body(), &f)
+		if err != nil {
+			log.Error("failed to unmarshal message body", "err", err.Error())
+			return
+		}
+
+		log = log.With(slog.String("function_id", f.ID), slog.String("tenant", f.Tenant))
+		log.Debug(functionType + " function updated")
+
+		ts := f.Timestamp.UTC()
+		if ts.IsZero() {
+			ts = time.Now().UTC()
+		}
+
+		entityID, typeName, props, err := fn(f, ts)
+		if err != nil {
+			log.Error("failed to map "+functionType+" function to entity", "err", err.Error())
+			return
+		}
+
+		props = append(props, common(f, ts)...)
+
+		log = log.With(slog.String("entity_id", entityID), slog.String("type_name", typeName))
+
+		err = cip.MergeOrCreate(logging.NewContextWithLogger(ctx, log), cbClientFn(f.Tenant), entityID, typeName, props)
+		if err != nil {
+			log.Error("failed to merge or create entity", "err", err.Error())
+			return
+		}
+
+		log.Debug(functionType + " function handled successfully")
+	}
+}
+
+// common returns the properties that every function is published with
+func common(f function, observedAt time.Time) []entities.EntityDecoratorFunc {
+	props := []entities.EntityDecoratorFunc{
+		decorators.DateObserved(helpers.FormatTime(observedAt)),
+	}
+
+	if f.Name != "" {
+		props = append(props, helpers.Name(f.Name))
+	}
+
+	if f.Location != nil {
+		props = append(props, decorators.Location(f.Location.Latitude, f.Location.Longitude))
+	}
+
+	if f.DeviceID != "" {
+		props = append(props, decorators.RefDevice(fiware.DeviceIDPrefix+f.DeviceID))
+	}
+
+	if f.Source != "" {
+		props = append(props, decorators.Source(f.Source))
+	}
+
+	return props
+}
+
+// measurement returns the properties of a DeviceMeasurement of controlledProperty with the value v
+func measurement(controlledProperty string, v float64, observedAt time.Time, unitCode string) []entities.EntityDecoratorFunc {
+	numValue := []NumberPropertyDecoratorFunc{ObservedAt(helpers.FormatTime(observedAt))}
+	if unitCode != "" {
+		numValue = append(numValue, UnitCode(unitCode))
+	}
+
+	return []entities.EntityDecoratorFunc{
+		decorators.Number("numValue", v, numValue...),
+		decorators.Text("controlledProperty", controlledProperty),
+	}
+}
+
+// counterEntity publishes people counters as CrowdFlowObserved, and other counters as DeviceMeasurement
+func counterEntity(f function, observedAt time.Time) (string, string, []entities.EntityDecoratorFunc, error) {
+	if f.Counter == nil {
+		return "", "", nil, fmt.Errorf("counter function %s without counter", f.ID)
+	}
+
+	if strings.EqualFold(f.SubType, "peoplecounter") {
+		props := []entities.EntityDecoratorFunc{
+			decorators.Number("peopleCount", float64(f.Counter.Count), ObservedAt(helpers.FormatTime(observedAt))),
+		}
+		return things.CrowdFlowObservedIDPrefix + f.ID, things.CrowdFlowObservedTypeName, props, nil
+	}
+
+	props := measurement("count", float64(f.Counter.Count), observedAt, "")
+	props = append(props, decorators.Status(onOff(f.Counter.State), TxtObservedAt(helpers.FormatTime(observedAt))))
+
+	return DeviceMeasurementIDPrefix + f.ID, DeviceMeasurementTypeName, props, nil
+}
+
+// levelEntity publishes levels as DeviceMeasurement, with the level in metres and the fill level in percent
+func levelEntity(f function, observedAt time.Time) (string, string, []entities.EntityDecoratorFunc, error) {
+	if f.Level == nil {
+		return "", "", nil, fmt.Errorf("level function %s without level", f.ID)
+	}
+
+	props := measurement("level", f.Level.Current, observedAt, "MTR")
+
+	if f.Level.Percent != nil {
+		props = append(props, helpers.FillingLevel(*f.Level.Percent, observedAt))
+	}
+
+	return DeviceMeasurementIDPrefix + f.ID, DeviceMeasurementTypeName, props, nil
+}
+
+// presenceEntity publishes presence as DeviceMeasurement of occupancy, 1 when present and 0 otherwise
+func presenceEntity(f function, observedAt time.Time) (string, string, []entities.EntityDecoratorFunc, error) {
+	if f.Presence == nil {
+		return "", "", nil, fmt.Errorf("presence function %s without presence", f.ID)
+	}
+
+	v := 0.0
+	if f.Presence.State {
+		v = 1.0
+	}
+
+	return DeviceMeasurementIDPrefix + f.ID, DeviceMeasurementTypeName, measurement("occupancy", v, observedAt, ""), nil
+}
+
+// timerEntity publishes timers as DeviceMeasurement of the duration of the latest period, in seconds, together
+// with when it started and ended and the total duration of all periods
+func timerEntity(f function, observedAt time.Time) (string, string, []entities.EntityDecoratorFunc, error) {
+	if f.Timer == nil {
+		return "", "", nil, fmt.Errorf("timer function %s without timer", f.ID)
+	}
+
+	duration := 0.0
+	if f.Timer.Duration != nil {
+		duration = f.Timer.Duration.Seconds()
+	}
+
+	props := measurement("duration", duration, observedAt, "SEC")
+	props = append(props,
+		decorators.Number("totalDuration", f.Timer.TotalDuration.Seconds(), UnitCode("SEC"), ObservedAt(helpers.FormatTime(observedAt))),
+		decorators.Status(onOff(f.Timer.State), TxtObservedAt(helpers.FormatTime(observedAt))),
+	)
+
+	if !f.Timer.StartTime.IsZero() {
+		props = append(props, decorators.DateTime("dateObservedFrom", helpers.FormatTime(f.Timer.StartTime)))
+	}
+
+	if f.Timer.EndTime != nil {
+		props = append(props, decorators.DateTime("dateObservedTo", helpers.FormatTime(*f.Timer.EndTime)))
+	}
+
+	return DeviceMeasurementIDPrefix + f.ID, DeviceMeasurementTypeName, props, nil
+}
+
+// waterQualityEntity publishes water qualities as WaterQualityObserved
+func waterQualityEntity(f function, observedAt time.Time) (string, string, []entities.EntityDecoratorFunc, error) {
+	if f.WaterQuality == nil {
+		return "", "", nil, fmt.Errorf("water quality function %s without water quality", f.ID)
+	}
+
+	ts := observedAt
+	if !f.WaterQuality.Timestamp.IsZero() {
+		ts = f.WaterQuality.Timestamp
+	}
+
+	props := []entities.EntityDecoratorFunc{
+		helpers.Temperature(f.WaterQuality.Temperature, ts),
+	}
+
+	return fiware.WaterQualityObservedIDPrefix + f.ID, fiware.WaterQualityObservedTypeName, props, nil
+}
+
+func onOff(state bool) string {
+	if state {
+		return "on"
+	}
+	return "off"
+}
@@ -0,0 +1,130 @@
+package functions
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/diwise/context-broker/pkg/ngsild"
+	"github.com/diwise/context-broker/pkg/ngsild/client"
+	"github.com/diwise/context-broker/pkg/ngsild/types"
+	testClient "github.com/diwise/context-broker/pkg/test"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/matryer/is"
+)
+
+func TestThatFunctionsAreFilteredByType(t *testing.T) {
+	is := is.New(t)
+
+	counters := MatchFunctionType(CounterFunctionType)
+
+	is.True(counters(message("application/vnd.diwise.counter+json", "")))
+	is.True(counters(message("application/vnd.diwise.Counter.PeopleCounter+json", "")))
+	is.True(!counters(message("application/vnd.diwise.counters+json", "")))
+	is.True(!counters(message("application/vnd.diwise.level.counter+json", "")))
+}
+
+func TestFunctionMessages(t *testing.T) {
+	is := is.New(t)
+
+	tests := map[string]struct {
+		handler  func(messaging.MsgContext, func(string) client.ContextBrokerClient) messaging.TopicMessageHandler
+		body     string
+		entityID string
+		contains []string
+	}{
+		"people counter": {
+			NewCounterTopicMessageHandler,
+			`{"id":"fn-01","name":"Entré","type":"counter","subtype":"peoplecounter","deviceID":"dev-01","tenant":"default","timestamp":"2024-11-19T10:00:00Z","counter":{"count":17,"state":true}}`,
+			"urn:ngsi-ld:CrowdFlowObserved:fn-01",
+			[]string{`"peopleCount":{"type":"Property","value":17,"observedAt":"2024-11-19T10:00:00Z"}`, `"refDevice":{"type":"Relationship","object":"urn:ngsi-ld:Device:dev-01"}`},
+		},
+		"counter": {
+			NewCounterTopicMessageHandler,
+			`{"id":"fn-02","type":"counter","deviceID":"dev-02","tenant":"default","timestamp":"2024-11-19T10:00:00Z","counter":{"count":3,"state":false}}`,
+			"urn:ngsi-ld:DeviceMeasurement:fn-02",
+			[]string{`"numValue":{"type":"Property","value":3,"observedAt":"2024-11-19T10:00:00Z"}`, `"controlledProperty":{"type":"Property","value":"count"}`, `"status":{"type":"Property","value":"off"`},
+		},
+		"level": {
+			NewLevelTopicMessageHandler,
+			`{"id":"fn-03","type":"level","subtype":"sand","deviceID":"dev-03","tenant":"default","timestamp":"2024-11-19T10:00:00Z","location":{"latitude":62.4,"longitude":17.3},"level":{"current":1.5,"percent":75}}`,
+			"urn:ngsi-ld:DeviceMeasurement:fn-03",
+			[]string{`"numValue":{"type":"Property","value":1.5,"observedAt":"2024-11-19T10:00:00Z","unitCode":"MTR"}`, `"fillingLevel":{"type":"Property","value":75`, `"location":{"type":"GeoProperty","value":{"type":"Point","coordinates":[17.3,62.4]}}`},
+		},
+		"presence": {
+			NewPresenceTopicMessageHandler,
+			`{"id":"fn-04","type":"presence","deviceID":"dev-04","tenant":"default","timestamp":"2024-11-19T10:00:00Z","presence":{"state":true}}`,
+			"urn:ngsi-ld:DeviceMeasurement:fn-04",
+			[]string{`"numValue":{"type":"Property","value":1,`, `"controlledProperty":{"type":"Property","value":"occupancy"}`},
+		},
+		"timer": {
+			NewTimerTopicMessageHandler,
+			`{"id":"fn-05","type":"timer","deviceID":"dev-05","tenant":"default","timestamp":"2024-11-19T10:00:00Z","timer":{"startTime":"2024-11-19T09:00:00Z","endTime":"2024-11-19T09:30:00Z","duration":1800000000000,"state":false,"totalDuration":3600000000000}}`,
+			"urn:ngsi-ld:DeviceMeasurement:fn-05",
+			[]string{`"numValue":{"type":"Property","value":1800,`, `"totalDuration":{"type":"Property","value":3600,`, `"dateObservedFrom":{"type":"Property","value":{"@type":"DateTime","@value":"2024-11-19T09:00:00Z"}}`},
+		},
+		"water quality": {
+			NewWaterQualityTopicMessageHandler,
+			`{"id":"fn-06","type":"waterquality","deviceID":"dev-06","tenant":"default","timestamp":"2024-11-19T10:00:00Z","waterquality":{"temperature":14.5,"timestamp":"2024-11-19T09:55:00Z"}}`,
+			"urn:ngsi-ld:WaterQualityObserved:fn-06",
+			[]string{`"temperature":{"type":"Property","value":14.5,"observedAt":"2024-11-19T09:55:00Z"}`},
+		},
+	}
+
+	for name, tc := range tests {
+		body := ""
+		cb := &testClient.ContextBrokerClientMock{
+			MergeEntityFunc: func(ctx context.Context, entityID string, fragment types.EntityFragment, headers map[string][]string) (*ngsild.MergeEntityResult, error) {
+				is.Equal(entityID, tc.entityID) // unexpected entity id
+				b, _ := json.Marshal(fragment)
+				body = string(b)
+				return &ngsild.MergeEntityResult{}, nil
+			},
+		}
+
+		handler := tc.handler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient { return cb })
+		handler(context.Background(), message("application/vnd.diwise."+name+"+json", tc.body), slog.Default())
+
+		is.Equal(len(cb.MergeEntityCalls()), 1) // expected the function to be published
+		for _, c := range tc.contains {
+			if !strings.Contains(body, c) {
+				t.Errorf("%s: expected %s in %s", name, c, body)
+			}
+		}
+	}
+}
+
+func TestThatFunctionsAreHandledAsSentByIoTCore(t *testing.T) {
+	is := is.New(t)
+
+	body := ""
+	cb := &testClient.ContextBrokerClientMock{
+		MergeEntityFunc: func(ctx context.Context, entityID string, fragment types.EntityFragment, headers map[string][]string) (*ngsild.MergeEntityResult, error) {
+			b, _ := json.Marshal(fragment)
+			body = string(b)
+			return &ngsild.MergeEntityResult{}, nil
+		},
+	}
+
+	// a level function that has not yet handled any measurement, as it is marshalled by iot-core
+	fn := `{"id":"fn-03","name":"","type":"level","subtype":"","deviceID":"dev-03","tenant":"default","onupdate":false,"timestamp":"0001-01-01T00:00:00Z","level":{"current":0}}`
+
+	handler := NewLevelTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient { return cb })
+	handler(context.Background(), message("application/vnd.diwise.level+json", fn), slog.Default())
+
+	is.Equal(len(cb.MergeEntityCalls()), 1)
+	is.True(strings.Contains(body, `"numValue":{"type":"Property","value":0,`))
+	is.True(!strings.Contains(body, `"fillingLevel"`))
+	is.True(!strings.Contains(body, `"name"`))
+	is.True(!strings.Contains(body, "0001-01-01"))
+}
+
+func message(contentType, body string) *messaging.IncomingTopicMessageMock {
+	return &messaging.IncomingTopicMessageMock{
+		BodyFunc:        func() []byte { return []byte(body) },
+		ContentTypeFunc: func() string { return contentType },
+		TopicNameFunc:   func() string { return "function.updated" },
+	}
+}
@@ -0,0 +1,88 @@
+package measurements
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/diwise/context-broker/pkg/ngsild/client"
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities"
+	"github.com/diwise/iot-transform-fiware/internal/application/cip"
+)
+
+// batch collects the writes of all transformers that handle parts of the same message, so that
+// properties for the same entity are merged into one write
+type batch struct {
+	ids    []string
+	writes map[string]*write
+}
+
+type write struct {
+	typeName   string
+	properties []entities.EntityDecoratorFunc
+	written    []afterWrite
+}
+
+// afterWrite is called once the entity it was derived for has been written, or with the error if it could not be,
+// to keep or undo the state that was derived for it
+type afterWrite func(ctx context.Context, err error) error
+
+func runAfterWrite(ctx context.Context, written []afterWrite, err error) error {
+	var errs []error
+
+	for _, fn := range written {
+		errs = append(errs, fn(ctx, err))
+	}
+
+	return errors.Join(errs...)
+}
+
+func newBatch() *batch {
+	return &batch{writes: map[string]*write{}}
+}
+
+func (b *batch) add(id, typeName string, properties []entities.EntityDecoratorFunc, written ...afterWrite) {
+	w, ok := b.writes[id]
+	if !ok {
+		w = &write{typeName: typeName}
+		b.writes[id] = w
+		b.ids = append(b.ids, id)
+	}
+
+	w.properties = append(w.properties, properties...)
+	w.written = append(w.written, written...)
+}
+
+func (b *batch) len() int {
+	return len(b.ids)
+}
+
+// flush merges or creates every entity in the batch, in the order they were first added, and calls what is to
+// be done once each of them has been written or has failed to be
+func (b *batch) flush(ctx context.Context, cbClient client.ContextBrokerClient) error {
+	var errs []error
+
+	for _, id := range b.ids {
+		w := b.writes[id]
+
+		err := cip.MergeOrCreate(ctx, cbClient, id, w.typeName, enrich(ctx, w.properties))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to merge or create %s: %w", id, err))
+		}
+
+		errs = append(errs, runAfterWrite(ctx, w.written, err))
+	}
+
+	return errors.Join(errs...)
+}
+
+type batchContextKey struct{}
+
+func newContextWithBatch(ctx context.Context, b *batch) context.Context {
+	return context.WithValue(ctx, batchContextKey{}, b)
+}
+
+func batchFromContext(ctx context.Context) (*batch, bool) {
+	b, ok := ctx.Value(batchContextKey{}).(*batch)
+	return b, ok
+}
@@ -0,0 +1,68 @@
+package measurements
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/diwise/iot-transform-fiware/internal/application/devices"
+)
+
+const DatasetIDPrefix string = "urn:ngsi-ld:Dataset:"
+
+// DatasetNames maps instances of LwM2M objects to the datasetId they are published with, per device type.
+// Instances are given as objectID/instanceID, for example {"elsys_ext": {"3303/0": "supply", "3303/1": "return"}}.
+// Names that are not URIs are prefixed with DatasetIDPrefix.
+type DatasetNames map[string]map[string]string
+
+// LoadDatasetNames reads dataset names, in the format described by DatasetNames, from r
+func LoadDatasetNames(r io.Reader) (DatasetNames, error) {
+	names := DatasetNames{}
+
+	err := json.NewDecoder(r).Decode(&names)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode dataset names: %w", err)
+	}
+
+	return names, nil
+}
+
+// datasetID returns the configured datasetId for an instance of an object, if there is one. An object
+// that only has its default instance in a pack is published without a datasetId, and other instances are
+// named after their object and instance id.
+func (dn DatasetNames) datasetID(deviceType string, o object, instances int) string {
+	if name, ok := dn[deviceType][o.ID+"/"+o.Instance]; ok {
+		if !strings.Contains(name, ":") {
+			name = DatasetIDPrefix + name
+		}
+		return name
+	}
+
+	if instances == 1 && o.Instance == "0" {
+		return ""
+	}
+
+	return fmt.Sprintf("%s%s:%s", DatasetIDPrefix, o.ID, o.Instance)
+}
+
+type datasetNamesContextKey struct{}
+
+func newContextWithDatasetNames(ctx context.Context, names DatasetNames) context.Context {
+	return context.WithValue(ctx, datasetNamesContextKey{}, names)
+}
+
+func datasetNamesFromContext(ctx context.Context) DatasetNames {
+	names, _ := ctx.Value(datasetNamesContextKey{}).(DatasetNames)
+	return names
+}
+
+func deviceTypeFromContext(ctx context.Context) string {
+	device, ok := devices.GetFromContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	return device.DeviceProfile.Name
+}
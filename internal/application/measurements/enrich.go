@@ -0,0 +1,65 @@
+package measurements
+
+import (
+	"context"
+	"errors"
+
+	"github.com/diwise/context-broker/pkg/ngsild/client"
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities"
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities/decorators"
+	"github.com/diwise/iot-transform-fiware/internal/application/cip"
+	"github.com/diwise/iot-transform-fiware/internal/application/devices"
+)
+
+// mergeOrCreate fills in the properties that the message did not carry from the device metadata
+// in ctx, if there is any, before the entity is merged or created. If ctx carries a batch, the write
+// is added to the batch instead. written, if any, is called once the entity has been written or has failed to be.
+func mergeOrCreate(ctx context.Context, cbClient client.ContextBrokerClient, id string, typeName string, properties []entities.EntityDecoratorFunc, written ...afterWrite) error {
+	if b, ok := batchFromContext(ctx); ok {
+		b.add(id, typeName, properties, written...)
+		return nil
+	}
+
+	err := cip.MergeOrCreate(ctx, cbClient, id, typeName, enrich(ctx, properties))
+
+	return errors.Join(err, runAfterWrite(ctx, written, err))
+}
+
+func enrich(ctx context.Context, properties []entities.EntityDecoratorFunc) []entities.EntityDecoratorFunc {
+	device, ok := devices.GetFromContext(ctx)
+	if !ok {
+		return properties
+	}
+
+	fragment, err := entities.NewFragment(properties...)
+	if err != nil {
+		return properties
+	}
+
+	present := map[string]bool{}
+	fragment.ForEachAttribute(func(_, name string, _ any) {
+		present[name] = true
+	})
+
+	if !present["location"] && !device.Location.IsZero() {
+		properties = append(properties, decorators.Location(device.Location.Latitude, device.Location.Longitude))
+	}
+
+	if !present["name"] && device.Name != "" {
+		properties = append(properties, decorators.Name(device.Name))
+	}
+
+	if !present["description"] && device.Description != "" {
+		properties = append(properties, decorators.Description(device.Description))
+	}
+
+	if !present["environment"] && device.Environment != "" {
+		properties = append(properties, decorators.Text("environment", device.Environment))
+	}
+
+	if !present["things"] && len(device.Things) > 0 {
+		properties = append(properties, decorators.TextList("things", device.Things))
+	}
+
+	return properties
+}
@@ -6,7 +6,6 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
-	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -18,7 +17,9 @@ import (
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/metric"
 
-	"github.com/diwise/iot-transform-fiware/internal/application/cip"
+	"github.com/diwise/iot-transform-fiware/internal/application/alerts"
+	"github.com/diwise/iot-transform-fiware/internal/application/devices"
+	"github.com/diwise/iot-transform-fiware/internal/application/watermeter"
 	//lint:ignore ST1001 "github.com/diwise/iot-transform-fiware/internal/application/decorators" is a valid import path
 	. "github.com/diwise/iot-transform-fiware/internal/application/decorators"
 
@@ -66,14 +67,10 @@ var (
 	ErrNoRelevantProperties = errors.New("no relevant properties were found in message")
 )
 
-func NewMeasurementTopicMessageHandler(messenger messaging.MsgContext, cbClientFn func(string) client.ContextBrokerClient) messaging.TopicMessageHandler {
-
-	getTransformer := func(m string) MeasurementTransformerFunc {
-		if mt, ok := transformers[m]; ok {
-			return mt
-		}
-		return nil
-	}
+// NewMeasurementTopicMessageHandler returns a handler that transforms accepted messages into entities. If registry
+// is not nil, the entities are enriched with metadata about the device that sent the message. Instances of
+// objects are published with the datasetIds configured in datasets for the type of device, if any.
+func NewMeasurementTopicMessageHandler(messenger messaging.MsgContext, cbClientFn func(string) client.ContextBrokerClient, registry devices.Registry, datasets DatasetNames) messaging.TopicMessageHandler {
 
 	log := logging.GetFromContext(context.Background())
 
@@ -110,14 +107,9 @@ func NewMeasurementTopicMessageHandler(messenger messaging.MsgContext, cbClientF
 
 		totalCounter.Add(ctx, 1)
 
-		measurementType := getMeasurementType(messageAccepted)
-		if measurementType == "" {
-			log.Debug("unable to determine measurement type from message, skipping")
-			return
-		}
-
-		transformer := getTransformer(measurementType)
-		if transformer == nil {
+		routes := routesOf(messageAccepted)
+		if len(routes) == 0 {
+			log.Debug("unable to find a transformer for any object in message, skipping")
 			return
 		}
 
@@ -128,23 +120,53 @@ func NewMeasurementTopicMessageHandler(messenger messaging.MsgContext, cbClientF
 		}
 
 		tenant := messageAccepted.Tenant()
+
+		if registry != nil {
+			device, err := registry.Find(ctx, deviceID)
+			if err != nil {
+				log.Warn("unable to retrieve device metadata, entity will not be enriched", slog.String("device_id", deviceID), "err", err.Error())
+			} else if tenant == "" || tenant == device.Tenant {
+				tenant = device.Tenant
+				ctx = devices.NewContextWithDevice(ctx, device)
+			}
+		}
+
 		if tenant == "" {
 			log.Debug("tenant is missing in message, skipping")
 			return
 		}
 
-		log = log.With(slog.String("device_id", deviceID), slog.String("tenant", tenant), slog.String("measurement_type", measurementType))
+		log = log.With(slog.String("device_id", deviceID), slog.String("tenant", tenant))
 		ctx = logging.NewContextWithLogger(ctx, log)
+		ctx = newContextWithDatasetNames(ctx, datasets)
 
-		err = transformer(ctx, messageAccepted, cbClientFn(tenant))
-		if err != nil {
-			if errors.Is(err, ErrNoRelevantProperties) {
-				log.Debug("message did not contain any relevant properties")
-				return
+		// the objects in the message are transformed one measurement type at a time, and all
+		// properties that end up on the same entity are then written together
+		writes := newBatch()
+		cbClient := cbClientFn(tenant)
+
+		for _, r := range routes {
+			rlog := log.With(slog.String("measurement_type", r.measurementType))
+			rctx := newContextWithBatch(logging.NewContextWithLogger(ctx, rlog), writes)
+
+			err = r.transformer(rctx, r.msg, cbClient)
+			if err != nil {
+				if errors.Is(err, ErrNoRelevantProperties) {
+					rlog.Debug("message did not contain any relevant properties")
+					continue
+				}
+
+				rlog.Error("transform failed", "err", err.Error())
 			}
+		}
 
-			log.Error("transform failed", "err", err.Error())
+		if writes.len() == 0 {
+			return
+		}
 
+		err = writes.flush(ctx, cbClient)
+		if err != nil {
+			log.Error("transform failed", "err", err.Error())
 			return
 		}
 
@@ -154,20 +176,6 @@ func NewMeasurementTopicMessageHandler(messenger messaging.MsgContext, cbClientF
 	}
 }
 
-func getMeasurementType(m events.MessageAccepted) string {
-	urn, ok := m.Pack().GetStringValue(senml.FindByName("0"))
-	if !ok {
-		return ""
-	}
-
-	env, ok := m.Pack().GetStringValue(senml.FindByName("env"))
-	if ok {
-		urn = fmt.Sprintf("%s/%s", urn, env)
-	}
-
-	return urn
-}
-
 func finder(p events.MessageAccepted, objectURN string, n int) senml.RecordFinder {
 	falseFn := func(r senml.Record) bool {
 		return false
@@ -187,17 +195,6 @@ func finder(p events.MessageAccepted, objectURN string, n int) senml.RecordFinde
 	return senml.FindByName(strconv.Itoa(n))
 }
 
-func timestamp(msg events.MessageAccepted) time.Time {
-
-	//TODO: get time from the actual record instead
-
-	ts, ok := msg.Pack().GetTime(senml.FindByName("0"))
-	if !ok {
-		return time.Now().UTC()
-	}
-	return ts
-}
-
 func AirQualityObserved(ctx context.Context, msg events.MessageAccepted, cbClient client.ContextBrokerClient) error {
 	const (
 		SensorValue         int = 5700
@@ -209,44 +206,29 @@ func AirQualityObserved(ctx context.Context, msg events.MessageAccepted, cbClien
 		NitrogenMonoxide    int = 19
 	)
 
-	properties := make([]entities.EntityDecoratorFunc, 0, 5)
-
-	temp, tempOk := msg.Pack().GetValue(finder(msg, TemperatureURN, SensorValue))
-	if tempOk {
-		properties = append(properties, Temperature(temp, timestamp(msg)))
-	}
-
-	co2, co2Ok := msg.Pack().GetValue(finder(msg, AirQualityURN, CarbonDioxide))
-	if co2Ok {
-		properties = append(properties, CO2(co2, timestamp(msg)))
-	}
-
-	pm10, pm10Ok := msg.Pack().GetValue(finder(msg, AirQualityURN, ParticulateMatter10))
-	if pm10Ok {
-		properties = append(properties, PM10(pm10, timestamp(msg)))
-	}
-
-	pm1, pm1Ok := msg.Pack().GetValue(finder(msg, AirQualityURN, ParticulateMatter1))
-	if pm1Ok {
-		properties = append(properties, PM1(pm1, timestamp(msg)))
-	}
-
-	pm25, pm25Ok := msg.Pack().GetValue(finder(msg, AirQualityURN, ParticulateMatter25))
-	if pm25Ok {
-		properties = append(properties, PM25(pm25, timestamp(msg)))
-	}
-
-	no2, no2Ok := msg.Pack().GetValue(finder(msg, AirQualityURN, NitrogenDioxide))
-	if no2Ok {
-		properties = append(properties, NO2(no2, timestamp(msg)))
-	}
+	properties := make([]entities.EntityDecoratorFunc, 0, 10)
 
-	no, noOk := msg.Pack().GetValue(finder(msg, AirQualityURN, NitrogenMonoxide))
-	if noOk {
-		properties = append(properties, NO(no, timestamp(msg)))
+	resources := []struct {
+		name      string
+		objectURN string
+		resource  int
+	}{
+		{"temperature", TemperatureURN, SensorValue},
+		{"CO2", AirQualityURN, CarbonDioxide},
+		{"PM10", AirQualityURN, ParticulateMatter10},
+		{"PM1", AirQualityURN, ParticulateMatter1},
+		{"PM25", AirQualityURN, ParticulateMatter25},
+		{"NO2", AirQualityURN, NitrogenDioxide},
+		{"NO", AirQualityURN, NitrogenMonoxide},
+	}
+
+	for _, r := range resources {
+		if values := valuesOf(ctx, msg, r.objectURN, r.resource); len(values) > 0 {
+			properties = append(properties, Numbers(r.name, values))
+		}
 	}
 
-	if !tempOk && !co2Ok && !pm10Ok && !pm1Ok && !pm25Ok && !no2Ok && !noOk {
+	if len(properties) == 0 {
 		return ErrNoRelevantProperties
 	}
 
@@ -260,7 +242,7 @@ func AirQualityObserved(ctx context.Context, msg events.MessageAccepted, cbClien
 
 	ctx = logging.NewContextWithLogger(ctx, logging.GetFromContext(ctx), slog.String("entity_id", id))
 
-	return cip.MergeOrCreate(ctx, cbClient, id, fiware.AirQualityObservedTypeName, properties)
+	return mergeOrCreate(ctx, cbClient, id, fiware.AirQualityObservedTypeName, properties)
 }
 
 func Device(ctx context.Context, msg events.MessageAccepted, cbClient client.ContextBrokerClient) error {
@@ -286,7 +268,7 @@ func Device(ctx context.Context, msg events.MessageAccepted, cbClient client.Con
 
 	ctx = logging.NewContextWithLogger(ctx, logging.GetFromContext(ctx), slog.String("entity_id", id))
 
-	return cip.MergeOrCreate(ctx, cbClient, id, fiware.DeviceTypeName, properties)
+	return mergeOrCreate(ctx, cbClient, id, fiware.DeviceTypeName, properties)
 }
 
 func GreenspaceRecord(ctx context.Context, msg events.MessageAccepted, cbClient client.ContextBrokerClient) error {
@@ -295,13 +277,22 @@ func GreenspaceRecord(ctx context.Context, msg events.MessageAccepted, cbClient
 
 	observedBy := fmt.Sprintf("%s%s", fiware.DeviceIDPrefix, msg.DeviceID())
 
-	if pr, ok := msg.Pack().GetValue(finder(msg, PressureURN, SensorValue)); ok {
-		kPa := pr / 1000.0
-		properties = append(properties, decorators.Number("soilMoisturePressure", kPa, p.UnitCode("KPA"), p.ObservedAt(msg.Timestamp.Format(time.RFC3339)), p.ObservedBy(observedBy)))
+	observedAt := func(values []NumberInstance) []NumberInstance {
+		for i := range values {
+			values[i].ObservedAt = msg.Timestamp
+		}
+		return values
+	}
+
+	if pr := valuesOf(ctx, msg, PressureURN, SensorValue); len(pr) > 0 {
+		for i := range pr {
+			pr[i].Value = pr[i].Value / 1000.0 // kPa
+		}
+		properties = append(properties, Numbers("soilMoisturePressure", observedAt(pr), p.UnitCode("KPA"), p.ObservedBy(observedBy)))
 	}
 
-	if co, ok := msg.Pack().GetValue(finder(msg, ConductivityURN, SensorValue)); ok {
-		properties = append(properties, decorators.Number("soilMoistureEc", co, p.UnitCode("MHO"), p.ObservedAt(msg.Timestamp.Format(time.RFC3339)), p.ObservedBy(observedBy)))
+	if co := valuesOf(ctx, msg, ConductivityURN, SensorValue); len(co) > 0 {
+		properties = append(properties, Numbers("soilMoistureEc", observedAt(co), p.UnitCode("MHO"), p.ObservedBy(observedBy)))
 	}
 
 	if len(properties) == 0 {
@@ -318,17 +309,17 @@ func GreenspaceRecord(ctx context.Context, msg events.MessageAccepted, cbClient
 
 	ctx = logging.NewContextWithLogger(ctx, logging.GetFromContext(ctx), slog.String("entity_id", id))
 
-	return cip.MergeOrCreate(ctx, cbClient, id, fiware.GreenspaceRecordTypeName, properties)
+	return mergeOrCreate(ctx, cbClient, id, fiware.GreenspaceRecordTypeName, properties)
 }
 func NoiseLevelObserved(ctx context.Context, msg events.MessageAccepted, cbClient client.ContextBrokerClient) error {
 	const SensorValue int = 5700
-	noise, ok := msg.Pack().GetValue(finder(msg, LoudnessURN, SensorValue))
-	if !ok {
+	noise := valuesOf(ctx, msg, LoudnessURN, SensorValue)
+	if len(noise) == 0 {
 		return ErrNoRelevantProperties
 	}
 
 	properties := []entities.EntityDecoratorFunc{
-		NoiseLevel(noise, timestamp(msg)),
+		Numbers("noiseLevel", noise),
 		decorators.DateObserved(msg.Timestamp.Format(time.RFC3339)),
 	}
 
@@ -338,7 +329,7 @@ func NoiseLevelObserved(ctx context.Context, msg events.MessageAccepted, cbClien
 
 	id := "urn:ngsi-ld:NoiseLevelObserved:" + msg.DeviceID()
 
-	return cip.MergeOrCreate(ctx, cbClient, id, "NoiseLevelObserved", properties)
+	return mergeOrCreate(ctx, cbClient, id, "NoiseLevelObserved", properties)
 }
 
 func IndoorEnvironmentObserved(ctx context.Context, msg events.MessageAccepted, cbClient client.ContextBrokerClient) error {
@@ -352,30 +343,32 @@ func IndoorEnvironmentObserved(ctx context.Context, msg events.MessageAccepted,
 
 	const (
 		ActualNumberOfPersons int = 1
+		CarbonDioxide         int = 17
 		SensorValue           int = 5700
 	)
 
-	temp, tempOk := msg.Pack().GetValue(finder(msg, TemperatureURN, SensorValue))
-	if tempOk {
-		properties = append(properties, Temperature(temp, timestamp(msg)))
+	resources := []struct {
+		name      string
+		objectURN string
+		resource  int
+	}{
+		{"temperature", TemperatureURN, SensorValue},
+		{"humidity", HumidityURN, SensorValue},
+		{"illuminance", IlluminanceURN, SensorValue},
+		{"peopleCount", PeopleCountURN, ActualNumberOfPersons},
+		{"CO2", AirQualityURN, CarbonDioxide},
 	}
 
-	humidity, humidityOk := msg.Pack().GetValue(finder(msg, HumidityURN, SensorValue))
-	if humidityOk {
-		properties = append(properties, Humidity(humidity, timestamp(msg)))
-	}
-
-	illuminance, illuminanceOk := msg.Pack().GetValue(finder(msg, IlluminanceURN, SensorValue))
-	if illuminanceOk {
-		properties = append(properties, Illuminance(illuminance, timestamp(msg)))
-	}
+	found := false
 
-	peopleCount, peopleCountOk := msg.Pack().GetValue(finder(msg, PeopleCountURN, ActualNumberOfPersons))
-	if peopleCountOk {
-		properties = append(properties, PeopleCount(peopleCount, timestamp(msg)))
+	for _, r := range resources {
+		if values := valuesOf(ctx, msg, r.objectURN, r.resource); len(values) > 0 {
+			properties = append(properties, Numbers(r.name, values))
+			found = true
+		}
 	}
 
-	if !tempOk && !humidityOk && !illuminanceOk && !peopleCountOk {
+	if !found {
 		return ErrNoRelevantProperties
 	}
 
@@ -383,7 +376,7 @@ func IndoorEnvironmentObserved(ctx context.Context, msg events.MessageAccepted,
 
 	ctx = logging.NewContextWithLogger(ctx, logging.GetFromContext(ctx), slog.String("entity_id", id))
 
-	return cip.MergeOrCreate(ctx, cbClient, id, fiware.IndoorEnvironmentObservedTypeName, properties)
+	return mergeOrCreate(ctx, cbClient, id, fiware.IndoorEnvironmentObservedTypeName, properties)
 }
 
 /*
@@ -407,12 +400,14 @@ func Lifebuoy(ctx context.Context, msg events.MessageAccepted, cbClient client.C
 	typeName := "Lifebuoy"
 	id := fmt.Sprintf("urn:ngsi-ld:%s:%s", typeName, msg.DeviceID())
 
-	return cip.MergeOrCreate(ctx, cbClient, id, typeName, properties)
+	return mergeOrCreate(ctx, cbClient, id, typeName, properties)
 }
 */
 
 func WaterConsumptionObserved(ctx context.Context, msg events.MessageAccepted, cbClient client.ContextBrokerClient) error {
 	log := logging.GetFromContext(ctx)
+	// the alarms of water meters are alerted about whether they are reported as things or as measurements
+	ctx = alerts.NewContextWithKind(ctx, "watermeter")
 	properties := make([]entities.EntityDecoratorFunc, 0, 10)
 
 	const (
@@ -431,11 +426,6 @@ func WaterConsumptionObserved(ctx context.Context, msg events.MessageAccepted, c
 		return 0
 	}
 
-	// lwm2m reports water volume in m3, but the context broker expects litres as default
-	toLtr := func(m3 float64) float64 {
-		return math.Floor((m3 + 0.0005) * 1000)
-	}
-
 	r, ok := msg.Pack().GetRecord(senml.FindByName(CumulatedWaterVolume))
 
 	if !ok {
@@ -450,21 +440,6 @@ func WaterConsumptionObserved(ctx context.Context, msg events.MessageAccepted, c
 		properties = append(properties, decorators.Location(lat, lon))
 	}
 
-	leakAlarm := toAlarmValue(finder(msg, WatermeterURN, LeakSuspected))
-	backflowAlarm := toAlarmValue(finder(msg, WatermeterURN, BackFlowDetected))
-	tamperAlarm := toAlarmValue(finder(msg, WatermeterURN, TamperDetected))
-	alarmInProgress := float64(0)
-	if leakAlarm == 1 || backflowAlarm == 1 || tamperAlarm == 1 {
-		alarmInProgress = 1
-	}
-
-	properties = append(properties,
-		decorators.Number("alarmInProgress", alarmInProgress),
-		decorators.Number("alarmStopsLeaks", leakAlarm),
-		decorators.Number("alarmTamper", tamperAlarm),
-		decorators.Number("alarmWaterQuality", backflowAlarm),
-	)
-
 	// An alternative name for this item
 	if t, ok := msg.Pack().GetStringValue(finder(msg, WatermeterURN, TypeOfMeter)); ok {
 		properties = append(properties, decorators.Text("alternateName", t))
@@ -477,12 +452,44 @@ func WaterConsumptionObserved(ctx context.Context, msg events.MessageAccepted, c
 		return fmt.Errorf("unable to get value (%t) or time (%t)", volOk, timeOk)
 	}
 
-	w := decorators.Number("waterConsumption", toLtr(vol), p.UnitCode("LTR"), p.ObservedAt(ts.Format(time.RFC3339)), p.ObservedBy(observedBy))
-	propsForEachReading := append(properties, w)
+	// lwm2m reports water volume in m3, but the context broker expects litres as default
+	litres := watermeter.ToLitres(vol)
+	observedAt := ts.Format(time.RFC3339)
+
+	reading, readingOk, err := watermeter.Update(ctx, msg.Tenant(), entityID, litres, ts)
+	if err != nil {
+		return err
+	}
+
+	leakAlarm := toAlarmValue(finder(msg, WatermeterURN, LeakSuspected))
+	backflowAlarm := toAlarmValue(finder(msg, WatermeterURN, BackFlowDetected))
+	tamperAlarm := toAlarmValue(finder(msg, WatermeterURN, TamperDetected))
+	alarmInProgress := float64(0)
+	if leakAlarm == 1 || backflowAlarm == 1 || tamperAlarm == 1 || reading.LeakSuspected || reading.CounterReset {
+		alarmInProgress = 1
+	}
+
+	properties = append(properties,
+		decorators.Number("alarmInProgress", alarmInProgress, p.ObservedAt(observedAt)),
+		decorators.Number("alarmStopsLeaks", leakAlarm, p.ObservedAt(observedAt)),
+		decorators.Number("alarmTamper", tamperAlarm, p.ObservedAt(observedAt)),
+		decorators.Number("alarmWaterQuality", backflowAlarm, p.ObservedAt(observedAt)),
+		decorators.Number("cumulativeWaterConsumption", litres, p.UnitCode("LTR"), p.ObservedAt(observedAt), p.ObservedBy(observedBy)),
+	)
+
+	properties = append(properties, watermeter.Decorators(reading, readingOk, observedAt, observedBy)...)
 
 	ctx = logging.NewContextWithLogger(ctx, logging.GetFromContext(ctx), slog.String("entity_id", entityID))
 
-	err := cip.MergeOrCreate(ctx, cbClient, entityID, fiware.WaterConsumptionObservedTypeName, propsForEachReading)
+	// a reading that could not be published is restored, so that a failed write does not lose its alarms
+	restore := func(ctx context.Context, err error) error {
+		if err == nil {
+			return nil
+		}
+		return watermeter.Restore(ctx, reading)
+	}
+
+	err = mergeOrCreate(ctx, cbClient, entityID, fiware.WaterConsumptionObservedTypeName, properties, restore)
 	if err != nil {
 		return fmt.Errorf("unable to merge or create WaterConsumptionObserved: %w", err)
 	}
@@ -494,14 +501,14 @@ func WeatherObserved(ctx context.Context, msg events.MessageAccepted, cbClient c
 	properties := make([]entities.EntityDecoratorFunc, 0, 5)
 
 	const SensorValue int = 5700
-	temp, ok := msg.Pack().GetValue(finder(msg, TemperatureURN, SensorValue))
-	if !ok {
+	temp := valuesOf(ctx, msg, TemperatureURN, SensorValue)
+	if len(temp) == 0 {
 		return fmt.Errorf("no temperature property was found in message from %s, ignoring", msg.DeviceID())
 	}
 
 	properties = append(properties,
 		decorators.DateObserved(msg.Timestamp.Format(time.RFC3339)),
-		Temperature(temp, timestamp(msg)),
+		Numbers("temperature", temp),
 	)
 
 	if src, ok := msg.Pack().GetStringValue(senml.FindByName("source")); ok {
@@ -516,5 +523,5 @@ func WeatherObserved(ctx context.Context, msg events.MessageAccepted, cbClient c
 
 	ctx = logging.NewContextWithLogger(ctx, logging.GetFromContext(ctx), slog.String("entity_id", id))
 
-	return cip.MergeOrCreate(ctx, cbClient, id, fiware.WeatherObservedTypeName, properties)
+	return mergeOrCreate(ctx, cbClient, id, fiware.WeatherObservedTypeName, properties)
 }
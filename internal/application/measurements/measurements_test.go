@@ -4,15 +4,22 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/diwise/context-broker/pkg/ngsild"
+	cbclient "github.com/diwise/context-broker/pkg/ngsild/client"
 	ngsierrors "github.com/diwise/context-broker/pkg/ngsild/errors"
 	"github.com/diwise/context-broker/pkg/ngsild/types"
 	client "github.com/diwise/context-broker/pkg/test"
 	iotcore "github.com/diwise/iot-core/pkg/messaging/events"
+	"github.com/diwise/iot-transform-fiware/internal/application/devices"
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
+	"github.com/diwise/messaging-golang/pkg/messaging"
 	"github.com/diwise/senml"
 	"github.com/google/uuid"
 
@@ -253,7 +260,7 @@ func TestThatWaterConsumptionObservedIsPatchedIfAlreadyExisting(t *testing.T) {
 		},
 	}
 
-	err := WaterConsumptionObserved(context.Background(), *msg, cbClient)
+	err := WaterConsumptionObserved(state.NewContextWithStore(context.Background(), state.NewInMemoryStore()), *msg, cbClient)
 	is.NoErr(err)
 
 	is.Equal(len(cbClient.CreateEntityCalls()), 1) // create entity should have been called once
@@ -262,7 +269,7 @@ func TestThatWaterConsumptionObservedIsPatchedIfAlreadyExisting(t *testing.T) {
 	is.Equal(cbClient.CreateEntityCalls()[0].Entity.ID(), expectedEntityID) // the entity id should be ...
 
 	b, _ := json.Marshal(cbClient.CreateEntityCalls()[0].Entity)
-	const expectedPatchBody string = `{"@context":["https://raw.githubusercontent.com/diwise/context-broker/main/assets/jsonldcontexts/default-context.jsonld"],"alarmInProgress":{"type":"Property","value":0},"alarmStopsLeaks":{"type":"Property","value":0},"alarmTamper":{"type":"Property","value":0},"alarmWaterQuality":{"type":"Property","value":0},"id":"urn:ngsi-ld:WaterConsumptionObserved:watermeter-01","location":{"type":"GeoProperty","value":{"type":"Point","coordinates":[17.509804,62.362829]}},"type":"WaterConsumptionObserved","waterConsumption":{"type":"Property","value":1009,"observedAt":"2006-01-02T15:04:05Z","observedBy":{"type":"Relationship","object":"urn:ngsi-ld:Device:watermeter-01"},"unitCode":"LTR"}}`
+	const expectedPatchBody string = `{"@context":["https://raw.githubusercontent.com/diwise/context-broker/main/assets/jsonldcontexts/default-context.jsonld"],"alarmFlowPersistence":{"type":"Property","value":0,"observedAt":"2006-01-02T15:04:05Z"},"alarmInProgress":{"type":"Property","value":0,"observedAt":"2006-01-02T15:04:05Z"},"alarmMetrology":{"type":"Property","value":0,"observedAt":"2006-01-02T15:04:05Z"},"alarmStopsLeaks":{"type":"Property","value":0,"observedAt":"2006-01-02T15:04:05Z"},"alarmTamper":{"type":"Property","value":0,"observedAt":"2006-01-02T15:04:05Z"},"alarmWaterQuality":{"type":"Property","value":0,"observedAt":"2006-01-02T15:04:05Z"},"cumulativeWaterConsumption":{"type":"Property","value":1009,"observedAt":"2006-01-02T15:04:05Z","observedBy":{"type":"Relationship","object":"urn:ngsi-ld:Device:watermeter-01"},"unitCode":"LTR"},"id":"urn:ngsi-ld:WaterConsumptionObserved:watermeter-01","location":{"type":"GeoProperty","value":{"type":"Point","coordinates":[17.509804,62.362829]}},"type":"WaterConsumptionObserved"}`
 	is.Equal(string(b), expectedPatchBody)
 }
 
@@ -295,11 +302,11 @@ func TestThatWaterConsumptionObservedIsCreatedIfNonExisting(t *testing.T) {
 		},
 	}
 
-	err := WaterConsumptionObserved(context.Background(), *msg, cbClient)
+	err := WaterConsumptionObserved(state.NewContextWithStore(context.Background(), state.NewInMemoryStore()), *msg, cbClient)
 	is.NoErr(err)
 
 	b, _ := json.Marshal(cbClient.CreateEntityCalls()[0].Entity)
-	expectedCreateBody := fmt.Sprintf(`{"@context":["https://raw.githubusercontent.com/diwise/context-broker/main/assets/jsonldcontexts/default-context.jsonld"],"alarmInProgress":{"type":"Property","value":0},"alarmStopsLeaks":{"type":"Property","value":0},"alarmTamper":{"type":"Property","value":0},"alarmWaterQuality":{"type":"Property","value":0},"id":"urn:ngsi-ld:WaterConsumptionObserved:%s","location":{"type":"GeoProperty","value":{"type":"Point","coordinates":[17.509804,62.362829]}},"type":"WaterConsumptionObserved","waterConsumption":{"type":"Property","value":1009,"observedAt":"2006-01-02T15:04:05Z","observedBy":{"type":"Relationship","object":"urn:ngsi-ld:Device:%s"},"unitCode":"LTR"}}`, devid, devid)
+	expectedCreateBody := fmt.Sprintf(`{"@context":["https://raw.githubusercontent.com/diwise/context-broker/main/assets/jsonldcontexts/default-context.jsonld"],"alarmFlowPersistence":{"type":"Property","value":0,"observedAt":"2006-01-02T15:04:05Z"},"alarmInProgress":{"type":"Property","value":0,"observedAt":"2006-01-02T15:04:05Z"},"alarmMetrology":{"type":"Property","value":0,"observedAt":"2006-01-02T15:04:05Z"},"alarmStopsLeaks":{"type":"Property","value":0,"observedAt":"2006-01-02T15:04:05Z"},"alarmTamper":{"type":"Property","value":0,"observedAt":"2006-01-02T15:04:05Z"},"alarmWaterQuality":{"type":"Property","value":0,"observedAt":"2006-01-02T15:04:05Z"},"cumulativeWaterConsumption":{"type":"Property","value":1009,"observedAt":"2006-01-02T15:04:05Z","observedBy":{"type":"Relationship","object":"urn:ngsi-ld:Device:%s"},"unitCode":"LTR"},"id":"urn:ngsi-ld:WaterConsumptionObserved:%s","location":{"type":"GeoProperty","value":{"type":"Point","coordinates":[17.509804,62.362829]}},"type":"WaterConsumptionObserved"}`, devid, devid)
 	is.Equal(string(b), expectedCreateBody)
 }
 
@@ -337,14 +344,175 @@ func TestThatWaterConsumptionObservedMapsConservativeAlarms(t *testing.T) {
 		},
 	}
 
-	err := WaterConsumptionObserved(context.Background(), *msg, cbClient)
+	err := WaterConsumptionObserved(state.NewContextWithStore(context.Background(), state.NewInMemoryStore()), *msg, cbClient)
 	is.NoErr(err)
 
 	b, _ := json.Marshal(cbClient.CreateEntityCalls()[0].Entity)
-	is.True(strings.Contains(string(b), `"alarmInProgress":{"type":"Property","value":1}`))
-	is.True(strings.Contains(string(b), `"alarmStopsLeaks":{"type":"Property","value":1}`))
-	is.True(strings.Contains(string(b), `"alarmTamper":{"type":"Property","value":1}`))
-	is.True(strings.Contains(string(b), `"alarmWaterQuality":{"type":"Property","value":0}`))
+	is.True(strings.Contains(string(b), `"alarmInProgress":{"type":"Property","value":1,"observedAt":`))
+	is.True(strings.Contains(string(b), `"alarmStopsLeaks":{"type":"Property","value":1,"observedAt":`))
+	is.True(strings.Contains(string(b), `"alarmTamper":{"type":"Property","value":1,"observedAt":`))
+	is.True(strings.Contains(string(b), `"alarmWaterQuality":{"type":"Property","value":0,"observedAt":`))
+}
+
+func TestThatWaterConsumptionObservedPublishesDeltasAndFlow(t *testing.T) {
+	is, cbClient := testSetup(t)
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+
+	t0, _ := time.Parse(time.RFC3339, "2006-01-02T12:00:00Z")
+
+	for i, v := range []float64{1.000, 1.030, 1.040} {
+		msg := iotcore.NewMessageAccepted(senml.Pack{},
+			base("urn:oma:lwm2m:ext:3424", "watermeter-01", time.Unix(0, 0)),
+			iotcore.Rec("1", "", &v, nil, float64(t0.Add(time.Duration(i)*30*time.Minute).Unix()), nil))
+
+		err := WaterConsumptionObserved(ctx, *msg, cbClient)
+		is.NoErr(err)
+	}
+
+	first, _ := json.Marshal(cbClient.CreateEntityCalls()[0].Entity)
+	is.True(!strings.Contains(string(first), `"waterConsumption"`)) // no delta can be computed from the first reading
+
+	b, _ := json.Marshal(cbClient.CreateEntityCalls()[2].Entity)
+	is.True(strings.Contains(string(b), `"waterConsumption":{"type":"Property","value":10,"observedAt":"2006-01-02T13:00:00Z"`))
+	is.True(strings.Contains(string(b), `"flow":{"type":"Property","value":20,"observedAt":"2006-01-02T13:00:00Z"`))
+	is.True(strings.Contains(string(b), `"minFlow":{"type":"Property","value":20,"observedAt":"2006-01-02T13:00:00Z","unitCode":"E32"}`))
+	is.True(strings.Contains(string(b), `"maxFlow":{"type":"Property","value":60,"observedAt":"2006-01-02T13:00:00Z","unitCode":"E32"}`))
+	is.True(strings.Contains(string(b), `"alarmFlowPersistence":{"type":"Property","value":0`))
+}
+
+func TestThatWaterConsumptionObservedFlagsCounterReset(t *testing.T) {
+	is, cbClient := testSetup(t)
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+
+	t0, _ := time.Parse(time.RFC3339, "2006-01-02T12:00:00Z")
+
+	for i, v := range []float64{11.899, 0.002} {
+		msg := iotcore.NewMessageAccepted(senml.Pack{},
+			base("urn:oma:lwm2m:ext:3424", "watermeter-01", time.Unix(0, 0)),
+			iotcore.Rec("1", "", &v, nil, float64(t0.Add(time.Duration(i)*time.Hour).Unix()), nil))
+
+		err := WaterConsumptionObserved(ctx, *msg, cbClient)
+		is.NoErr(err)
+	}
+
+	b, _ := json.Marshal(cbClient.CreateEntityCalls()[1].Entity)
+	is.True(strings.Contains(string(b), `"alarmMetrology":{"type":"Property","value":1`))
+	is.True(strings.Contains(string(b), `"alarmInProgress":{"type":"Property","value":1,"observedAt":`))
+	is.True(!strings.Contains(string(b), `"waterConsumption"`))
+}
+
+func TestThatWaterConsumptionObservedSuspectsLeakOnContinuousNightFlow(t *testing.T) {
+	is, cbClient := testSetup(t)
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+
+	t0, _ := time.Parse(time.RFC3339, "2006-01-02T21:00:00Z") // 22:00 in Europe/Stockholm
+
+	v := 1.0
+	for i := range 6 {
+		v += 0.005
+		msg := iotcore.NewMessageAccepted(senml.Pack{},
+			base("urn:oma:lwm2m:ext:3424", "watermeter-01", time.Unix(0, 0)),
+			iotcore.Rec("1", "", &v, nil, float64(t0.Add(time.Duration(i)*time.Hour).Unix()), nil))
+
+		err := WaterConsumptionObserved(ctx, *msg, cbClient)
+		is.NoErr(err)
+	}
+
+	calls := cbClient.CreateEntityCalls()
+
+	b, _ := json.Marshal(calls[3].Entity) // 01:00, flow has not yet persisted long enough
+	is.True(strings.Contains(string(b), `"alarmFlowPersistence":{"type":"Property","value":0`))
+
+	b, _ = json.Marshal(calls[5].Entity) // 03:00, continuous flow since before midnight
+	is.True(strings.Contains(string(b), `"alarmFlowPersistence":{"type":"Property","value":1`))
+	is.True(strings.Contains(string(b), `"alarmInProgress":{"type":"Property","value":1,"observedAt":`))
+}
+
+func TestThatWaterConsumptionObservedKeepsReadingsThatCouldNotBeWritten(t *testing.T) {
+	is, cbClient := testSetup(t)
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+
+	creates := 0
+	cbClient.CreateEntityFunc = func(ctx context.Context, entity types.Entity, headers map[string][]string) (*ngsild.CreateEntityResult, error) {
+		creates++
+		if creates == 2 {
+			return nil, fmt.Errorf("context broker unavailable")
+		}
+		return ngsild.NewCreateEntityResult("ignored"), nil
+	}
+
+	t0, _ := time.Parse(time.RFC3339, "2006-01-02T12:00:00Z")
+
+	for i, v := range []float64{1.000, 1.030, 1.040} {
+		msg := iotcore.NewMessageAccepted(senml.Pack{},
+			base("urn:oma:lwm2m:ext:3424", "watermeter-01", time.Unix(0, 0)),
+			iotcore.Rec("1", "", &v, nil, float64(t0.Add(time.Duration(i)*time.Hour).Unix()), nil))
+
+		err := WaterConsumptionObserved(ctx, *msg, cbClient)
+		is.Equal(err != nil, i == 1) // the second reading could not be written
+	}
+
+	b, _ := json.Marshal(cbClient.CreateEntityCalls()[2].Entity)
+	is.True(strings.Contains(string(b), `"waterConsumption":{"type":"Property","value":40,`)) // consumed since the first reading
+}
+
+func TestThatMeasurementIsEnrichedWithDeviceMetadata(t *testing.T) {
+	is, cbClient := testSetup(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"deviceID":"deviceID","tenant":"default","name":"Termometer 1","description":"Vid badplatsen","location":{"latitude":62.39,"longitude":17.30},"environment":"air","things":["badplatsen"]}`))
+	}))
+	defer ts.Close()
+
+	temp := 22.2
+	ti, _ := time.Parse(time.RFC3339, "2022-01-01T00:00:00Z")
+	msg := iotcore.NewMessageAccepted(senml.Pack{}, base("urn:oma:lwm2m:ext:3303", "deviceID", ti), iotcore.Environment("air"), iotcore.Rec("5700", "", &temp, nil, 0, nil), iotcore.Tenant("default"))
+	body, _ := json.Marshal(msg)
+
+	itm := &messaging.IncomingTopicMessageMock{
+		BodyFunc:        func() []byte { return body },
+		ContentTypeFunc: func() string { return "application/json" },
+	}
+
+	handler := NewMeasurementTopicMessageHandler(&messaging.MsgContextMock{}, func(string) cbclient.ContextBrokerClient { return cbClient }, devices.NewRegistry(ts.URL, ts.Client(), time.Minute), nil)
+	handler(context.Background(), itm, slog.Default())
+
+	is.Equal(len(cbClient.CreateEntityCalls()), 1)
+
+	b, _ := json.Marshal(cbClient.CreateEntityCalls()[0].Entity)
+	is.True(strings.Contains(string(b), `"name":{"type":"Property","value":"Termometer 1"}`))
+	is.True(strings.Contains(string(b), `"description":{"type":"Property","value":"Vid badplatsen"}`))
+	is.True(strings.Contains(string(b), `"location":{"type":"GeoProperty","value":{"type":"Point","coordinates":[17.3,62.39]}}`))
+	is.True(strings.Contains(string(b), `"things":{"type":"Property","value":["badplatsen"]}`))
+}
+
+func TestThatMeasurementIsTransformedWhenDeviceRegistryIsUnavailable(t *testing.T) {
+	is, cbClient := testSetup(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	temp := 22.2
+	ti, _ := time.Parse(time.RFC3339, "2022-01-01T00:00:00Z")
+	msg := iotcore.NewMessageAccepted(senml.Pack{}, base("urn:oma:lwm2m:ext:3303", "deviceID", ti), iotcore.Environment("air"), iotcore.Lat(62.362829), iotcore.Lon(17.509804), iotcore.Rec("5700", "", &temp, nil, 0, nil), iotcore.Tenant("default"))
+	body, _ := json.Marshal(msg)
+
+	itm := &messaging.IncomingTopicMessageMock{
+		BodyFunc:        func() []byte { return body },
+		ContentTypeFunc: func() string { return "application/json" },
+	}
+
+	handler := NewMeasurementTopicMessageHandler(&messaging.MsgContextMock{}, func(string) cbclient.ContextBrokerClient { return cbClient }, devices.NewRegistry(ts.URL, ts.Client(), time.Minute), nil)
+	handler(context.Background(), itm, slog.Default())
+
+	is.Equal(len(cbClient.CreateEntityCalls()), 1)
+
+	b, _ := json.Marshal(cbClient.CreateEntityCalls()[0].Entity)
+	is.True(strings.Contains(string(b), `"location":{"type":"GeoProperty","value":{"type":"Point","coordinates":[17.509804,62.362829]}}`))
+	is.True(!strings.Contains(string(b), `"name"`))
 }
 
 /*
@@ -394,3 +562,132 @@ const waterConsumptionJson string = `
 	"timestamp":"2025-01-15T08:29:52.83583502Z"
 }`
 */
+
+func TestThatMultipleInstancesArePublishedWithDatasetIDs(t *testing.T) {
+	is, cbClient := testSetup(t)
+
+	ti, _ := time.Parse(time.RFC3339, "2022-01-01T00:00:00Z")
+	supply, ret := 55.5, 32.0
+
+	pack := senml.Pack{
+		{BaseName: "deviceID/3303/0/", BaseTime: float64(ti.Unix()), Name: "0", StringValue: TemperatureURN},
+		{Name: "5700", Value: &supply},
+		{BaseName: "deviceID/3303/1/", Name: "0", StringValue: TemperatureURN},
+		{Name: "5700", Value: &ret},
+	}
+	msg := iotcore.NewMessageAccepted(pack)
+
+	err := WeatherObserved(context.Background(), *msg, cbClient)
+	is.NoErr(err)
+
+	b, _ := json.Marshal(cbClient.CreateEntityCalls()[0].Entity)
+	is.True(strings.Contains(string(b), `"temperature":[{"type":"Property","value":55.5,"observedAt":"2022-01-01T00:00:00Z","datasetId":"urn:ngsi-ld:Dataset:3303:0"},{"type":"Property","value":32,"observedAt":"2022-01-01T00:00:00Z","datasetId":"urn:ngsi-ld:Dataset:3303:1"}]`))
+}
+
+func TestThatDatasetIDsCanBeConfiguredPerDeviceType(t *testing.T) {
+	is, cbClient := testSetup(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"deviceID":"deviceID","tenant":"default","deviceProfile":{"name":"elsys_ext"}}`))
+	}))
+	defer ts.Close()
+
+	datasets, err := LoadDatasetNames(strings.NewReader(`{"elsys_ext":{"3303/0":"supply","3303/1":"urn:ngsi-ld:Dataset:return"}}`))
+	is.NoErr(err)
+
+	ti, _ := time.Parse(time.RFC3339, "2022-01-01T00:00:00Z")
+	supply, ret := 55.5, 32.0
+
+	// instances without an instance id in the base name are numbered in order
+	pack := senml.Pack{
+		{BaseName: "deviceID/3303/", BaseTime: float64(ti.Unix()), Name: "0", StringValue: TemperatureURN},
+		{Name: "5700", Value: &supply},
+		{Name: "0", StringValue: TemperatureURN},
+		{Name: "5700", Value: &ret},
+		{Name: "env", StringValue: "air"},
+		{Name: "tenant", StringValue: "default"},
+	}
+	body, _ := json.Marshal(iotcore.NewMessageAccepted(pack))
+
+	itm := &messaging.IncomingTopicMessageMock{
+		BodyFunc:        func() []byte { return body },
+		ContentTypeFunc: func() string { return "application/json" },
+	}
+
+	handler := NewMeasurementTopicMessageHandler(&messaging.MsgContextMock{}, func(string) cbclient.ContextBrokerClient { return cbClient }, devices.NewRegistry(ts.URL, ts.Client(), time.Minute), datasets)
+	handler(context.Background(), itm, slog.Default())
+
+	is.Equal(len(cbClient.CreateEntityCalls()), 1)
+
+	b, _ := json.Marshal(cbClient.CreateEntityCalls()[0].Entity)
+	is.True(strings.Contains(string(b), `"datasetId":"urn:ngsi-ld:Dataset:supply"`))
+	is.True(strings.Contains(string(b), `"datasetId":"urn:ngsi-ld:Dataset:return"`))
+}
+
+func TestThatObjectsInTheSamePackAreMergedIntoOneWrite(t *testing.T) {
+	is, cbClient := testSetup(t)
+
+	ti, _ := time.Parse(time.RFC3339, "2022-01-01T00:00:00Z")
+	temp, humidity, co2 := 22.2, 45.0, 600.0
+
+	pack := senml.Pack{
+		{BaseName: "deviceID/3303/", BaseTime: float64(ti.Unix()), Name: "0", StringValue: TemperatureURN},
+		{Name: "5700", Value: &temp},
+		{BaseName: "deviceID/3304/", Name: "0", StringValue: HumidityURN},
+		{Name: "5700", Value: &humidity},
+		{BaseName: "deviceID/3428/", Name: "0", StringValue: AirQualityURN},
+		{Name: "17", Value: &co2},
+		{Name: "env", StringValue: "indoors"},
+		{Name: "tenant", StringValue: "default"},
+	}
+	body, _ := json.Marshal(iotcore.NewMessageAccepted(pack))
+
+	itm := &messaging.IncomingTopicMessageMock{
+		BodyFunc:        func() []byte { return body },
+		ContentTypeFunc: func() string { return "application/json" },
+	}
+
+	handler := NewMeasurementTopicMessageHandler(&messaging.MsgContextMock{}, func(string) cbclient.ContextBrokerClient { return cbClient }, nil, nil)
+	handler(context.Background(), itm, slog.Default())
+
+	is.Equal(len(cbClient.MergeEntityCalls()), 1)
+	is.Equal(len(cbClient.CreateEntityCalls()), 1)
+
+	b, _ := json.Marshal(cbClient.CreateEntityCalls()[0].Entity)
+	is.True(strings.Contains(string(b), `"id":"urn:ngsi-ld:IndoorEnvironmentObserved:deviceID"`))
+	is.True(strings.Contains(string(b), `"temperature":{"type":"Property","value":22.2,"observedAt":"2022-01-01T00:00:00Z"}`))
+	is.True(strings.Contains(string(b), `"humidity":{"type":"Property","value":45,"observedAt":"2022-01-01T00:00:00Z"}`))
+	is.True(strings.Contains(string(b), `"CO2":{"type":"Property","value":600,"observedAt":"2022-01-01T00:00:00Z"}`))
+}
+
+func TestThatObjectsWithoutTransformerAreAvailableToOtherTransformers(t *testing.T) {
+	is, cbClient := testSetup(t)
+
+	ti, _ := time.Parse(time.RFC3339, "2022-01-01T00:00:00Z")
+	temp, pm10 := 12.5, 8.0
+
+	pack := senml.Pack{
+		{BaseName: "deviceID/3303/", BaseTime: float64(ti.Unix()), Name: "0", StringValue: TemperatureURN},
+		{Name: "5700", Value: &temp},
+		{BaseName: "deviceID/3428/", Name: "0", StringValue: AirQualityURN},
+		{Name: "1", Value: &pm10},
+		{Name: "tenant", StringValue: "default"},
+	}
+	body, _ := json.Marshal(iotcore.NewMessageAccepted(pack))
+
+	itm := &messaging.IncomingTopicMessageMock{
+		BodyFunc:        func() []byte { return body },
+		ContentTypeFunc: func() string { return "application/json" },
+	}
+
+	handler := NewMeasurementTopicMessageHandler(&messaging.MsgContextMock{}, func(string) cbclient.ContextBrokerClient { return cbClient }, nil, nil)
+	handler(context.Background(), itm, slog.Default())
+
+	is.Equal(len(cbClient.CreateEntityCalls()), 1)
+
+	b, _ := json.Marshal(cbClient.CreateEntityCalls()[0].Entity)
+	is.True(strings.Contains(string(b), `"id":"urn:ngsi-ld:AirQualityObserved:deviceID"`))
+	is.True(strings.Contains(string(b), `"PM10":{"type":"Property","value":8`))
+	is.True(strings.Contains(string(b), `"temperature":{"type":"Property","value":12.5`))
+}
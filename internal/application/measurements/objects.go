@@ -0,0 +1,195 @@
+package measurements
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/diwise/iot-core/pkg/messaging/events"
+	"github.com/diwise/senml"
+
+	//lint:ignore ST1001 "github.com/diwise/iot-transform-fiware/internal/application/decorators" is a valid import path
+	. "github.com/diwise/iot-transform-fiware/internal/application/decorators"
+)
+
+// object is one instance of an LwM2M object in a pack, together with the records that belong to it.
+// The records are normalized, except for their names which are kept relative to the object so that
+// resources can be found by their resource id.
+type object struct {
+	URN      string
+	ID       string
+	Instance string
+	BaseName string
+	Time     time.Time
+	Pack     senml.Pack
+}
+
+// objectsOf returns the objects in the pack in msg, see splitPack
+func objectsOf(msg events.MessageAccepted) []object {
+	objects, _ := splitPack(msg.Pack())
+	return objects
+}
+
+// splitPack splits a pack into the objects it contains and the records that are shared by all objects,
+// such as the position, environment or tenant. Every object starts with a record named "0" that holds
+// the URN of the object and is followed by its resources, that are named by their resource id. The
+// instance id is taken from base names on the form deviceID/objectID/instanceID/, and when the base
+// name does not carry one the instances of an object are numbered in the order they appear in the pack.
+func splitPack(pack senml.Pack) ([]object, senml.Pack) {
+	normalized := pack.Clone()
+	normalized.Normalize()
+
+	objects := make([]object, 0, 1)
+	shared := senml.Pack{}
+	ordinals := map[string]int{}
+	baseName := ""
+
+	for i, r := range pack {
+		if r.BaseName != "" {
+			baseName = r.BaseName
+		}
+
+		rec := normalized[i]
+		rec.Name = r.Name
+
+		if r.Name == "0" && strings.HasPrefix(strings.ToLower(r.StringValue), "urn:") {
+			urn := strings.ToLower(r.StringValue)
+			objectID := urn[strings.LastIndex(urn, ":")+1:]
+
+			instance, ok := instanceFromBaseName(baseName, objectID)
+			if !ok {
+				instance = strconv.Itoa(ordinals[urn])
+			}
+			ordinals[urn]++
+
+			ts, _ := rec.GetTime()
+
+			objects = append(objects, object{URN: urn, ID: objectID, Instance: instance, BaseName: baseName, Time: ts})
+		}
+
+		if _, err := strconv.Atoi(r.Name); err != nil || len(objects) == 0 {
+			shared = append(shared, rec)
+			continue
+		}
+
+		current := &objects[len(objects)-1]
+		current.Pack = append(current.Pack, rec)
+	}
+
+	return objects, shared
+}
+
+// withObjects returns a copy of msg that only holds the given objects and the shared records
+func withObjects(msg events.MessageAccepted, objects []object, shared senml.Pack) events.MessageAccepted {
+	pack := make(senml.Pack, 0, len(msg.Pack()))
+
+	for _, o := range objects {
+		for i, r := range o.Pack {
+			if i == 0 {
+				r.BaseName = o.BaseName
+			}
+			pack = append(pack, r)
+		}
+	}
+
+	msg.Pack_ = append(pack, shared...)
+
+	return msg
+}
+
+// route is the part of a message that holds the objects of one measurement type, and the transformer it is routed to
+type route struct {
+	measurementType string
+	transformer     MeasurementTransformerFunc
+	msg             events.MessageAccepted
+}
+
+// routesOf splits msg by measurement type, in the order the types first appear in the pack. Objects that
+// no transformer handles are passed along with every part, so that transformers can still use them, such
+// as the temperature reported by an air quality sensor.
+func routesOf(msg events.MessageAccepted) []route {
+	objects, shared := splitPack(msg.Pack())
+
+	env, _ := shared.GetStringValue(senml.FindByName("env"))
+
+	measurementTypes := []string{}
+	routed := map[string][]object{}
+	unrouted := []object{}
+
+	for _, o := range objects {
+		mt := measurementType(o.URN, env)
+
+		if _, ok := transformers[mt]; !ok {
+			unrouted = append(unrouted, o)
+			continue
+		}
+
+		if _, ok := routed[mt]; !ok {
+			measurementTypes = append(measurementTypes, mt)
+		}
+
+		routed[mt] = append(routed[mt], o)
+	}
+
+	routes := make([]route, 0, len(measurementTypes))
+
+	for _, mt := range measurementTypes {
+		routes = append(routes, route{
+			measurementType: mt,
+			transformer:     transformers[mt],
+			msg:             withObjects(msg, append(routed[mt], unrouted...), shared),
+		})
+	}
+
+	return routes
+}
+
+func measurementType(urn, env string) string {
+	if env == "" {
+		return urn
+	}
+
+	return fmt.Sprintf("%s/%s", urn, env)
+}
+
+func instanceFromBaseName(baseName, objectID string) (string, bool) {
+	segments := strings.Split(strings.Trim(baseName, "/"), "/")
+	if len(segments) < 3 || segments[1] != objectID || segments[2] == "" {
+		return "", false
+	}
+
+	return segments[2], true
+}
+
+// valuesOf returns the value of a resource in every instance of the object identified by objectURN,
+// with the datasetId that each instance should be published with
+func valuesOf(ctx context.Context, msg events.MessageAccepted, objectURN string, resource int) []NumberInstance {
+	instances := make([]object, 0, 1)
+
+	for _, o := range objectsOf(msg) {
+		if strings.EqualFold(o.URN, objectURN) {
+			instances = append(instances, o)
+		}
+	}
+
+	values := make([]NumberInstance, 0, len(instances))
+	deviceType := deviceTypeFromContext(ctx)
+	names := datasetNamesFromContext(ctx)
+
+	for _, o := range instances {
+		v, ok := o.Pack.GetValue(senml.FindByName(strconv.Itoa(resource)))
+		if !ok {
+			continue
+		}
+
+		values = append(values, NumberInstance{
+			DatasetID:  names.datasetID(deviceType, o, len(instances)),
+			Value:      v,
+			ObservedAt: o.Time,
+		})
+	}
+
+	return values
+}
@@ -0,0 +1,335 @@
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// fileStore is an embedded, single file key/value store. Every change is appended to
+// the file as a checksummed record and synced to disk before the call returns. When the
+// file is opened the records are replayed, corrupt records are skipped, and a torn or corrupt
+// tail left behind by a crash is cut off. The file is compacted when it has grown well beyond
+// the live data, or when it holds corrupt records.
+type fileStore struct {
+	*inMemoryStore
+
+	path    string
+	file    *os.File
+	records int
+	// corrupt is the number of corrupt records that were skipped when the file was replayed
+	corrupt int
+}
+
+type record struct {
+	Op    string `json:"op"`
+	Key   Key    `json:"key"`
+	Entry *entry `json:"entry,omitempty"`
+}
+
+const (
+	opSet    string = "set"
+	opDelete string = "del"
+
+	compactThreshold int = 1024
+)
+
+// NewFileStore opens, or creates, the store kept in the file at path
+func NewFileStore(path string) (Store, error) {
+	return openFileStore(path, time.Now)
+}
+
+func openFileStore(path string, now func() time.Time) (*fileStore, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create directory for state file %s: %w", path, err)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state file %s: %w", path, err)
+	}
+
+	s := &fileStore{
+		inMemoryStore: newInMemoryStore(),
+		path:          path,
+		file:          f,
+	}
+	s.now = now
+
+	err = s.replay()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if s.corrupt > 0 || (s.records > compactThreshold && s.records > 2*len(s.entries)) {
+		err = s.compact()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (s *fileStore) replay() error {
+	r := bufio.NewReader(s.file)
+
+	// offset is the end of the last good record, and read the end of the last complete line
+	var offset, read int64
+	corrupt := 0
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// anything without a terminating newline is a write that never completed
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read state file %s: %w", s.path, err)
+		}
+
+		read += int64(len(line))
+
+		rec, ok := decodeRecord(line)
+		if !ok {
+			// a corrupt record only loses its own change, the records after it are still good
+			corrupt++
+			continue
+		}
+
+		s.apply(rec)
+		s.records++
+		s.corrupt += corrupt
+		corrupt = 0
+		offset = read
+	}
+
+	// drop the torn or corrupt tail so that new records are appended after the last good one
+	err := s.file.Truncate(offset)
+	if err != nil {
+		return fmt.Errorf("failed to truncate state file %s: %w", s.path, err)
+	}
+
+	_, err = s.file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("failed to seek in state file %s: %w", s.path, err)
+	}
+
+	now := s.now()
+	for k, e := range s.entries {
+		if e.expired(now) {
+			delete(s.entries, k)
+		}
+	}
+
+	return nil
+}
+
+func (s *fileStore) apply(rec record) {
+	switch rec.Op {
+	case opSet:
+		if rec.Entry != nil {
+			s.entries[rec.Key] = *rec.Entry
+		}
+	case opDelete:
+		delete(s.entries, rec.Key)
+	}
+}
+
+func (s *fileStore) Set(ctx context.Context, k Key, v any, ttl time.Duration) error {
+	e, err := s.newEntry(k, v, ttl)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	err = s.append(record{Op: opSet, Key: k, Entry: &e})
+	if err != nil {
+		return err
+	}
+
+	s.entries[k] = e
+
+	return s.compactIfNeeded()
+}
+
+func (s *fileStore) Delete(ctx context.Context, k Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	if _, ok := s.entries[k]; !ok {
+		return nil
+	}
+
+	err := s.append(record{Op: opDelete, Key: k})
+	if err != nil {
+		return err
+	}
+
+	delete(s.entries, k)
+
+	return s.compactIfNeeded()
+}
+
+func (s *fileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+
+	return s.file.Close()
+}
+
+func (s *fileStore) append(rec record) error {
+	b, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.file.Write(b)
+	if err != nil {
+		return fmt.Errorf("failed to write to state file %s: %w", s.path, err)
+	}
+
+	err = s.file.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync state file %s: %w", s.path, err)
+	}
+
+	s.records++
+
+	return nil
+}
+
+func (s *fileStore) compactIfNeeded() error {
+	if s.records <= compactThreshold || s.records <= 2*len(s.entries) {
+		return nil
+	}
+
+	return s.compact()
+}
+
+// compact writes the live entries to a new file and atomically replaces the old one with it
+func (s *fileStore) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	now := s.now()
+	records := 0
+
+	for k, e := range s.entries {
+		if e.expired(now) {
+			delete(s.entries, k)
+			continue
+		}
+
+		b, err := encodeRecord(record{Op: opSet, Key: k, Entry: &e})
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+
+		if _, err = w.Write(b); err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to write temporary state file: %w", err)
+		}
+
+		records++
+	}
+
+	if err = w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write temporary state file: %w", err)
+	}
+
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync temporary state file: %w", err)
+	}
+
+	if err = tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary state file: %w", err)
+	}
+
+	if err = os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to replace state file %s: %w", s.path, err)
+	}
+
+	f, err := os.OpenFile(s.path, os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to reopen state file %s: %w", s.path, err)
+	}
+
+	s.file.Close()
+	s.file = f
+	s.records = records
+	s.corrupt = 0
+
+	return nil
+}
+
+// encodeRecord formats a record as a line with the crc32 checksum of its json body in front of it
+func encodeRecord(rec record) ([]byte, error) {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal state record: %w", err)
+	}
+
+	line := make([]byte, 0, len(body)+10)
+	line = fmt.Appendf(line, "%08x ", crc32.ChecksumIEEE(body))
+	line = append(line, body...)
+	line = append(line, '\n')
+
+	return line, nil
+}
+
+func decodeRecord(line []byte) (record, bool) {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+
+	checksum, body, found := bytes.Cut(line, []byte(" "))
+	if !found {
+		return record{}, false
+	}
+
+	crc, err := strconv.ParseUint(string(checksum), 16, 32)
+	if err != nil || uint32(crc) != crc32.ChecksumIEEE(body) {
+		return record{}, false
+	}
+
+	rec := record{}
+	if err = json.Unmarshal(body, &rec); err != nil {
+		return record{}, false
+	}
+
+	return rec, true
+}
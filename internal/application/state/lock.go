@@ -0,0 +1,46 @@
+package state
+
+import "sync"
+
+type lockEntry struct {
+	mu       sync.Mutex
+	refCount int
+}
+
+type keyedLocks struct {
+	mu    sync.Mutex
+	locks map[Key]*lockEntry
+}
+
+func (kl *keyedLocks) lock(key Key) func() {
+	kl.mu.Lock()
+	entry, ok := kl.locks[key]
+	if !ok {
+		entry = &lockEntry{}
+		kl.locks[key] = entry
+	}
+	entry.refCount++
+	kl.mu.Unlock()
+
+	entry.mu.Lock()
+
+	return func() {
+		entry.mu.Unlock()
+
+		kl.mu.Lock()
+		entry.refCount--
+		if entry.refCount == 0 {
+			delete(kl.locks, key)
+		}
+		kl.mu.Unlock()
+	}
+}
+
+var locks = &keyedLocks{locks: make(map[Key]*lockEntry)}
+
+// Lock locks the value stored for k until the returned function is called, so that a value that is read,
+// changed and stored again is not changed by someone else in between. Values are only locked within this
+// process, and are not to be kept locked while waiting for anything else than the store.
+func Lock(k Key) (unlock func()) {
+	return locks.lock(k)
+}
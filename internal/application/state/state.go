@@ -0,0 +1,166 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Store keeps small pieces of state between messages, such as the previous
+// reading of a meter, so that transformers can compute deltas, debounce
+// changes or detect stale writes.
+type Store interface {
+	// Get unmarshals the value stored for k into v and reports whether a value was found
+	Get(ctx context.Context, k Key, v any) (bool, error)
+	// Set stores v for k. A ttl of zero means that the value never expires.
+	Set(ctx context.Context, k Key, v any, ttl time.Duration) error
+	Delete(ctx context.Context, k Key) error
+	Close() error
+}
+
+// Key identifies a value by the tenant and entity it belongs to and a name
+// chosen by the transformer that owns it
+type Key struct {
+	Tenant string `json:"tenant"`
+	Entity string `json:"entity"`
+	Name   string `json:"name"`
+}
+
+func NewKey(tenant, entity, name string) Key {
+	return Key{Tenant: tenant, Entity: entity, Name: name}
+}
+
+func (k Key) String() string {
+	return fmt.Sprintf("%s/%s/%s", k.Tenant, k.Entity, k.Name)
+}
+
+var ErrClosed = errors.New("state store is closed")
+
+type entry struct {
+	Value     json.RawMessage `json:"value"`
+	ExpiresAt *time.Time      `json:"expiresAt,omitempty"`
+}
+
+func (e entry) expired(now time.Time) bool {
+	return e.ExpiresAt != nil && !now.Before(*e.ExpiresAt)
+}
+
+type inMemoryStore struct {
+	mu      sync.Mutex
+	entries map[Key]entry
+	now     func() time.Time
+	closed  bool
+}
+
+func NewInMemoryStore() Store {
+	return newInMemoryStore()
+}
+
+func newInMemoryStore() *inMemoryStore {
+	return &inMemoryStore{
+		entries: make(map[Key]entry),
+		now:     time.Now,
+	}
+}
+
+func (s *inMemoryStore) Get(ctx context.Context, k Key, v any) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false, ErrClosed
+	}
+
+	e, ok := s.entries[k]
+	if !ok {
+		return false, nil
+	}
+
+	if e.expired(s.now()) {
+		delete(s.entries, k)
+		return false, nil
+	}
+
+	err := json.Unmarshal(e.Value, v)
+	if err != nil {
+		return false, fmt.Errorf("failed to unmarshal state for %s: %w", k, err)
+	}
+
+	return true, nil
+}
+
+func (s *inMemoryStore) Set(ctx context.Context, k Key, v any, ttl time.Duration) error {
+	e, err := s.newEntry(k, v, ttl)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	s.entries[k] = e
+
+	return nil
+}
+
+func (s *inMemoryStore) Delete(ctx context.Context, k Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	delete(s.entries, k)
+
+	return nil
+}
+
+func (s *inMemoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+
+	return nil
+}
+
+func (s *inMemoryStore) newEntry(k Key, v any, ttl time.Duration) (entry, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return entry{}, fmt.Errorf("failed to marshal state for %s: %w", k, err)
+	}
+
+	e := entry{Value: b}
+
+	if ttl > 0 {
+		expiresAt := s.now().Add(ttl).UTC()
+		e.ExpiresAt = &expiresAt
+	}
+
+	return e, nil
+}
+
+type storeContextKey struct{}
+
+var defaultStore = NewInMemoryStore()
+
+func NewContextWithStore(ctx context.Context, s Store) context.Context {
+	return context.WithValue(ctx, storeContextKey{}, s)
+}
+
+// GetFromContext returns the store attached to ctx, or a process wide in-memory store if there is none
+func GetFromContext(ctx context.Context) Store {
+	if s, ok := ctx.Value(storeContextKey{}).(Store); ok && s != nil {
+		return s
+	}
+
+	return defaultStore
+}
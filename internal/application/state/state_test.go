@@ -0,0 +1,269 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+type reading struct {
+	Volume float64 `json:"volume"`
+}
+
+var meterKey = NewKey("default", "urn:ngsi-ld:WaterConsumptionObserved:watermeter-01", "watermeter")
+
+func TestThatMissingKeyIsNotFound(t *testing.T) {
+	is := is.New(t)
+
+	r := reading{}
+	found, err := NewInMemoryStore().Get(context.Background(), meterKey, &r)
+	is.NoErr(err)
+	is.True(!found)
+}
+
+func TestThatKeysAreSeparatedByTenant(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	s := NewInMemoryStore()
+	is.NoErr(s.Set(ctx, meterKey, reading{Volume: 1}, 0))
+
+	r := reading{}
+	found, err := s.Get(ctx, NewKey("other", meterKey.Entity, meterKey.Name), &r)
+	is.NoErr(err)
+	is.True(!found)
+}
+
+func TestThatValuesExpireAfterTTL(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := newInMemoryStore()
+	s.now = func() time.Time { return now }
+
+	is.NoErr(s.Set(ctx, meterKey, reading{Volume: 1}, time.Hour))
+
+	r := reading{}
+	found, _ := s.Get(ctx, meterKey, &r)
+	is.True(found)
+
+	now = now.Add(time.Hour)
+
+	found, _ = s.Get(ctx, meterKey, &r)
+	is.True(!found)
+}
+
+func TestThatFileStoreKeepsValuesAfterReopen(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	path := filepath.Join(t.TempDir(), "state.db")
+
+	s, err := NewFileStore(path)
+	is.NoErr(err)
+	is.NoErr(s.Set(ctx, meterKey, reading{Volume: 1009}, 0))
+	is.NoErr(s.Set(ctx, NewKey("default", "urn:ngsi-ld:Sewer:01", "overflow"), reading{Volume: 1}, 0))
+	is.NoErr(s.Delete(ctx, NewKey("default", "urn:ngsi-ld:Sewer:01", "overflow")))
+	is.NoErr(s.Close())
+
+	reopened, err := NewFileStore(path)
+	is.NoErr(err)
+	defer reopened.Close()
+
+	r := reading{}
+	found, err := reopened.Get(ctx, meterKey, &r)
+	is.NoErr(err)
+	is.True(found)
+	is.Equal(r.Volume, 1009.0)
+
+	found, _ = reopened.Get(ctx, NewKey("default", "urn:ngsi-ld:Sewer:01", "overflow"), &r)
+	is.True(!found) // deleted values should stay deleted
+}
+
+func TestThatFileStoreRecoversFromTornWrite(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	path := filepath.Join(t.TempDir(), "state.db")
+
+	s, err := NewFileStore(path)
+	is.NoErr(err)
+	is.NoErr(s.Set(ctx, meterKey, reading{Volume: 1009}, 0))
+	is.NoErr(s.Set(ctx, meterKey, reading{Volume: 1010}, 0))
+	is.NoErr(s.Close())
+
+	// simulate a crash in the middle of writing the last record
+	b, err := os.ReadFile(path)
+	is.NoErr(err)
+	is.NoErr(os.WriteFile(path, b[:len(b)-5], 0o644))
+
+	reopened, err := NewFileStore(path)
+	is.NoErr(err)
+
+	r := reading{}
+	found, err := reopened.Get(ctx, meterKey, &r)
+	is.NoErr(err)
+	is.True(found)
+	is.Equal(r.Volume, 1009.0) // the torn record should be discarded
+
+	// new records must be readable after the discarded tail
+	is.NoErr(reopened.Set(ctx, meterKey, reading{Volume: 1011}, 0))
+	is.NoErr(reopened.Close())
+
+	reopened, err = NewFileStore(path)
+	is.NoErr(err)
+	defer reopened.Close()
+
+	found, _ = reopened.Get(ctx, meterKey, &r)
+	is.True(found)
+	is.Equal(r.Volume, 1011.0)
+}
+
+func TestThatFileStoreIgnoresCorruptRecords(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	path := filepath.Join(t.TempDir(), "state.db")
+
+	s, err := NewFileStore(path)
+	is.NoErr(err)
+	is.NoErr(s.Set(ctx, meterKey, reading{Volume: 1009}, 0))
+	is.NoErr(s.Close())
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	is.NoErr(err)
+	_, err = f.WriteString("00000000 {\"op\":\"set\",\"key\":{\"tenant\":\"default\"}}\n")
+	is.NoErr(err)
+	f.Close()
+
+	reopened, err := NewFileStore(path)
+	is.NoErr(err)
+	defer reopened.Close()
+
+	r := reading{}
+	found, err := reopened.Get(ctx, meterKey, &r)
+	is.NoErr(err)
+	is.True(found)
+	is.Equal(r.Volume, 1009.0)
+}
+
+func TestThatFileStoreKeepsRecordsAfterACorruptRecord(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	path := filepath.Join(t.TempDir(), "state.db")
+	otherKey := NewKey("default", "urn:ngsi-ld:WaterConsumptionObserved:watermeter-02", "watermeter")
+
+	s, err := NewFileStore(path)
+	is.NoErr(err)
+	is.NoErr(s.Set(ctx, meterKey, reading{Volume: 1009}, 0))
+	is.NoErr(s.Set(ctx, meterKey, reading{Volume: 1010}, 0))
+	is.NoErr(s.Set(ctx, otherKey, reading{Volume: 17}, 0))
+	is.NoErr(s.Close())
+
+	// corrupt the second of the three records by flipping a byte in its body
+	b, err := os.ReadFile(path)
+	is.NoErr(err)
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	lines[1][20] ^= 0xff
+	is.NoErr(os.WriteFile(path, bytes.Join(lines, nil), 0o644))
+
+	reopened, err := NewFileStore(path)
+	is.NoErr(err)
+
+	r := reading{}
+	found, err := reopened.Get(ctx, meterKey, &r)
+	is.NoErr(err)
+	is.True(found)
+	is.Equal(r.Volume, 1009.0) // only the corrupt record is lost
+
+	found, err = reopened.Get(ctx, otherKey, &r)
+	is.NoErr(err)
+	is.True(found)
+	is.Equal(r.Volume, 17.0) // the record after the corrupt one is kept
+	is.NoErr(reopened.Close())
+
+	// the corrupt record has been compacted away
+	b, err = os.ReadFile(path)
+	is.NoErr(err)
+	is.Equal(bytes.Count(b, []byte("\n")), 2)
+}
+
+func TestThatFileStoreIsCompacted(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	path := filepath.Join(t.TempDir(), "state.db")
+
+	s, err := openFileStore(path, time.Now)
+	is.NoErr(err)
+
+	for i := range compactThreshold * 2 {
+		is.NoErr(s.Set(ctx, meterKey, reading{Volume: float64(i)}, 0))
+	}
+
+	is.True(s.records <= compactThreshold)
+	is.NoErr(s.Close())
+
+	reopened, err := NewFileStore(path)
+	is.NoErr(err)
+	defer reopened.Close()
+
+	r := reading{}
+	found, _ := reopened.Get(ctx, meterKey, &r)
+	is.True(found)
+	is.Equal(r.Volume, float64(compactThreshold*2-1))
+}
+
+func TestThatExpiredValuesAreDroppedOnReopen(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	path := filepath.Join(t.TempDir(), "state.db")
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	s, err := openFileStore(path, func() time.Time { return now })
+	is.NoErr(err)
+	is.NoErr(s.Set(ctx, meterKey, reading{Volume: 1}, time.Hour))
+	is.NoErr(s.Close())
+
+	reopened, err := openFileStore(path, func() time.Time { return now.Add(2 * time.Hour) })
+	is.NoErr(err)
+	defer reopened.Close()
+
+	is.Equal(len(reopened.entries), 0)
+}
+
+func TestThatALockedValueIsNotChangedInBetween(t *testing.T) {
+	is := is.New(t)
+	ctx := context.Background()
+
+	s := NewInMemoryStore()
+
+	wg := sync.WaitGroup{}
+	for range 50 {
+		wg.Go(func() {
+			unlock := Lock(meterKey)
+			defer unlock()
+
+			r := reading{}
+			_, _ = s.Get(ctx, meterKey, &r)
+			r.Volume++
+			_ = s.Set(ctx, meterKey, r, 0)
+		})
+	}
+	wg.Wait()
+
+	r := reading{}
+	_, _ = s.Get(ctx, meterKey, &r)
+	is.Equal(r.Volume, 50.0)
+	is.Equal(len(locks.locks), 0) // locks are dropped once they are no longer held
+}
@@ -0,0 +1,178 @@
+package things
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities"
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities/decorators"
+	"github.com/diwise/context-broker/pkg/ngsild/types/relationships"
+	helpers "github.com/diwise/iot-transform-fiware/internal/application/decorators"
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
+
+	. "github.com/diwise/context-broker/pkg/ngsild/types/properties"
+)
+
+// syncedTTL is how long the entity that represents a point of interest may go without being written while it does
+// not change, so that an entity that is changed behind our back is eventually written again
+const syncedTTL = 24 * time.Hour
+
+// maxObservations is how many of the observations made at a point of interest it references, the ones most
+// recently made, so that devices that have been replaced are eventually no longer referenced
+const maxObservations = 16
+
+const (
+	observationsName string = "observations"
+	fingerprintName  string = "fingerprint"
+)
+
+// syncedPointOfInterest returns e, the entity that represents poi, with the description of poi, its bathing
+// season and references to the observations that have been made at it, observationID included. The entity is
+// Unchanged, and need not be written, if it is the same as when it was last written.
+func syncedPointOfInterest(ctx context.Context, poi pointOfInterest, e entity, observationID string) (entity, error) {
+	store := state.GetFromContext(ctx)
+
+	observations, err := recordObservation(ctx, poi.Tenant, e.ID, observationID, poi.ObservedAt)
+	if err != nil {
+		return e, err
+	}
+
+	if poi.Description != nil && *poi.Description != "" {
+		e.Properties = append(e.Properties, decorators.Description(*poi.Description))
+	}
+
+	if poi.BathingSeason != nil {
+		e.Properties = append(e.Properties, helpers.Structured("bathingSeason", map[string]string{
+			"start": helpers.FormatTime(poi.BathingSeason.Start),
+			"end":   helpers.FormatTime(poi.BathingSeason.End),
+		}))
+	}
+
+	e.Properties = append(e.Properties, entities.R("refWaterQualityObserved", relationships.NewMultiObjectRelationship(observations)))
+
+	fingerprint, err := fingerprintOf(e.Properties)
+	if err != nil {
+		return e, err
+	}
+
+	fingerprintKey := state.NewKey(poi.Tenant, e.ID, fingerprintName)
+
+	var prev uint32
+	found, err := store.Get(ctx, fingerprintKey, &prev)
+	if err != nil {
+		return e, fmt.Errorf("failed to load fingerprint: %w", err)
+	}
+
+	if found && fingerprint == prev {
+		e.Unchanged = true
+		return e, nil
+	}
+
+	// the fingerprint is only kept once the entity has been written, so that an entity that failed to be written
+	// is written again with the next message
+	e.written = func(ctx context.Context) error {
+		err := state.GetFromContext(ctx).Set(ctx, fingerprintKey, fingerprint, syncedTTL)
+		if err != nil {
+			return fmt.Errorf("failed to store fingerprint: %w", err)
+		}
+		return nil
+	}
+
+	return e, nil
+}
+
+// recordObservation records that observationID was made at the point of interest entityID at the time at, and returns
+// the ids of the maxObservations observations most recently made at it, in order
+func recordObservation(ctx context.Context, tenant, entityID, observationID string, at time.Time) ([]string, error) {
+	store := state.GetFromContext(ctx)
+	key := state.NewKey(tenant, entityID, observationsName)
+
+	unlock := state.Lock(key)
+	defer unlock()
+
+	// when each observation was last made
+	observations := map[string]time.Time{}
+	_, err := store.Get(ctx, key, &observations)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load observations: %w", err)
+	}
+
+	if prev, ok := observations[observationID]; !ok || at.After(prev) {
+		observations[observationID] = at.UTC()
+	}
+
+	ids := slices.Collect(maps.Keys(observations))
+	slices.SortFunc(ids, func(a, b string) int {
+		return cmp.Or(observations[b].Compare(observations[a]), strings.Compare(a, b))
+	})
+
+	for _, id := range ids[min(len(ids), maxObservations):] {
+		delete(observations, id)
+	}
+
+	err = store.Set(ctx, key, observations, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store observations: %w", err)
+	}
+
+	ids = ids[:len(observations)]
+	slices.Sort(ids)
+
+	return ids, nil
+}
+
+// forgetPointOfInterest clears the observations and fingerprint kept for the entity that represents poi
+func forgetPointOfInterest(ctx context.Context, cfg Config, poi pointOfInterest, _ time.Time) ([]entity, error) {
+	store := state.GetFromContext(ctx)
+	entityID := fmt.Sprintf("urn:ngsi-ld:%s:%s", cfg.PointsOfInterest.of(poi).TypeName, poi.Key())
+
+	err := errors.Join(
+		store.Delete(ctx, state.NewKey(poi.Tenant, entityID, observationsName)),
+		store.Delete(ctx, state.NewKey(poi.Tenant, entityID, fingerprintName)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to forget the observations of %s: %w", entityID, err)
+	}
+
+	return nil, nil
+}
+
+// fingerprintOf returns a hash of props as they would be written
+func fingerprintOf(props []entities.EntityDecoratorFunc) (uint32, error) {
+	fragment, err := entities.NewFragment(props...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create entity fragment: %w", err)
+	}
+
+	b, err := fragment.MarshalJSON()
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal entity fragment: %w", err)
+	}
+
+	h := fnv.New32a()
+	h.Write(b)
+
+	return h.Sum32(), nil
+}
+
+// observedTemperature returns the temperature m as the property name, observed when m was made, or else at
+// observedAt, and by the device that made it
+func observedTemperature(name string, m measurement, observedAt time.Time) entities.EntityDecoratorFunc {
+	if !m.Timestamp.IsZero() {
+		observedAt = m.Timestamp
+	}
+
+	propDecorators := []NumberPropertyDecoratorFunc{ObservedAt(helpers.FormatTime(observedAt)), UnitCode("CEL")}
+	if by := m.observedBy(); by != "" {
+		propDecorators = append(propDecorators, ObservedBy(by))
+	}
+
+	return decorators.Number(name, *m.Value, propDecorators...)
+}
@@ -0,0 +1,126 @@
+package things
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/diwise/context-broker/pkg/ngsild"
+	"github.com/diwise/context-broker/pkg/ngsild/client"
+	"github.com/diwise/context-broker/pkg/ngsild/types"
+	testClient "github.com/diwise/context-broker/pkg/test"
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/matryer/is"
+)
+
+func TestThatBeachesAreKeptInSyncAndLinkedToTheirObservations(t *testing.T) {
+	is := is.New(t)
+
+	cb, merged := newMergeRecorder()
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+	handler := NewThingTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient { return cb }, DefaultConfig())
+
+	body := strings.Replace(pointOfInterestJson, `"subType": "Beach",`, `"subType": "Beach", "description": "Sandstrand", "bathingSeason": {"start": "2026-06-15T00:00:00Z", "end": "2026-08-31T00:00:00Z"},`, 1)
+	body = strings.Replace(body, `"temperature": {
+      "ref": "09089d61-8f40-5ac8-a631-c940dab1fc9b",
+      "timestamp": "2026-03-23T16:20:30Z",
+      "v": 21.1`, `"temperature": {
+      "source": "https://www.smhi.se",
+      "timestamp": "2026-03-23T16:00:00Z",
+      "v": 19.5`, 1)
+
+	handler(ctx, thingMessage("application/vnd.diwise.pointofinterest+json", body), slog.Default())
+	handler(ctx, thingMessage("application/vnd.diwise.pointofinterest+json", body), slog.Default())
+
+	const observationID = "urn:ngsi-ld:WaterQualityObserved:09089d61-8f40-5ac8-a631-c940dab1fc9b"
+
+	beach := merged["urn:ngsi-ld:Beach:71ed07e4-52c0-417c-be15-3110b8e1f4e8"]
+	is.Equal(len(beach), 1) // the beach is only written again when it changes
+	is.True(strings.Contains(beach[0], `"description":{"type":"Property","value":"Sandstrand"}`))
+	is.True(strings.Contains(beach[0], `"bathingSeason":{"type":"Property","value":{"end":"2026-08-31T00:00:00Z","start":"2026-06-15T00:00:00Z"}}`))
+	is.True(strings.Contains(beach[0], `"refWaterQualityObserved":{"type":"Relationship","object":["`+observationID+`"]}`))
+
+	observation := merged[observationID]
+	is.Equal(len(observation), 2)
+	is.True(strings.Contains(observation[0], `"refLocation":{"type":"Relationship","object":"urn:ngsi-ld:Beach:71ed07e4-52c0-417c-be15-3110b8e1f4e8"}`))
+	is.True(strings.Contains(observation[0], `"temperature":{"type":"Property","value":21.1,"observedAt":"2026-03-23T16:20:30Z","observedBy":{"type":"Relationship","object":"urn:ngsi-ld:Device:09089d61-8f40-5ac8-a631-c940dab1fc9b"}`))
+	is.True(strings.Contains(observation[0], `"referenceTemperature":{"type":"Property","value":19.5,"observedAt":"2026-03-23T16:00:00Z","unitCode":"CEL"}`)) // a source is not a device
+}
+
+func TestThatABeachThatFailedToBeWrittenIsWrittenAgain(t *testing.T) {
+	is := is.New(t)
+
+	failing := true
+	beaches := 0
+	cb := &testClient.ContextBrokerClientMock{
+		MergeEntityFunc: func(ctx context.Context, entityID string, fragment types.EntityFragment, headers map[string][]string) (*ngsild.MergeEntityResult, error) {
+			if b, _ := json.Marshal(fragment); strings.Contains(string(b), "refWaterQualityObserved") {
+				if failing {
+					return nil, errors.New("unavailable")
+				}
+				beaches++
+			}
+			return &ngsild.MergeEntityResult{}, nil
+		},
+	}
+
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+	handler := NewThingTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient { return cb }, DefaultConfig())
+
+	handler(ctx, thingMessage("application/vnd.diwise.pointofinterest+json", pointOfInterestJson), slog.Default())
+	failing = false
+	handler(ctx, thingMessage("application/vnd.diwise.pointofinterest+json", pointOfInterestJson), slog.Default())
+	handler(ctx, thingMessage("application/vnd.diwise.pointofinterest+json", pointOfInterestJson), slog.Default())
+
+	is.Equal(beaches, 1) // written once it no longer failed, and then not again
+}
+
+func TestThatOnlyTheLatestObservationsAreReferenced(t *testing.T) {
+	is := is.New(t)
+
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+	t0 := time.Date(2026, 6, 15, 12, 0, 0, 0, time.UTC)
+
+	var wg sync.WaitGroup
+	for i := range maxObservations {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := recordObservation(ctx, "default", "urn:ngsi-ld:Beach:b-1", fmt.Sprintf("urn:ngsi-ld:WaterQualityObserved:%02d", i), t0.Add(time.Duration(i)*time.Minute))
+			is.NoErr(err)
+		}()
+	}
+	wg.Wait()
+
+	ids, err := recordObservation(ctx, "default", "urn:ngsi-ld:Beach:b-1", "urn:ngsi-ld:WaterQualityObserved:new", t0.Add(time.Hour))
+	is.NoErr(err)
+	is.Equal(len(ids), maxObservations)
+	is.True(!slices.Contains(ids, "urn:ngsi-ld:WaterQualityObserved:00")) // the oldest is no longer referenced
+	is.True(slices.Contains(ids, "urn:ngsi-ld:WaterQualityObserved:01"))
+	is.True(slices.Contains(ids, "urn:ngsi-ld:WaterQualityObserved:new"))
+}
+
+func TestThatDeletedBeachesForgetTheirObservations(t *testing.T) {
+	is := is.New(t)
+
+	cb, _ := newMergeRecorder()
+	cbClientFn := func(s string) client.ContextBrokerClient { return cb }
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+
+	NewThingTopicMessageHandler(&messaging.MsgContextMock{}, cbClientFn, DefaultConfig())(ctx, thingMessage("application/vnd.diwise.pointofinterest+json", pointOfInterestJson), slog.Default())
+	NewThingDeletedTopicMessageHandler(&messaging.MsgContextMock{}, cbClientFn, DefaultConfig())(ctx, thingMessage("application/vnd.diwise.pointofinterest+json", pointOfInterestJson), slog.Default())
+
+	for _, name := range []string{observationsName, fingerprintName} {
+		found, err := state.GetFromContext(ctx).Get(ctx, state.NewKey("default", "urn:ngsi-ld:Beach:71ed07e4-52c0-417c-be15-3110b8e1f4e8", name), &struct{}{})
+		is.NoErr(err)
+		is.True(!found)
+	}
+}
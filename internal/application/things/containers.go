@@ -0,0 +1,166 @@
+package things
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
+)
+
+const (
+	WasteContainerIsleTypeName string = "WasteContainerIsle"
+	WasteContainerIsleIDPrefix string = "urn:ngsi-ld:" + WasteContainerIsleTypeName + ":"
+)
+
+// ContainerThresholds are the fill levels, in percent, that the status of a waste container is derived from
+type ContainerThresholds struct {
+	// Full is the fill level from which a container is full
+	Full float64
+	// Overflowing is the fill level from which a container is overflowing
+	Overflowing float64
+	// Emptied is how much the fill level must drop from one observation to the next for the container to
+	// be considered emptied
+	Emptied float64
+}
+
+func DefaultContainerThresholds() ContainerThresholds {
+	return ContainerThresholds{Full: 80, Overflowing: 100, Emptied: 30}
+}
+
+// Validate returns an error unless the thresholds are percentages, and a container is full before it overflows
+func (t ContainerThresholds) Validate() error {
+	if t.Full <= 0 || t.Overflowing > 100 || t.Full > t.Overflowing {
+		return fmt.Errorf("full from %g%% and overflowing from %g%% are not within 0 and 100%% and in order", t.Full, t.Overflowing)
+	}
+
+	if t.Emptied <= 0 || t.Emptied > 100 {
+		return fmt.Errorf("emptied from a drop of %g percentage points is not within 0 and 100", t.Emptied)
+	}
+
+	return nil
+}
+
+// status returns the status of a waste container with the fill level percent, i.e. ok, full or overflowing
+func (ct ContainerThresholds) status(percent float64) string {
+	if percent >= ct.Overflowing {
+		return "overflowing"
+	}
+
+	if percent >= ct.Full {
+		return "full"
+	}
+
+	return "ok"
+}
+
+// fillPercent returns the fill level of the container in percent, computed from its current and max level
+// when the percentage is missing
+func (c container) fillPercent() float64 {
+	if c.Percent == 0 && c.MaxLevel > 0 {
+		return c.CurrentLevel / c.MaxLevel * 100
+	}
+
+	return c.Percent
+}
+
+// wasteContainerIsleID returns the entity id of the isle that a container is part of, unless parent already is one
+func wasteContainerIsleID(parent string) string {
+	if strings.HasPrefix(parent, "urn:ngsi-ld:") {
+		return parent
+	}
+
+	return WasteContainerIsleIDPrefix + nonSafeUriRegExp.ReplaceAllString(parent, ":")
+}
+
+// fillState is how a waste container has filled up since it was last emptied
+type fillState struct {
+	Percent    float64   `json:"percent"`
+	ObservedAt time.Time `json:"observedAt"`
+	// CycleStart is the lowest fill level since the container was last emptied, from which it fills up
+	CycleStartPercent float64    `json:"cycleStartPercent"`
+	CycleStartAt      time.Time  `json:"cycleStartAt"`
+	LastEmptying      *time.Time `json:"lastEmptying,omitempty"`
+}
+
+const fillName string = "fill"
+
+// fillStateTTL is how long the fill state of a container that is no longer observed is kept
+const fillStateTTL = 30 * 24 * time.Hour
+
+// nextFillState updates the fill state of the container entityID with the fill level percent, observed at observedAt
+func nextFillState(ctx context.Context, tenant, entityID string, percent float64, observedAt time.Time, thresholds ContainerThresholds) (fillState, error) {
+	store := state.GetFromContext(ctx)
+	key := state.NewKey(tenant, entityID, fillName)
+
+	prev := fillState{}
+	_, err := store.Get(ctx, key, &prev)
+	if err != nil {
+		return fillState{}, fmt.Errorf("failed to load fill state: %w", err)
+	}
+
+	next := prev.next(percent, observedAt, thresholds)
+
+	err = store.Set(ctx, key, next, fillStateTTL)
+	if err != nil {
+		return fillState{}, fmt.Errorf("failed to store fill state: %w", err)
+	}
+
+	return next, nil
+}
+
+// forgetContainer clears the fill state kept for the container c
+func forgetContainer(ctx context.Context, _ Config, c container, _ time.Time) ([]entity, error) {
+	err := state.GetFromContext(ctx).Delete(ctx, state.NewKey(c.Tenant, c.EntityID(), fillName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to forget the fill state of %s: %w", c.EntityID(), err)
+	}
+
+	return nil, nil
+}
+
+func (prev fillState) next(percent float64, observedAt time.Time, thresholds ContainerThresholds) fillState {
+	observedAt = observedAt.UTC()
+
+	if !prev.ObservedAt.IsZero() && !observedAt.After(prev.ObservedAt) {
+		// the same, or an older, observation tells nothing new about how the container fills up
+		return prev
+	}
+
+	next := prev
+	next.Percent = percent
+	next.ObservedAt = observedAt
+
+	if prev.ObservedAt.IsZero() || percent < prev.CycleStartPercent {
+		next.CycleStartPercent = percent
+		next.CycleStartAt = observedAt
+	}
+
+	if !prev.ObservedAt.IsZero() && prev.Percent-percent >= thresholds.Emptied {
+		next.LastEmptying = &observedAt
+		next.CycleStartPercent = percent
+		next.CycleStartAt = observedAt
+	}
+
+	return next
+}
+
+// predictedFull returns when the container is predicted to be full, from the rate it has filled up at since it
+// was last emptied. There is no prediction for a container that already is full or has not filled up at all.
+func (s fillState) predictedFull(full float64) (time.Time, bool) {
+	if s.Percent >= full {
+		return time.Time{}, false
+	}
+
+	elapsed := s.ObservedAt.Sub(s.CycleStartAt)
+	rise := s.Percent - s.CycleStartPercent
+
+	if elapsed <= 0 || rise <= 0 {
+		return time.Time{}, false
+	}
+
+	remaining := time.Duration((full - s.Percent) / rise * float64(elapsed))
+
+	return s.ObservedAt.Add(remaining).Truncate(time.Second), true
+}
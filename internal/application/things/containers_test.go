@@ -0,0 +1,89 @@
+package things
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diwise/context-broker/pkg/ngsild/client"
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/matryer/is"
+)
+
+func TestThatContainerStatusFollowsTheThresholds(t *testing.T) {
+	is := is.New(t)
+
+	thresholds := DefaultContainerThresholds()
+
+	is.Equal(thresholds.status(79.9), "ok")
+	is.Equal(thresholds.status(80), "full")
+	is.Equal(thresholds.status(104), "overflowing")
+}
+
+func TestThatContainerThresholdsAreValidated(t *testing.T) {
+	is := is.New(t)
+
+	is.NoErr(DefaultContainerThresholds().Validate())
+	is.NoErr(ContainerThresholds{Full: 90, Overflowing: 90, Emptied: 10}.Validate())
+
+	is.True(ContainerThresholds{Full: 100, Overflowing: 80, Emptied: 30}.Validate() != nil)
+	is.True(ContainerThresholds{Full: 80, Overflowing: 120, Emptied: 30}.Validate() != nil)
+	is.True(ContainerThresholds{Full: 0, Overflowing: 100, Emptied: 30}.Validate() != nil)
+	is.True(ContainerThresholds{Full: 80, Overflowing: 100, Emptied: 0}.Validate() != nil)
+}
+
+func TestThatEmptyingIsDetectedAndFullIsPredicted(t *testing.T) {
+	is := is.New(t)
+
+	t0 := time.Date(2024, 11, 19, 6, 0, 0, 0, time.UTC)
+	thresholds := DefaultContainerThresholds()
+
+	s := fillState{}.next(10, t0, thresholds)
+	_, ok := s.predictedFull(thresholds.Full)
+	is.True(!ok) // nothing is known about the fill rate yet
+
+	s = s.next(40, t0.Add(3*time.Hour), thresholds)
+	full, ok := s.predictedFull(thresholds.Full)
+	is.True(ok)
+	is.Equal(full, t0.Add(7*time.Hour)) // 30 percent in 3 hours leaves 4 hours to 80 percent
+	is.True(s.LastEmptying == nil)
+
+	s = s.next(35, t0.Add(4*time.Hour), thresholds) // a small drop, such as the waste settling
+	is.True(s.LastEmptying == nil)
+
+	s = s.next(5, t0.Add(5*time.Hour), thresholds)
+	is.Equal(*s.LastEmptying, t0.Add(5*time.Hour))
+	_, ok = s.predictedFull(thresholds.Full)
+	is.True(!ok) // the container is filling up from the start again
+
+	s = s.next(90, t0.Add(6*time.Hour), thresholds)
+	_, ok = s.predictedFull(thresholds.Full)
+	is.True(!ok) // the container already is full
+}
+
+func TestThatContainersArePublishedWithStatusAndEmptying(t *testing.T) {
+	is := is.New(t)
+
+	cb, merged := newMergeRecorder()
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+	handler := NewThingTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient { return cb }, DefaultConfig())
+
+	container := func(percent float64, observedAt string) string {
+		return fmt.Sprintf(`{"id":"c-001","type":"Container","thing":{"id":"c-001","type":"Container","subType":"WasteContainer","name":"Soptunna 1","parent":"Isle 4","location":{"latitude":62,"longitude":17},"currentLevel":0.5,"percent":%v,"observedAt":"%s","tenant":"default"},"tenant":"default","timestamp":"%s"}`, percent, observedAt, observedAt)
+	}
+
+	handler(ctx, thingMessage("application/vnd.diwise.container+json", container(85, "2024-11-19T06:00:00Z")), slog.Default())
+	handler(ctx, thingMessage("application/vnd.diwise.container+json", container(10, "2024-11-19T08:00:00Z")), slog.Default())
+
+	bodies := merged["urn:ngsi-ld:WasteContainer:c-001"]
+	is.Equal(len(bodies), 2)
+	is.True(strings.Contains(bodies[0], `"status":{"type":"Property","value":"full","observedAt":"2024-11-19T06:00:00Z"}`))
+	is.True(strings.Contains(bodies[0], `"refWasteContainerIsle":{"type":"Relationship","object":"urn:ngsi-ld:WasteContainerIsle:Isle:4"}`))
+	is.True(strings.Contains(bodies[0], `"currentLevel":{"type":"Property","value":0.5`))
+	is.True(strings.Contains(bodies[1], `"status":{"type":"Property","value":"ok","observedAt":"2024-11-19T08:00:00Z"}`))
+	is.True(strings.Contains(bodies[1], `"dateLastEmptying":{"type":"Property","value":{"@type":"DateTime","@value":"2024-11-19T08:00:00Z"}}`))
+}
@@ -0,0 +1,212 @@
+package things
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DecodingMode decides what happens to things whose payloads do not keep to the contract of their version
+type DecodingMode string
+
+const (
+	// LenientDecoding handles things whose payloads violate their contract, such as by having unknown fields, as
+	// well as they can be decoded. The violations are logged and counted.
+	LenientDecoding DecodingMode = "lenient"
+	// StrictDecoding rejects things whose payloads violate their contract, such as by having unknown fields
+	StrictDecoding DecodingMode = "strict"
+)
+
+// ParseDecodingMode returns the DecodingMode named by s
+func ParseDecodingMode(s string) (DecodingMode, error) {
+	mode := DecodingMode(strings.ToLower(s))
+
+	if mode != LenientDecoding && mode != StrictDecoding {
+		return "", fmt.Errorf("unknown decoding mode %q, expected %q or %q", s, LenientDecoding, StrictDecoding)
+	}
+
+	return mode, nil
+}
+
+// identityFile is the contract of the fields that identify a thing, of every kind and version
+const identityFile = "identity.json"
+
+// payloadSchemas are the contracts of every version of the payload of every kind of thing
+var payloadSchemas = func() schemas {
+	all, err := loadSchemas(schemaFiles)
+	if err != nil {
+		panic(err)
+	}
+	return all
+}()
+
+// parseContentType returns the content type ct without its version, and the version, e.g.
+// application/vnd.diwise.sewer+json and 2 for application/vnd.diwise.sewer.v2+json. Content types without a
+// version are version 1.
+func parseContentType(ct string) (string, int) {
+	ct = strings.ToLower(ct)
+
+	name, ok := strings.CutSuffix(ct, "+json")
+	if !ok {
+		return ct, 1
+	}
+
+	i := strings.LastIndex(name, ".v")
+	if i < 0 {
+		return ct, 1
+	}
+
+	version, err := strconv.Atoi(name[i+2:])
+	if err != nil || version < 1 {
+		return ct, 1
+	}
+
+	return name[:i] + "+json", version
+}
+
+// upgrade rewrites a thing, as decoded into a map, from another version of a payload into the shape of the
+// payload that the kind of thing is decoded into
+type upgrade func(t map[string]any) error
+
+// kindOf returns the kind of thing registered for contentType, if it supports the version of the content type
+func kindOf(contentType string) (thingKind, bool) {
+	base, version := parseContentType(contentType)
+
+	k, ok := kinds[base]
+	if !ok || !k.supports(version) {
+		return nil, false
+	}
+
+	return k, true
+}
+
+// schemaFile returns the name of the schema of version of the payload of this kind
+func (k kind[T, P]) schemaFile(version int) string {
+	name := strings.TrimSuffix(strings.TrimPrefix(k.contentType, "application/vnd.diwise."), "+json")
+	return fmt.Sprintf("%s.v%d.json", name, version)
+}
+
+func (k kind[T, P]) supports(version int) bool {
+	_, ok := payloadSchemas[k.schemaFile(version)]
+	return ok
+}
+
+// decode validates the message body against the contract of the version of the payload given by its content
+// type, upgrades it to the shape of T if it is of another version, and decodes it according to the decoding mode
+// in h. Violations of the contract, such as unknown fields, are errors when decoding strictly, and are otherwise
+// logged and counted.
+func (k kind[T, P]) decode(contentType string, body []byte, h handling, log *slog.Logger) (msg[T], error) {
+	m := msg[T]{}
+
+	_, version := parseContentType(contentType)
+	if !k.supports(version) {
+		return m, fmt.Errorf("version %d of %s is not supported", version, k.name)
+	}
+
+	doc, err := k.validate(k.schemaFile(version), version, body, h, log)
+	if err != nil {
+		return m, err
+	}
+
+	if up, ok := k.upgrades[version]; ok {
+		envelope, _ := doc.(map[string]any)
+		t, _ := envelope["thing"].(map[string]any)
+		if t == nil {
+			return m, fmt.Errorf("version %d of %s without thing", version, k.name)
+		}
+
+		if err := up(t); err != nil {
+			return m, fmt.Errorf("failed to upgrade version %d of %s: %w", version, k.name, err)
+		}
+
+		body, _ = json.Marshal(doc)
+	}
+
+	err = json.Unmarshal(body, &m)
+
+	return m, err
+}
+
+// decodeIdentity decodes the message body as decode does, but only validates the fields that identify the
+// thing against their contract, see identityFile. It is used for deleted things, whose payloads may be
+// reduced to those fields. The payload is not upgraded, as only the fields that identify a thing are used.
+func (k kind[T, P]) decodeIdentity(contentType string, body []byte, h handling, log *slog.Logger) (msg[T], error) {
+	m := msg[T]{}
+
+	_, version := parseContentType(contentType)
+	if !k.supports(version) {
+		return m, fmt.Errorf("version %d of %s is not supported", version, k.name)
+	}
+
+	if _, err := k.validate(identityFile, version, body, h, log); err != nil {
+		return m, err
+	}
+
+	err := json.Unmarshal(body, &m)
+
+	return m, err
+}
+
+// validate decodes body and validates it against the schema in file. Violations are counted and are errors
+// when decoding strictly, and are otherwise logged.
+func (k kind[T, P]) validate(file string, version int, body []byte, h handling, log *slog.Logger) (any, error) {
+	var doc any
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+
+	violations := payloadSchemas.validate(file, doc)
+	if violations == nil {
+		return doc, nil
+	}
+
+	h.count(k.name, version)
+
+	if h.cfg.Decoding == StrictDecoding {
+		return nil, fmt.Errorf("payload violates version %d of its contract: %w", version, violations)
+	}
+
+	log.Warn("payload violates its contract", slog.Int("version", version), "err", violations.Error())
+
+	return doc, nil
+}
+
+// upgradeSewerV2 moves the overflow of a sewer, that version 2 groups in an object of its own with durations in
+// seconds, into the fields of version 1
+func upgradeSewerV2(t map[string]any) error {
+	overflow, ok := t["overflow"].(map[string]any)
+	if !ok {
+		return errors.New("missing overflow")
+	}
+	delete(t, "overflow")
+
+	fields := map[string]string{
+		"observed":   "overflowObserved",
+		"observedAt": "overflowObservedAt",
+		"endedAt":    "overflowEndedAt",
+		"lastAction": "lastAction",
+	}
+
+	for from, to := range fields {
+		if v, ok := overflow[from]; ok {
+			t[to] = v
+		}
+	}
+
+	durations := map[string]string{
+		"duration":       "overflowDuration",
+		"cumulativeTime": "overflowCumulativeTime",
+	}
+
+	for from, to := range durations {
+		if seconds, ok := overflow[from].(float64); ok {
+			t[to] = int64(seconds * float64(time.Second))
+		}
+	}
+
+	return nil
+}
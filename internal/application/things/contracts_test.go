@@ -0,0 +1,199 @@
+package things
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/diwise/context-broker/pkg/ngsild/client"
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/matryer/is"
+)
+
+func TestParseContentType(t *testing.T) {
+	is := is.New(t)
+
+	tests := map[string]struct {
+		base    string
+		version int
+	}{
+		"application/vnd.diwise.sewer+json":      {"application/vnd.diwise.sewer+json", 1},
+		"application/vnd.diwise.sewer.v2+json":   {"application/vnd.diwise.sewer+json", 2},
+		"application/vnd.diwise.Sewer.V2+json":   {"application/vnd.diwise.sewer+json", 2},
+		"application/vnd.diwise.sewer.v0+json":   {"application/vnd.diwise.sewer.v0+json", 1},
+		"application/vnd.diwise.sewer.vx+json":   {"application/vnd.diwise.sewer.vx+json", 1},
+		"application/vnd.diwise.pointofinterest": {"application/vnd.diwise.pointofinterest", 1},
+	}
+
+	for ct, expected := range tests {
+		base, version := parseContentType(ct)
+		is.Equal(base, expected.base)       // base of ct
+		is.Equal(version, expected.version) // version of ct
+	}
+}
+
+func TestThatEverySchemaIsLoadedAndEveryReferenceResolves(t *testing.T) {
+	is := is.New(t)
+
+	all, err := loadSchemas(schemaFiles)
+	is.NoErr(err) // every schema compiles, and so every reference resolves
+
+	for _, k := range kinds {
+		is.True(k.supports(1)) // every kind has a contract for version 1
+	}
+
+	_, ok := all[identityFile]
+	is.True(ok) // the contract of deleted things
+}
+
+func TestThatViolationsOfTheContractAreReported(t *testing.T) {
+	is := is.New(t)
+
+	body := strings.Replace(sewerJson, `"latitude": 62.395275`, `"latitude": 162.395275`, 1)
+	body = strings.Replace(body, `"tenant": "default",
+    "currentLevel"`, `"currentLevel"`, 1)
+	body = strings.Replace(body, `"overflowObserved": false`, `"overflowObserved": "no"`, 1)
+
+	var doc any
+	is.NoErr(json.Unmarshal([]byte(body), &doc))
+
+	err := payloadSchemas.validate("sewer.v1.json", doc)
+	is.True(err != nil)
+
+	violations := strings.Split(err.Error(), "\n")
+	is.Equal(len(violations), 3)
+	is.Equal(violations[0], `at '/thing': missing property 'tenant'`)
+	is.Equal(violations[1], `at '/thing/location/latitude': maximum: got 162.395275, want 90`)
+	is.Equal(violations[2], `at '/thing/overflowObserved': got string, want boolean`)
+
+	var unknown any
+	is.NoErr(json.Unmarshal([]byte(strings.Replace(sewerJson, `"currentLevel": 0,`, `"currentLevel": 0, "unknown": true,`, 1)), &unknown))
+	is.Equal(payloadSchemas.validate("sewer.v1.json", unknown).Error(), `at '/thing': additional properties 'unknown' not allowed`) // unknown fields violate the contract
+
+	var valid any
+	is.NoErr(json.Unmarshal([]byte(sewerJson), &valid))
+	is.NoErr(payloadSchemas.validate("sewer.v1.json", valid))
+}
+
+const sewerOverflowingJson = `{
+  "id": "25ba0559-3d49-4853-a537-3bbf7d2ae777",
+  "type": "Sewer",
+  "thing": {
+    "id": "25ba0559-3d49-4853-a537-3bbf7d2ae777",
+    "type": "Sewer",
+    "subType": "CombinedSewerOverflow",
+    "name": "05",
+    "location": {"latitude": 62.395275, "longitude": 17.462769},
+    "observedAt": "2024-11-27T06:12:58Z",
+    "tenant": "default",
+    "currentLevel": 0.4,
+    "percent": 40,
+    "overflowObserved": true,
+    "overflowObservedAt": "2024-11-27T06:00:00Z",
+    "overflowDuration": 758000000000,
+    "overflowCumulativeTime": 3600000000000,
+    "lastAction": "overflow started"
+  },
+  "tenant": "default",
+  "timestamp": "2024-11-27T06:13:00Z"
+}`
+
+const sewerOverflowingV2Json = `{
+  "id": "25ba0559-3d49-4853-a537-3bbf7d2ae777",
+  "type": "Sewer",
+  "thing": {
+    "id": "25ba0559-3d49-4853-a537-3bbf7d2ae777",
+    "type": "Sewer",
+    "subType": "CombinedSewerOverflow",
+    "name": "05",
+    "location": {"latitude": 62.395275, "longitude": 17.462769},
+    "observedAt": "2024-11-27T06:12:58Z",
+    "tenant": "default",
+    "currentLevel": 0.4,
+    "percent": 40,
+    "overflow": {
+      "observed": true,
+      "observedAt": "2024-11-27T06:00:00Z",
+      "duration": 758,
+      "cumulativeTime": 3600,
+      "lastAction": "overflow started"
+    }
+  },
+  "tenant": "default",
+  "timestamp": "2024-11-27T06:13:00Z"
+}`
+
+func TestThatVersion2OfASewerIsPublishedAsVersion1(t *testing.T) {
+	is := is.New(t)
+
+	publish := func(contentType, body string) map[string][]string {
+		cb, merged := newMergeRecorder()
+		ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+		handler := NewThingTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient { return cb }, DefaultConfig())
+		handler(ctx, thingMessage(contentType, body), slog.Default())
+		return merged
+	}
+
+	v1 := publish("application/vnd.diwise.sewer+json", sewerOverflowingJson)
+	v2 := publish("application/vnd.diwise.sewer.v2+json", sewerOverflowingV2Json)
+
+	const sewerID = "urn:ngsi-ld:CombinedSewerOverflow:25ba0559-3d49-4853-a537-3bbf7d2ae777"
+
+	is.Equal(len(v1[sewerID]), 1)
+	is.Equal(v2[sewerID], v1[sewerID]) // version 2 is published the same as version 1
+	is.True(strings.Contains(v2[sewerID][0], `"status":{"type":"Property","value":"true","observedAt":"2024-11-27T06:00:00Z"}`))
+	is.True(strings.Contains(v2[sewerID][0], `"overflowCumulativeTime":{"type":"Property","value":3600,`))
+}
+
+func TestThatStrictDecodingRejectsPayloadsThatViolateTheirContract(t *testing.T) {
+	is := is.New(t)
+
+	withUnknownField := strings.Replace(sewerJson, `"currentLevel": 0,`, `"currentLevel": 0, "unknown": true,`, 1)
+	withoutTenant := strings.Replace(sewerJson, `"tenant": "default",
+    "currentLevel"`, `"currentLevel"`, 1)
+
+	for _, body := range []string{withUnknownField, withoutTenant} {
+		for _, mode := range []DecodingMode{LenientDecoding, StrictDecoding} {
+			cb, merged := newMergeRecorder()
+			ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+
+			cfg := DefaultConfig()
+			cfg.Decoding = mode
+
+			handler := NewThingTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient { return cb }, cfg)
+			handler(ctx, thingMessage("application/vnd.diwise.sewer+json", body), slog.Default())
+
+			_, published := merged["urn:ngsi-ld:CombinedSewerOverflow:25ba0559-3d49-4853-a537-3bbf7d2ae777"]
+			is.Equal(published, mode == LenientDecoding) // only lenient decoding publishes the sewer
+		}
+	}
+}
+
+func TestThatUnsupportedVersionsAreNotHandled(t *testing.T) {
+	is := is.New(t)
+
+	cb, merged := newMergeRecorder()
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+	handler := NewThingTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient { return cb }, DefaultConfig())
+
+	handler(ctx, thingMessage("application/vnd.diwise.sewer.v3+json", sewerJson), slog.Default())
+	handler(ctx, thingMessage("application/vnd.diwise.building.v2+json", sewerJson), slog.Default())
+
+	is.Equal(len(merged), 0)
+	is.True(!kinds["application/vnd.diwise.building+json"].supports(2))
+	is.True(kinds["application/vnd.diwise.sewer+json"].supports(2))
+}
+
+func TestParseDecodingMode(t *testing.T) {
+	is := is.New(t)
+
+	mode, err := ParseDecodingMode("Strict")
+	is.NoErr(err)
+	is.Equal(mode, StrictDecoding)
+
+	_, err = ParseDecodingMode("relaxed")
+	is.True(err != nil)
+}
@@ -0,0 +1,60 @@
+package things
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
+)
+
+// dailyCount is the number of events, such as overflows or pump cycles, that started during the current
+// period, i.e. the current day
+type dailyCount struct {
+	PeriodStart time.Time `json:"periodStart"`
+	Count       int       `json:"count"`
+	LastStart   time.Time `json:"lastStart"`
+}
+
+// dailyCountTTL is how long a daily count is kept, well beyond the end of its period
+const dailyCountTTL = 7 * 24 * time.Hour
+
+// countPerDay counts the events of the entity entityID that started during the day of observedAt, keyed by
+// name. Every event is counted once, by the time it started, however many updates it is reported in.
+func countPerDay(ctx context.Context, tenant, entityID, name string, startedAt *time.Time, observedAt time.Time) (dailyCount, error) {
+	store := state.GetFromContext(ctx)
+	key := state.NewKey(tenant, entityID, name)
+
+	prev := dailyCount{}
+	_, err := store.Get(ctx, key, &prev)
+	if err != nil {
+		return dailyCount{}, fmt.Errorf("failed to load %s count: %w", name, err)
+	}
+
+	next := prev.next(startedAt, observedAt)
+
+	err = store.Set(ctx, key, next, dailyCountTTL)
+	if err != nil {
+		return dailyCount{}, fmt.Errorf("failed to store %s count: %w", name, err)
+	}
+
+	return next, nil
+}
+
+func (prev dailyCount) next(startedAt *time.Time, observedAt time.Time) dailyCount {
+	observedAt = observedAt.UTC()
+	periodStart := time.Date(observedAt.Year(), observedAt.Month(), observedAt.Day(), 0, 0, 0, 0, time.UTC)
+
+	next := prev
+	if !prev.PeriodStart.Equal(periodStart) {
+		next.PeriodStart = periodStart
+		next.Count = 0
+	}
+
+	if startedAt != nil && !startedAt.Equal(prev.LastStart) && !startedAt.Before(periodStart) {
+		next.Count++
+		next.LastStart = startedAt.UTC()
+	}
+
+	return next
+}
@@ -0,0 +1,32 @@
+package things
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+)
+
+func TestThatEventsAreCountedOncePerDay(t *testing.T) {
+	is := is.New(t)
+
+	at := func(s string) *time.Time {
+		ts, _ := time.Parse(time.RFC3339, s)
+		return &ts
+	}
+
+	c := dailyCount{}
+
+	c = c.next(at("2024-11-27T06:10:00Z"), *at("2024-11-27T06:10:00Z"))
+	is.Equal(c.Count, 1)
+
+	c = c.next(at("2024-11-27T06:10:00Z"), *at("2024-11-27T06:40:00Z")) // the same event, updated
+	is.Equal(c.Count, 1)
+
+	c = c.next(at("2024-11-27T12:00:00Z"), *at("2024-11-27T12:00:00Z"))
+	is.Equal(c.Count, 2)
+
+	c = c.next(nil, *at("2024-11-28T01:00:00Z")) // a new day
+	is.Equal(c.Count, 0)
+	is.Equal(c.PeriodStart, *at("2024-11-28T00:00:00Z"))
+}
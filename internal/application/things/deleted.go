@@ -0,0 +1,236 @@
+package things
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/diwise/context-broker/pkg/datamodels/fiware"
+	"github.com/diwise/context-broker/pkg/ngsild/client"
+	"github.com/diwise/context-broker/pkg/ngsild/types"
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities"
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities/decorators"
+	"github.com/diwise/context-broker/pkg/ngsild/types/relationships"
+	"github.com/diwise/iot-transform-fiware/internal/application/cip"
+	helpers "github.com/diwise/iot-transform-fiware/internal/application/decorators"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// DeletionMode decides what happens to the entities of a thing that has been deleted
+type DeletionMode string
+
+const (
+	// DeleteEntities removes the entities from the context broker
+	DeleteEntities DeletionMode = "delete"
+	// DeactivateEntities keeps the entities, but marks them as inactive
+	DeactivateEntities DeletionMode = "deactivate"
+)
+
+// ParseDeletionMode returns the DeletionMode named by s
+func ParseDeletionMode(s string) (DeletionMode, error) {
+	mode := DeletionMode(strings.ToLower(s))
+
+	if mode != DeleteEntities && mode != DeactivateEntities {
+		return "", fmt.Errorf("unknown deletion mode %q, expected %q or %q", s, DeleteEntities, DeactivateEntities)
+	}
+
+	return mode, nil
+}
+
+// NewThingDeletedTopicMessageHandler returns a handler for deleted things that removes, or deactivates, the entity
+// that represents the thing and the observations derived from it, depending on the deletion mode in cfg. Things
+// are identified as when they were updated. Messages with a content type that no kind is registered for are
+// counted and logged.
+func NewThingDeletedTopicMessageHandler(messenger messaging.MsgContext, cbClientFn func(string) client.ContextBrokerClient, cfg Config) messaging.TopicMessageHandler {
+
+	log := logging.GetFromContext(context.Background())
+
+	unknownCounter, err := otel.Meter("iot-transform-fiware/things").Int64Counter(
+		"diwise.transform.things.deleted.unknown",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of deleted things with an unknown content type"),
+	)
+
+	if err != nil {
+		log.Error("failed to create otel unknown deleted things counter", "err", err.Error())
+	}
+
+	h := newHandling(cbClientFn, cfg)
+
+	return func(ctx context.Context, itm messaging.IncomingTopicMessage, l *slog.Logger) {
+		k, ok := kindOf(itm.ContentType())
+		if !ok {
+			if unknownCounter != nil {
+				unknownCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("content_type", itm.ContentType())))
+			}
+			l.Warn("no handler registered for content type", slog.String("content_type", itm.ContentType()))
+			return
+		}
+
+		k.remove(ctx, itm, h, l)
+	}
+}
+
+func (k kind[T, P]) remove(ctx context.Context, itm messaging.IncomingTopicMessage, h handling, l *slog.Logger) {
+	log := l.With("content_type", itm.ContentType(), "deletion_mode", string(h.cfg.Deletion))
+	log.Debug(k.name + " deleted")
+
+	m, err := k.decodeIdentity(itm.ContentType(), itm.Body(), h, log)
+	if err != nil {
+		log.Error("failed to decode message body", "err", err.Error())
+		return
+	}
+
+	tenant := m.Thing.base().Tenant
+	log = log.With(slog.String("tenant", tenant))
+
+	key, _, err := resolveKey(ctx, m.Thing.base(), h.cfg.IDs)
+	if err != nil {
+		log.Error("failed to resolve the key of "+k.name, "err", err.Error())
+		return
+	}
+
+	P(&m.Thing).setKey(key)
+
+	ids, err := k.ids(ctx, h.cfg, m.Thing)
+	if err != nil {
+		log.Error("failed to list the entities of "+k.name, "err", err.Error())
+		return
+	}
+
+	owner, err := ownerOf(ctx, tenant, ids[0])
+	if err != nil {
+		log.Error("failed to look up the owner of "+k.name, "err", err.Error())
+		return
+	}
+
+	if owner != "" && owner != m.Thing.base().ID {
+		log.Warn("entity id is used by another thing, entities not removed", slog.String("entity_id", ids[0]), slog.String("owner", owner))
+		return
+	}
+
+	deletedAt := m.Timestamp
+	if deletedAt.IsZero() {
+		deletedAt = time.Now()
+	}
+
+	cbClient := h.cbClientFn(tenant)
+
+	err = removeEntities(logging.NewContextWithLogger(ctx, log), cbClient, ids, h.cfg.Deletion, deletedAt)
+	if err != nil {
+		log.Error("failed to remove all entities of "+k.name, "err", err.Error())
+		return
+	}
+
+	// the entities are gone even if their devices could not be updated, so these failures are only logged
+	refs, err := removeBackReferences(ctx, tenant, m.Thing.DeviceIDs(), ids[0])
+	if err != nil {
+		log.Error("failed to remove the references to "+k.name+" from its devices", "err", err.Error())
+	}
+
+	for _, e := range refs {
+		_ = write(ctx, cbClient, log, e)
+	}
+
+	if k.forget != nil {
+		ents, err := k.forget(ctx, h.cfg, m.Thing, deletedAt)
+		if err != nil {
+			log.Error("failed to forget "+k.name, "err", err.Error())
+			return
+		}
+
+		for _, e := range ents {
+			err = write(ctx, cbClient, log, e)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	err = errors.Join(forgetRelations(ctx, m.Thing.base()), forgetKey(ctx, m.Thing.base()), release(ctx, tenant, ids[0]))
+	if err != nil {
+		log.Error("failed to forget the key of "+k.name, "err", err.Error())
+		return
+	}
+
+	log.Debug(k.name + " removed successfully")
+}
+
+// removeEntities deletes or deactivates every entity in ids. The derived entities are removed before the entity
+// that represents the thing, which is first in ids, so that a thing is not lost track of while its observations
+// remain. A failure to remove one entity does not stop the others from being removed, and all failures are returned.
+func removeEntities(ctx context.Context, cbClient client.ContextBrokerClient, ids []string, mode DeletionMode, deletedAt time.Time) error {
+	log := logging.GetFromContext(ctx)
+
+	inactive := []entities.EntityDecoratorFunc{
+		decorators.Text("operationalStatus", "inactive"),
+		decorators.DateModified(helpers.FormatTime(deletedAt)),
+	}
+
+	errs := []error{}
+
+	for _, id := range slices.Backward(ids) {
+		var err error
+
+		if mode == DeactivateEntities {
+			err = cip.MergeIfExists(ctx, cbClient, id, inactive)
+		} else {
+			err = cip.Delete(ctx, cbClient, id)
+		}
+
+		if err != nil {
+			log.Error("failed to remove entity", slog.String("entity_id", id), "err", err.Error())
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ngsiLDNull is the value that removes an attribute when an entity is merged
+const ngsiLDNull string = "urn:ngsi-ld:null"
+
+// removeBackReferences returns the devices that referenced the entity assetID, with a reference to every other
+// asset that they are connected to, or with the reference removed if there are none. The devices are those in
+// deviceIDs, and any others that the asset was referenced from when it was handled.
+func removeBackReferences(ctx context.Context, tenant string, deviceIDs []string, assetID string) ([]entity, error) {
+	devices, err := addDevices(ctx, tenant, assetID, deviceIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]entity, 0, len(devices))
+
+	for _, deviceID := range devices {
+		if deviceID == assetID {
+			continue
+		}
+
+		assets, err := removeControlledAsset(ctx, tenant, deviceID, assetID)
+		if err != nil {
+			return refs, err
+		}
+
+		var ref types.Relationship = relationships.NewSingleObjectRelationship(ngsiLDNull)
+		if len(assets) > 0 {
+			ref = relationships.NewMultiObjectRelationship(assets)
+		}
+
+		refs = append(refs, entity{
+			ID:         deviceID,
+			TypeName:   fiware.DeviceTypeName,
+			Properties: []entities.EntityDecoratorFunc{entities.R("controlledAsset", ref)},
+			MergeOnly:  true,
+		})
+	}
+
+	return refs, forgetDevices(ctx, tenant, assetID)
+}
@@ -0,0 +1,215 @@
+package things
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/diwise/context-broker/pkg/ngsild"
+	"github.com/diwise/context-broker/pkg/ngsild/client"
+	ngsierrors "github.com/diwise/context-broker/pkg/ngsild/errors"
+	"github.com/diwise/context-broker/pkg/ngsild/types"
+	testClient "github.com/diwise/context-broker/pkg/test"
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/matryer/is"
+)
+
+func TestThatDeletedThingsAreDeleted(t *testing.T) {
+	is := is.New(t)
+
+	deleted := []string{}
+	cb := &testClient.ContextBrokerClientMock{
+		DeleteEntityFunc: func(ctx context.Context, entityID string) (*ngsild.DeleteEntityResult, error) {
+			deleted = append(deleted, entityID)
+			return ngsild.NewDeleteEntityResult(), nil
+		},
+		MergeEntityFunc: func(ctx context.Context, entityID string, fragment types.EntityFragment, headers map[string][]string) (*ngsild.MergeEntityResult, error) {
+			return &ngsild.MergeEntityResult{}, nil
+		},
+	}
+
+	handler := NewThingDeletedTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient {
+		return cb
+	}, Config{IDs: NameAliases, Deletion: DeleteEntities})
+
+	handler(context.Background(), deletedMessage("application/vnd.diwise.sewer+json", sewerJson), slog.Default())
+
+	is.Equal(deleted, []string{"urn:ngsi-ld:CombinedSewerOverflow:05"})
+}
+
+func TestThatAllEntitiesAreRemovedDespitePartialFailures(t *testing.T) {
+	is := is.New(t)
+
+	deleted := []string{}
+	cb := &testClient.ContextBrokerClientMock{
+		DeleteEntityFunc: func(ctx context.Context, entityID string) (*ngsild.DeleteEntityResult, error) {
+			if entityID == "urn:ngsi-ld:WaterQualityObserved:Teststrand" {
+				return nil, errors.New("context broker unavailable")
+			}
+			if strings.HasSuffix(entityID, "d549c148-e73e-5cb6-bb74-96b588c59258") {
+				return nil, ngsierrors.ErrNotFound
+			}
+			deleted = append(deleted, entityID)
+			return ngsild.NewDeleteEntityResult(), nil
+		},
+	}
+
+	handler := NewThingDeletedTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient {
+		return cb
+	}, Config{IDs: NameAliases, Deletion: DeleteEntities})
+
+	buf := &bytes.Buffer{}
+	handler(context.Background(), deletedMessage("application/vnd.diwise.pointofinterest+json", pointOfInterestJson), slog.New(slog.NewTextHandler(buf, nil)))
+
+	is.Equal(len(cb.DeleteEntityCalls()), 5) // the beach and its observations, one per device and one for the whole beach
+	is.Equal(deleted, []string{
+		"urn:ngsi-ld:WaterQualityObserved:09089d61-8f40-5ac8-a631-c940dab1fc9b",
+		"urn:ngsi-ld:WaterQualityObserved:3e85f04b-a64b-51a6-a3a9-e33aaf11986e",
+		"urn:ngsi-ld:Beach:Teststrand", // the beach is removed last, even when some of its observations could not be
+	})
+	is.True(strings.Contains(buf.String(), "failed to remove all entities of point of interest"))
+	is.True(strings.Contains(buf.String(), "context broker unavailable"))
+}
+
+func TestThatDeletedThingsCanBeDeactivated(t *testing.T) {
+	is := is.New(t)
+
+	fragments := map[string]string{}
+	cb := &testClient.ContextBrokerClientMock{
+		MergeEntityFunc: func(ctx context.Context, entityID string, fragment types.EntityFragment, headers map[string][]string) (*ngsild.MergeEntityResult, error) {
+			b, _ := json.Marshal(fragment)
+			fragments[entityID] = string(b)
+			return &ngsild.MergeEntityResult{}, nil
+		},
+	}
+
+	handler := NewThingDeletedTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient {
+		return cb
+	}, Config{IDs: NameAliases, Deletion: DeactivateEntities})
+
+	handler(context.Background(), deletedMessage("application/vnd.diwise.container+json", wastecontainerJson), slog.Default())
+
+	is.Equal(len(cb.DeleteEntityCalls()), 0)
+	is.Equal(len(cb.CreateEntityCalls()), 0)
+	is.True(strings.Contains(fragments["urn:ngsi-ld:WasteContainer:Soptunnor.XY"], `"operationalStatus":{"type":"Property","value":"inactive"}`))
+}
+
+func TestThatOnlyTheIdentityOfDeletedThingsIsValidated(t *testing.T) {
+	is := is.New(t)
+
+	deleted := []string{}
+	cb := &testClient.ContextBrokerClientMock{
+		DeleteEntityFunc: func(ctx context.Context, entityID string) (*ngsild.DeleteEntityResult, error) {
+			deleted = append(deleted, entityID)
+			return ngsild.NewDeleteEntityResult(), nil
+		},
+	}
+
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+
+	cfg := DefaultConfig()
+	cfg.Deletion = DeleteEntities
+	cfg.Decoding = StrictDecoding
+
+	handler := NewThingDeletedTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient {
+		return cb
+	}, cfg)
+
+	handler(ctx, deletedMessage("application/vnd.diwise.sewer.v2+json", `{"id":"sewer-1","type":"Sewer","thing":{"id":"sewer-1","type":"Sewer","subType":"CombinedSewerOverflow"},"tenant":"default"}`), slog.Default())
+	is.Equal(len(deleted), 0) // a thing without a tenant cannot be identified
+
+	handler(ctx, deletedMessage("application/vnd.diwise.sewer.v2+json", `{"id":"sewer-1","type":"Sewer","thing":{"id":"sewer-1","type":"Sewer","subType":"CombinedSewerOverflow","tenant":"default"},"tenant":"default"}`), slog.Default())
+	is.Equal(deleted, []string{"urn:ngsi-ld:CombinedSewerOverflow:sewer-1"})
+}
+
+func TestThatDevicesNoLongerReferenceDeletedThings(t *testing.T) {
+	is := is.New(t)
+
+	devices := []string{}
+	cb := &testClient.ContextBrokerClientMock{
+		MergeEntityFunc: func(ctx context.Context, entityID string, fragment types.EntityFragment, headers map[string][]string) (*ngsild.MergeEntityResult, error) {
+			if isDevice(entityID) {
+				b, _ := json.Marshal(fragment)
+				devices = append(devices, string(b))
+			}
+			return &ngsild.MergeEntityResult{}, nil
+		},
+	}
+
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+	cbClientFn := func(s string) client.ContextBrokerClient { return cb }
+
+	container := func(id string) string {
+		return fmt.Sprintf(`{"id":"%[1]s","type":"Container","thing":{"id":"%[1]s","type":"Container","subType":"WasteContainer","location":{"latitude":62,"longitude":17},"refDevices":[{"deviceID":"dev-1"}],"currentLevel":0.5,"percent":50,"observedAt":"2024-11-19T10:49:59Z","tenant":"default"},"tenant":"default","timestamp":"2024-11-19T10:49:59Z"}`, id)
+	}
+
+	handler := NewThingTopicMessageHandler(&messaging.MsgContextMock{}, cbClientFn, DefaultConfig())
+	handler(ctx, thingMessage("application/vnd.diwise.container+json", container("c-001")), slog.Default())
+	handler(ctx, thingMessage("application/vnd.diwise.container+json", container("c-002")), slog.Default())
+
+	deleted := NewThingDeletedTopicMessageHandler(&messaging.MsgContextMock{}, cbClientFn, DefaultConfig())
+	deleted(ctx, deletedMessage("application/vnd.diwise.container+json", container("c-001")), slog.Default())
+
+	is.Equal(len(devices), 3)
+	is.True(strings.Contains(devices[2], `"controlledAsset":{"type":"Relationship","object":["urn:ngsi-ld:WasteContainer:c-002"]}`))
+
+	deleted(ctx, deletedMessage("application/vnd.diwise.container+json", container("c-002")), slog.Default())
+
+	is.Equal(len(devices), 4)
+	is.True(strings.Contains(devices[3], `"controlledAsset":{"type":"Relationship","object":"urn:ngsi-ld:null"}`)) // the reference is removed
+
+	found, err := state.GetFromContext(ctx).Get(ctx, state.NewKey("default", "dev-1", controlledAssetsName), &[]string{})
+	is.NoErr(err)
+	is.True(!found)
+}
+
+func TestThatTheStateOfDeletedThingsIsCleared(t *testing.T) {
+	is := is.New(t)
+
+	cb, _ := newMergeRecorder()
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+	cbClientFn := func(s string) client.ContextBrokerClient { return cb }
+
+	body := containerWithName("c-001", "Soptunna 1")
+
+	NewThingTopicMessageHandler(&messaging.MsgContextMock{}, cbClientFn, DefaultConfig())(ctx, thingMessage("application/vnd.diwise.container+json", body), slog.Default())
+	NewThingDeletedTopicMessageHandler(&messaging.MsgContextMock{}, cbClientFn, DefaultConfig())(ctx, deletedMessage("application/vnd.diwise.container+json", body), slog.Default())
+
+	store := state.GetFromContext(ctx)
+
+	for _, key := range []state.Key{
+		state.NewKey("default", "urn:ngsi-ld:WasteContainer:c-001", fillName),
+		state.NewKey("default", "urn:ngsi-ld:WasteContainer:c-001", ownerName),
+		state.NewKey("default", "c-001", entityName),
+		state.NewKey("default", "c-001", thingKeyName),
+	} {
+		found, err := store.Get(ctx, key, &json.RawMessage{})
+		is.NoErr(err)
+		is.True(!found) // the state of the deleted container is kept
+	}
+}
+
+func TestParseDeletionMode(t *testing.T) {
+	is := is.New(t)
+
+	mode, err := ParseDeletionMode("Delete")
+	is.NoErr(err)
+	is.Equal(mode, DeleteEntities)
+
+	_, err = ParseDeletionMode("archive")
+	is.True(err != nil)
+}
+
+func deletedMessage(contentType, body string) messaging.IncomingTopicMessage {
+	return &messaging.IncomingTopicMessageMock{
+		BodyFunc:        func() []byte { return []byte(body) },
+		ContentTypeFunc: func() string { return contentType },
+		TopicNameFunc:   func() string { return "thing.deleted" },
+	}
+}
@@ -0,0 +1,258 @@
+package things
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities"
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities/decorators"
+)
+
+// geometry is a GeoJSON geometry. Positions are in longitude, latitude order, as in GeoJSON.
+type geometry struct {
+	Type       string
+	Point      []float64
+	LineString [][]float64
+	Polygons   [][][][]float64
+}
+
+const (
+	geometryPoint        string = "Point"
+	geometryLineString   string = "LineString"
+	geometryPolygon      string = "Polygon"
+	geometryMultiPolygon string = "MultiPolygon"
+)
+
+// UnmarshalJSON accepts either a latitude and longitude pair or a GeoJSON geometry. The latitude and longitude
+// of a geometry are its centroid, unless they are given alongside it, so that the location can always be used
+// as a point. Malformed geometries are rejected.
+func (l *location) UnmarshalJSON(b []byte) error {
+	v := struct {
+		Latitude    *float64        `json:"latitude"`
+		Longitude   *float64        `json:"longitude"`
+		Type        string          `json:"type"`
+		Coordinates json.RawMessage `json:"coordinates"`
+	}{}
+
+	err := json.Unmarshal(b, &v)
+	if err != nil {
+		return err
+	}
+
+	*l = location{}
+
+	if v.Type != "" {
+		g, err := newGeometry(v.Type, v.Coordinates)
+		if err != nil {
+			return fmt.Errorf("invalid location: %w", err)
+		}
+
+		l.Geometry = g
+		l.Longitude, l.Latitude = g.centroid()
+	}
+
+	if v.Latitude != nil && v.Longitude != nil {
+		l.Latitude, l.Longitude = *v.Latitude, *v.Longitude
+	}
+
+	return nil
+}
+
+// geoProperty returns the location as the NGSI-LD location property, using the geometry when there is one.
+// Polygons are published as multi polygons with a single polygon.
+func (l location) geoProperty() entities.EntityDecoratorFunc {
+	if l.Geometry != nil {
+		switch l.Geometry.Type {
+		case geometryLineString:
+			return decorators.LocationLS(l.Geometry.LineString)
+		case geometryPolygon, geometryMultiPolygon:
+			return decorators.LocationMP(l.Geometry.Polygons)
+		}
+	}
+
+	return l.point()
+}
+
+// point returns the location as a point, i.e. the centroid of the geometry when there is one
+func (l location) point() entities.EntityDecoratorFunc {
+	return decorators.Location(l.Latitude, l.Longitude)
+}
+
+func newGeometry(typeName string, coordinates json.RawMessage) (*geometry, error) {
+	supported := []string{geometryPoint, geometryLineString, geometryPolygon, geometryMultiPolygon}
+	if !slices.Contains(supported, typeName) {
+		return nil, fmt.Errorf("unsupported geometry type %q, expected one of %s", typeName, strings.Join(supported, ", "))
+	}
+
+	if len(coordinates) == 0 {
+		return nil, fmt.Errorf("%s without coordinates", typeName)
+	}
+
+	g := &geometry{Type: typeName}
+
+	var err error
+
+	switch typeName {
+	case geometryPoint:
+		err = json.Unmarshal(coordinates, &g.Point)
+		if err == nil {
+			err = validatePosition(g.Point)
+		}
+	case geometryLineString:
+		err = json.Unmarshal(coordinates, &g.LineString)
+		if err == nil {
+			err = validateLineString(g.LineString)
+		}
+	case geometryPolygon:
+		polygon := [][][]float64{}
+		err = json.Unmarshal(coordinates, &polygon)
+		if err == nil {
+			err = validatePolygon(polygon)
+		}
+		g.Polygons = [][][][]float64{polygon}
+	case geometryMultiPolygon:
+		err = json.Unmarshal(coordinates, &g.Polygons)
+		if err == nil {
+			err = validateMultiPolygon(g.Polygons)
+		}
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("malformed %s: %w", typeName, err)
+	}
+
+	return g, nil
+}
+
+// validatePosition checks that a position is a longitude and latitude, and possibly an altitude, in that order
+func validatePosition(p []float64) error {
+	if len(p) != 2 && len(p) != 3 {
+		return fmt.Errorf("a position must have 2 or 3 coordinates, not %d", len(p))
+	}
+
+	if p[0] < -180 || p[0] > 180 {
+		return fmt.Errorf("longitude %v is out of range, coordinates must be in longitude, latitude order", p[0])
+	}
+
+	if p[1] < -90 || p[1] > 90 {
+		return fmt.Errorf("latitude %v is out of range, coordinates must be in longitude, latitude order", p[1])
+	}
+
+	return nil
+}
+
+func validateLineString(ls [][]float64) error {
+	if len(ls) < 2 {
+		return errors.New("a line string must have at least 2 positions")
+	}
+
+	for i, p := range ls {
+		if err := validatePosition(p); err != nil {
+			return fmt.Errorf("position %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// validatePolygon checks that every ring of a polygon, the exterior ring first and then any holes, is closed
+func validatePolygon(polygon [][][]float64) error {
+	if len(polygon) == 0 {
+		return errors.New("a polygon must have an exterior ring")
+	}
+
+	for r, ring := range polygon {
+		if len(ring) < 4 {
+			return fmt.Errorf("ring %d must have at least 4 positions", r)
+		}
+
+		for i, p := range ring {
+			if err := validatePosition(p); err != nil {
+				return fmt.Errorf("ring %d, position %d: %w", r, i, err)
+			}
+		}
+
+		first, last := ring[0], ring[len(ring)-1]
+		if first[0] != last[0] || first[1] != last[1] {
+			return fmt.Errorf("ring %d is not closed, the first and last positions must be the same", r)
+		}
+	}
+
+	return nil
+}
+
+func validateMultiPolygon(polygons [][][][]float64) error {
+	if len(polygons) == 0 {
+		return errors.New("a multi polygon must have at least one polygon")
+	}
+
+	for i, polygon := range polygons {
+		if err := validatePolygon(polygon); err != nil {
+			return fmt.Errorf("polygon %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// centroid returns the longitude and latitude of the centre of the geometry. The centre of a line string is
+// weighted by the length of its segments and the centre of polygons by the area of their exterior rings.
+func (g geometry) centroid() (float64, float64) {
+	switch g.Type {
+	case geometryLineString:
+		return lineCentroid(g.LineString)
+	case geometryPolygon, geometryMultiPolygon:
+		var area, x, y float64
+		for _, polygon := range g.Polygons {
+			a, cx, cy := ringCentroid(polygon[0])
+			area += a
+			x += a * cx
+			y += a * cy
+		}
+		if area == 0 {
+			return lineCentroid(g.Polygons[0][0])
+		}
+		return x / area, y / area
+	}
+
+	return g.Point[0], g.Point[1]
+}
+
+func lineCentroid(ls [][]float64) (float64, float64) {
+	var length, x, y float64
+
+	for i := 1; i < len(ls); i++ {
+		d := math.Hypot(ls[i][0]-ls[i-1][0], ls[i][1]-ls[i-1][1])
+		length += d
+		x += d * (ls[i][0] + ls[i-1][0]) / 2
+		y += d * (ls[i][1] + ls[i-1][1]) / 2
+	}
+
+	if length == 0 {
+		return ls[0][0], ls[0][1]
+	}
+
+	return x / length, y / length
+}
+
+// ringCentroid returns the area and centre of a closed ring, using the shoelace formula
+func ringCentroid(ring [][]float64) (float64, float64, float64) {
+	var area, x, y float64
+
+	for i := 0; i < len(ring)-1; i++ {
+		cross := ring[i][0]*ring[i+1][1] - ring[i+1][0]*ring[i][1]
+		area += cross
+		x += (ring[i][0] + ring[i+1][0]) * cross
+		y += (ring[i][1] + ring[i+1][1]) * cross
+	}
+
+	if area == 0 {
+		return 0, 0, 0
+	}
+
+	return math.Abs(area / 2), x / (3 * area), y / (3 * area)
+}
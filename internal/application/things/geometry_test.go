@@ -0,0 +1,112 @@
+package things
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/diwise/context-broker/pkg/ngsild/client"
+	testClient "github.com/diwise/context-broker/pkg/test"
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/matryer/is"
+)
+
+func TestThatLocationsAcceptGeometries(t *testing.T) {
+	is := is.New(t)
+
+	l := location{}
+	is.NoErr(json.Unmarshal([]byte(`{"latitude":62.4,"longitude":17.3}`), &l))
+	is.Equal(l.Latitude, 62.4)
+	is.True(l.Geometry == nil)
+
+	l = location{}
+	is.NoErr(json.Unmarshal([]byte(`{"type":"Polygon","coordinates":[[[17,62],[18,62],[18,63],[17,63],[17,62]]]}`), &l))
+	is.Equal(l.Geometry.Type, "Polygon")
+	is.Equal(l.Longitude, 17.5) // the centroid of the polygon
+	is.Equal(l.Latitude, 62.5)
+
+	l = location{}
+	is.NoErr(json.Unmarshal([]byte(`{"type":"LineString","coordinates":[[17,62],[18,62],[19,62]]}`), &l))
+	is.Equal(l.Longitude, 18.0)
+	is.Equal(l.Latitude, 62.0)
+
+	l = location{}
+	is.NoErr(json.Unmarshal([]byte(`{"type":"Point","coordinates":[17.3,62.4],"latitude":62,"longitude":17}`), &l))
+	is.Equal(l.Latitude, 62.0) // a point given alongside the geometry is kept
+}
+
+func TestThatMalformedGeometriesAreRejected(t *testing.T) {
+	is := is.New(t)
+
+	tests := map[string]struct {
+		json string
+		err  string
+	}{
+		"unclosed ring":      {`{"type":"Polygon","coordinates":[[[17,62],[18,62],[18,63],[17,63]]]}`, "ring 0 is not closed"},
+		"latitude first":     {`{"type":"Point","coordinates":[62.4,117.3]}`, "latitude 117.3 is out of range"},
+		"too few positions":  {`{"type":"LineString","coordinates":[[17,62]]}`, "at least 2 positions"},
+		"missing positions":  {`{"type":"MultiPolygon","coordinates":[]}`, "at least one polygon"},
+		"unsupported type":   {`{"type":"GeometryCollection","geometries":[]}`, "unsupported geometry type"},
+		"wrong nesting":      {`{"type":"Polygon","coordinates":[[17,62],[18,62]]}`, "malformed Polygon"},
+		"missing coordinate": {`{"type":"Point","coordinates":[17]}`, "2 or 3 coordinates"},
+	}
+
+	for name, tc := range tests {
+		l := location{}
+		err := json.Unmarshal([]byte(tc.json), &l)
+		is.True(err != nil)                            // expected an error
+		is.True(strings.Contains(err.Error(), tc.err)) // unexpected error message
+		t.Log(name, ": ", err)
+	}
+}
+
+func TestThatGeometriesArePublishedAsLocation(t *testing.T) {
+	is := is.New(t)
+
+	cb, bodies := newCreateRecorder()
+
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+	handler := NewThingTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient { return cb }, DefaultConfig())
+
+	body := strings.Replace(sewerJson, `"location": {
+      "latitude": 62.395275,
+      "longitude": 17.462769
+    }`, `"location": {"type":"LineString","coordinates":[[17.3,62.39],[17.31,62.4]]}`, 1)
+	is.True(body != sewerJson)
+
+	handler(ctx, thingMessage("application/vnd.diwise.sewer+json", body), slog.Default())
+
+	is.True(strings.Contains(bodies["urn:ngsi-ld:CombinedSewerOverflow:25ba0559-3d49-4853-a537-3bbf7d2ae777"], `"location":{"type":"GeoProperty","value":{"type":"LineString","coordinates":[[17.3,62.39],[17.31,62.4]]}}`))
+}
+
+func TestThatThingsWithMalformedGeometriesAreNotPublished(t *testing.T) {
+	is := is.New(t)
+
+	cb := &testClient.ContextBrokerClientMock{}
+
+	handler := NewThingTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient { return cb }, DefaultConfig())
+
+	body := strings.Replace(sewerJson, `"location": {
+      "latitude": 62.395275,
+      "longitude": 17.462769
+    }`, `"location": {"type":"Polygon","coordinates":[[[17.3,62.39],[17.31,62.39],[17.31,62.4]]]}`, 1)
+
+	buf := &bytes.Buffer{}
+	handler(context.Background(), thingMessage("application/vnd.diwise.sewer+json", body), slog.New(slog.NewTextHandler(buf, nil)))
+
+	is.Equal(len(cb.MergeEntityCalls()), 0)
+	is.Equal(len(cb.CreateEntityCalls()), 0)
+	is.True(strings.Contains(buf.String(), "invalid location: malformed Polygon: ring 0 must have at least 4 positions"))
+}
+
+func thingMessage(contentType, body string) messaging.IncomingTopicMessage {
+	return &messaging.IncomingTopicMessageMock{
+		BodyFunc:        func() []byte { return []byte(body) },
+		ContentTypeFunc: func() string { return contentType },
+		TopicNameFunc:   func() string { return "thing.updated" },
+	}
+}
@@ -0,0 +1,265 @@
+package things
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/diwise/context-broker/pkg/ngsild/client"
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities"
+	"github.com/diwise/context-broker/pkg/ngsild/types/relationships"
+	"github.com/diwise/iot-transform-fiware/internal/application/cip"
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// IDStrategy decides what identifies a thing in the ids of the entities it is published as
+type IDStrategy string
+
+const (
+	// NameAliases identifies a thing by its alternative name, name or id as it was when the thing was first
+	// handled. The name is kept as an alias of the thing in the state store, so that the entity ids of the thing
+	// stay the same when it is renamed.
+	NameAliases IDStrategy = "alias"
+	// ThingIDs identifies a thing by its immutable id
+	ThingIDs IDStrategy = "id"
+)
+
+// ParseIDStrategy returns the IDStrategy named by s
+func ParseIDStrategy(s string) (IDStrategy, error) {
+	strategy := IDStrategy(strings.ToLower(s))
+
+	if strategy != NameAliases && strategy != ThingIDs {
+		return "", fmt.Errorf("unknown id strategy %q, expected %q or %q", s, NameAliases, ThingIDs)
+	}
+
+	return strategy, nil
+}
+
+const (
+	// thingKeyName is the name of the key that a thing is known by in the state store
+	thingKeyName string = "key"
+	// ownerName is the name of the id of the thing that owns an entity id in the state store
+	ownerName string = "owner"
+)
+
+// keyed is implemented by a pointer to every kind of thing, through the thing it embeds, so that the key that a
+// thing is published under can be set
+type keyed[T payload] interface {
+	*T
+	setKey(key string)
+}
+
+// identify resolves the key of t according to the id strategy in h, and makes sure that the entity that represents
+// t is not owned by another thing. Should it be, e.g. because two things have the same name, t is identified by
+// its id instead, and failing that by its id and a hash of it, and the collision is counted and logged. identify
+// returns the key that t was previously published under if that has changed.
+func (k kind[T, P]) identify(ctx context.Context, t *T, h handling, log *slog.Logger) (string, error) {
+	base := (*t).base()
+
+	key, previous, err := resolveKey(ctx, base, h.cfg.IDs)
+	if err != nil {
+		return "", err
+	}
+
+	if previous != "" {
+		prev := *t
+		P(&prev).setKey(previous)
+
+		prevID, err := k.entityID(ctx, h.cfg, prev)
+		if err != nil {
+			return "", err
+		}
+
+		owner, err := ownerOf(ctx, base.Tenant, prevID)
+		if err != nil {
+			return "", err
+		}
+
+		if owner != "" && owner != base.ID {
+			// the previous entity belongs to another thing, and must not be superseded
+			previous = ""
+		}
+	}
+
+	for _, candidate := range candidateKeys(key, base) {
+		P(t).setKey(candidate)
+		entityID, err := k.entityID(ctx, h.cfg, *t)
+		if err != nil {
+			return "", err
+		}
+
+		owner, displaced, err := claim(ctx, base.Tenant, entityID, base.ID)
+		if err != nil {
+			return "", err
+		}
+
+		if displaced != "" {
+			h.collisions.Add(ctx, 1, metric.WithAttributes(attribute.String("kind", k.name)))
+			log.Warn("entity id is taken over from another thing", slog.String("entity_id", entityID), slog.String("previous_owner", displaced), slog.String("thing_id", base.ID))
+		}
+
+		if owner == base.ID {
+			if candidate == previous {
+				previous = ""
+			}
+			return previous, nil
+		}
+
+		h.collisions.Add(ctx, 1, metric.WithAttributes(attribute.String("kind", k.name)))
+		log.Warn("entity id is already used by another thing", slog.String("entity_id", entityID), slog.String("owner", owner), slog.String("thing_id", base.ID))
+	}
+
+	return "", fmt.Errorf("every entity id of thing %s is already used by other things", base.ID)
+}
+
+// entityID returns the id of the entity that represents t
+func (k kind[T, P]) entityID(ctx context.Context, cfg Config, t T) (string, error) {
+	ids, err := k.ids(ctx, cfg, t)
+	if err != nil {
+		return "", err
+	}
+
+	return ids[0], nil
+}
+
+// candidateKeys returns the keys that t may be identified by, in order of preference
+func candidateKeys(key string, t thing) []string {
+	id := nonSafeUriRegExp.ReplaceAllString(t.ID, ":")
+
+	h := fnv.New32a()
+	h.Write([]byte(t.ID))
+
+	return slices.Compact([]string{key, id, fmt.Sprintf("%s:%08x", id, h.Sum32())})
+}
+
+// claim makes the thing with id thingID the owner of entityID, unless it is already owned by another thing
+// with a lower id, and returns the owner and the thing that was displaced, if any. Letting the lowest id win
+// makes the outcome of a collision independent of the order in which the things are handled.
+func claim(ctx context.Context, tenant, entityID, thingID string) (owner, displaced string, err error) {
+	key := state.NewKey(tenant, entityID, ownerName)
+
+	unlock := state.Lock(key)
+	defer unlock()
+
+	owner, err = ownerOf(ctx, tenant, entityID)
+	if err != nil {
+		return "", "", err
+	}
+
+	if owner != "" && owner <= thingID {
+		return owner, "", nil
+	}
+
+	err = state.GetFromContext(ctx).Set(ctx, key, thingID, 0)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to store the owner of %s: %w", entityID, err)
+	}
+
+	return thingID, owner, nil
+}
+
+// ownerOf returns the id of the thing that owns entityID, or an empty string if no thing does
+func ownerOf(ctx context.Context, tenant, entityID string) (string, error) {
+	owner := ""
+
+	_, err := state.GetFromContext(ctx).Get(ctx, state.NewKey(tenant, entityID, ownerName), &owner)
+	if err != nil {
+		return "", fmt.Errorf("failed to load the owner of %s: %w", entityID, err)
+	}
+
+	return owner, nil
+}
+
+func release(ctx context.Context, tenant, entityID string) error {
+	err := state.GetFromContext(ctx).Delete(ctx, state.NewKey(tenant, entityID, ownerName))
+	if err != nil {
+		return fmt.Errorf("failed to release %s: %w", entityID, err)
+	}
+
+	return nil
+}
+
+// resolveKey returns the key that identifies t according to strategy, and the key that t was previously
+// published under if that differs, i.e. if the strategy has changed since t was last handled
+func resolveKey(ctx context.Context, t thing, strategy IDStrategy) (string, string, error) {
+	stored, err := storedKey(ctx, t)
+	if err != nil {
+		return "", "", err
+	}
+
+	if strategy == NameAliases {
+		if stored != "" {
+			return stored, "", nil
+		}
+		return t.AlternativeNameOrNameOrID(), "", nil
+	}
+
+	key := nonSafeUriRegExp.ReplaceAllString(t.ID, ":")
+
+	previous := stored
+	if previous == "" {
+		// things handled before the strategy was introduced were published under their names
+		previous = t.AlternativeNameOrNameOrID()
+	}
+
+	if previous == key {
+		previous = ""
+	}
+
+	return key, previous, nil
+}
+
+func storedKey(ctx context.Context, t thing) (string, error) {
+	key := ""
+
+	_, err := state.GetFromContext(ctx).Get(ctx, state.NewKey(t.Tenant, t.ID, thingKeyName), &key)
+	if err != nil {
+		return "", fmt.Errorf("failed to load the key of thing %s: %w", t.ID, err)
+	}
+
+	return key, nil
+}
+
+func storeKey(ctx context.Context, t thing) error {
+	err := state.GetFromContext(ctx).Set(ctx, state.NewKey(t.Tenant, t.ID, thingKeyName), t.Key(), 0)
+	if err != nil {
+		return fmt.Errorf("failed to store the key of thing %s: %w", t.ID, err)
+	}
+
+	return nil
+}
+
+func forgetKey(ctx context.Context, t thing) error {
+	err := state.GetFromContext(ctx).Delete(ctx, state.NewKey(t.Tenant, t.ID, thingKeyName))
+	if err != nil {
+		return fmt.Errorf("failed to forget the key of thing %s: %w", t.ID, err)
+	}
+
+	return nil
+}
+
+// link references the entities with ids in current from the entities, if they exist, with the corresponding
+// ids in previous that the thing was published as before, with supersededBy. The previous entities, and their
+// temporal evolution, are kept as they are.
+func link(ctx context.Context, cbClient client.ContextBrokerClient, log *slog.Logger, previous, current []string) error {
+	for i := range min(len(previous), len(current)) {
+		if previous[i] == current[i] {
+			continue
+		}
+
+		err := cip.MergeIfExists(ctx, cbClient, previous[i], []entities.EntityDecoratorFunc{
+			entities.R("supersededBy", relationships.NewSingleObjectRelationship(current[i])),
+		})
+		if err != nil {
+			log.Error("failed to link previous entity", slog.String("entity_id", previous[i]), slog.String("superseded_by", current[i]), "err", err.Error())
+			return err
+		}
+	}
+
+	return nil
+}
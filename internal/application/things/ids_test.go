@@ -0,0 +1,189 @@
+package things
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/diwise/context-broker/pkg/ngsild"
+	"github.com/diwise/context-broker/pkg/ngsild/client"
+	"github.com/diwise/context-broker/pkg/ngsild/types"
+	testClient "github.com/diwise/context-broker/pkg/test"
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/matryer/is"
+)
+
+func TestThatRenamedThingsKeepTheirEntityIDs(t *testing.T) {
+	is := is.New(t)
+
+	cb, merged := newMergeRecorder()
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+
+	handler := NewThingTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient { return cb }, aliases())
+
+	handler(ctx, thingMessage("application/vnd.diwise.sewer+json", sewerJson), slog.Default())
+	handler(ctx, thingMessage("application/vnd.diwise.sewer+json", strings.Replace(sewerJson, `"name": "05"`, `"name": "Overflow 05"`, 1)), slog.Default())
+
+	is.Equal(len(merged["urn:ngsi-ld:CombinedSewerOverflow:05"]), 2)
+	is.Equal(len(merged["urn:ngsi-ld:CombinedSewerOverflow:Overflow:05"]), 0)
+}
+
+func TestThatThingIDsSupersedeNameBasedEntities(t *testing.T) {
+	is := is.New(t)
+
+	cb, merged := newMergeRecorder()
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+
+	handler := NewThingTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient { return cb }, DefaultConfig())
+
+	handler(ctx, thingMessage("application/vnd.diwise.sewer+json", sewerJson), slog.Default())
+	handler(ctx, thingMessage("application/vnd.diwise.sewer+json", sewerJson), slog.Default())
+
+	const entityID = "urn:ngsi-ld:CombinedSewerOverflow:25ba0559-3d49-4853-a537-3bbf7d2ae777"
+
+	is.Equal(len(merged[entityID]), 2)
+	is.Equal(len(merged["urn:ngsi-ld:CombinedSewerOverflow:05"]), 1) // the previous entity is linked once, and otherwise left as it is
+	is.Equal(merged["urn:ngsi-ld:CombinedSewerOverflow:05"][0], `{"@context":["https://raw.githubusercontent.com/diwise/context-broker/main/assets/jsonldcontexts/default-context.jsonld"],"supersededBy":{"type":"Relationship","object":"`+entityID+`"}}`)
+}
+
+func TestThatDeletedThingsAreFoundByTheirAlias(t *testing.T) {
+	is := is.New(t)
+
+	cb, _ := newMergeRecorder()
+	cb.DeleteEntityFunc = func(ctx context.Context, entityID string) (*ngsild.DeleteEntityResult, error) {
+		return ngsild.NewDeleteEntityResult(), nil
+	}
+
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+	cbClientFn := func(s string) client.ContextBrokerClient { return cb }
+
+	renamed := strings.Replace(sewerJson, `"name": "05"`, `"name": "06"`, 1)
+
+	NewThingTopicMessageHandler(&messaging.MsgContextMock{}, cbClientFn, aliases())(ctx, thingMessage("application/vnd.diwise.sewer+json", sewerJson), slog.Default())
+	NewThingDeletedTopicMessageHandler(&messaging.MsgContextMock{}, cbClientFn, Config{IDs: NameAliases, Deletion: DeleteEntities})(ctx, thingMessage("application/vnd.diwise.sewer+json", renamed), slog.Default())
+
+	is.Equal(len(cb.DeleteEntityCalls()), 1)
+	is.Equal(cb.DeleteEntityCalls()[0].EntityID, "urn:ngsi-ld:CombinedSewerOverflow:05")
+
+	// the alias is forgotten along with the thing
+	key, err := storedKey(ctx, thing{ID: "25ba0559-3d49-4853-a537-3bbf7d2ae777", Tenant: "default"})
+	is.NoErr(err)
+	is.Equal(key, "")
+}
+
+func TestParseIDStrategy(t *testing.T) {
+	is := is.New(t)
+
+	strategy, err := ParseIDStrategy("ID")
+	is.NoErr(err)
+	is.Equal(strategy, ThingIDs)
+
+	_, err = ParseIDStrategy("name")
+	is.True(err != nil)
+}
+
+// newMergeRecorder returns a context broker client where every entity exists, and the fragments merged into
+// each entity, except for devices
+func newMergeRecorder() (*testClient.ContextBrokerClientMock, map[string][]string) {
+	merged := map[string][]string{}
+
+	return &testClient.ContextBrokerClientMock{
+		MergeEntityFunc: func(ctx context.Context, entityID string, fragment types.EntityFragment, headers map[string][]string) (*ngsild.MergeEntityResult, error) {
+			if !isDevice(entityID) {
+				b, _ := json.Marshal(fragment)
+				merged[entityID] = append(merged[entityID], string(b))
+			}
+			return &ngsild.MergeEntityResult{}, nil
+		},
+	}, merged
+}
+
+func TestThatCollidingThingsAreIdentifiedByTheirIDs(t *testing.T) {
+	is := is.New(t)
+
+	cb, merged := newMergeRecorder()
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+
+	handler := NewThingTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient { return cb }, aliases())
+
+	buf := &bytes.Buffer{}
+	log := slog.New(slog.NewTextHandler(buf, nil))
+
+	for range 2 {
+		handler(ctx, thingMessage("application/vnd.diwise.container+json", containerWithName("c-001", "Soptunna 1")), log)
+		handler(ctx, thingMessage("application/vnd.diwise.container+json", containerWithName("c-002", "Soptunna:1")), log)
+	}
+
+	is.Equal(len(merged["urn:ngsi-ld:WasteContainer:Soptunna:1"]), 2)
+	is.Equal(len(merged["urn:ngsi-ld:WasteContainer:c-002"]), 2)
+	is.Equal(strings.Count(buf.String(), "entity id is already used by another thing"), 1) // the second thing keeps its id once it has collided
+}
+
+func TestThatTheThingWithTheLowestIDOwnsACollidingEntityID(t *testing.T) {
+	is := is.New(t)
+
+	cb, merged := newMergeRecorder()
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+
+	handler := NewThingTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient { return cb }, aliases())
+
+	handler(ctx, thingMessage("application/vnd.diwise.container+json", containerWithName("c-002", "Soptunna:1")), slog.Default())
+	handler(ctx, thingMessage("application/vnd.diwise.container+json", containerWithName("c-001", "Soptunna 1")), slog.Default())
+	handler(ctx, thingMessage("application/vnd.diwise.container+json", containerWithName("c-002", "Soptunna:1")), slog.Default())
+
+	owner, err := ownerOf(ctx, "default", "urn:ngsi-ld:WasteContainer:Soptunna:1")
+	is.NoErr(err)
+	is.Equal(owner, "c-001")
+	is.Equal(len(merged["urn:ngsi-ld:WasteContainer:c-002"]), 1)
+}
+
+func TestThatConcurrentClaimsAreWonByTheLowestID(t *testing.T) {
+	is := is.New(t)
+
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+
+	var wg sync.WaitGroup
+	for i := 9; i >= 0; i-- {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := claim(ctx, "default", "urn:ngsi-ld:WasteContainer:Soptunna:1", fmt.Sprintf("c-%03d", i))
+			is.NoErr(err)
+		}()
+	}
+	wg.Wait()
+
+	owner, err := ownerOf(ctx, "default", "urn:ngsi-ld:WasteContainer:Soptunna:1")
+	is.NoErr(err)
+	is.Equal(owner, "c-000")
+}
+
+func TestThatEntitiesOfOtherThingsAreNotRemoved(t *testing.T) {
+	is := is.New(t)
+
+	cb, _ := newMergeRecorder()
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+	cbClientFn := func(s string) client.ContextBrokerClient { return cb }
+
+	NewThingTopicMessageHandler(&messaging.MsgContextMock{}, cbClientFn, aliases())(ctx, thingMessage("application/vnd.diwise.container+json", containerWithName("c-001", "Soptunna 1")), slog.Default())
+	NewThingDeletedTopicMessageHandler(&messaging.MsgContextMock{}, cbClientFn, Config{IDs: NameAliases, Deletion: DeleteEntities})(ctx, thingMessage("application/vnd.diwise.container+json", containerWithName("c-002", "Soptunna:1")), slog.Default())
+
+	is.Equal(len(cb.DeleteEntityCalls()), 0)
+}
+
+// aliases returns the default configuration, but with things identified by their name aliases
+func aliases() Config {
+	cfg := DefaultConfig()
+	cfg.IDs = NameAliases
+	return cfg
+}
+
+func containerWithName(id, name string) string {
+	return fmt.Sprintf(`{"id":"%[1]s","type":"Container","thing":{"id":"%[1]s","type":"Container","subType":"WasteContainer","name":"%[2]s","location":{"latitude":62,"longitude":17},"currentLevel":0.5,"percent":50,"observedAt":"2024-11-19T10:49:59Z","tenant":"default"},"tenant":"default","timestamp":"2024-11-19T10:49:59Z"}`, id, name)
+}
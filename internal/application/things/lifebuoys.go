@@ -0,0 +1,321 @@
+package things
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/diwise/context-broker/pkg/ngsild/client"
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities"
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities/decorators"
+	"github.com/diwise/iot-transform-fiware/internal/application/alerts"
+	helpers "github.com/diwise/iot-transform-fiware/internal/application/decorators"
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+
+	. "github.com/diwise/context-broker/pkg/ngsild/types/properties"
+)
+
+// DefaultMissingLifebuoyAlert is how long a lifebuoy may be missing before an alert is issued, unless configured otherwise
+const DefaultMissingLifebuoyAlert = 10 * time.Minute
+
+// lifebuoyState is whether a lifebuoy is in place, and when it last went missing and was returned
+type lifebuoyState struct {
+	Present    bool      `json:"present"`
+	ObservedAt time.Time `json:"observedAt"`
+	// MissingSince is when the lifebuoy last went missing, kept after it has been returned
+	MissingSince *time.Time `json:"missingSince,omitempty"`
+	ReturnedAt   *time.Time `json:"returnedAt,omitempty"`
+	// AlertIssued is when the alert about the latest time the lifebuoy went missing was issued, if it was
+	AlertIssued *time.Time `json:"alertIssued,omitempty"`
+}
+
+const (
+	lifebuoyName string = "lifebuoy"
+	// missingLifebuoysName names the lifebuoys that are missing without an alert having been issued yet, see
+	// WatchMissingLifebuoys
+	missingLifebuoysName string = "missingLifebuoys"
+)
+
+// nextLifebuoyState updates the state of the lifebuoy lb with its presence
+func nextLifebuoyState(ctx context.Context, lb lifebuoy, alertAfter time.Duration) (lifebuoyState, lifebuoyState, error) {
+	store := state.GetFromContext(ctx)
+	key := state.NewKey(lb.Tenant, lb.ID, lifebuoyName)
+
+	unlock := state.Lock(key)
+	defer unlock()
+
+	prev := lifebuoyState{}
+	_, err := store.Get(ctx, key, &prev)
+	if err != nil {
+		return prev, prev, fmt.Errorf("failed to load lifebuoy state: %w", err)
+	}
+
+	observedAt := lb.ObservedAt
+	if observedAt.IsZero() {
+		observedAt = time.Now()
+	}
+
+	next := prev.next(lb.Presence, observedAt, alertAfter)
+
+	err = store.Set(ctx, key, next, 0)
+	if err != nil {
+		return prev, prev, fmt.Errorf("failed to store lifebuoy state: %w", err)
+	}
+
+	if prev.awaitsAlert() != next.awaitsAlert() {
+		err = trackMissingLifebuoy(ctx, lb, next.awaitsAlert())
+		if err != nil {
+			return prev, prev, err
+		}
+	}
+
+	return prev, next, nil
+}
+
+func (prev lifebuoyState) next(present bool, observedAt time.Time, alertAfter time.Duration) lifebuoyState {
+	observedAt = observedAt.UTC()
+
+	if !prev.ObservedAt.IsZero() && !observedAt.After(prev.ObservedAt) {
+		return prev
+	}
+
+	next := prev
+	next.Present = present
+	next.ObservedAt = observedAt
+
+	if !present && (prev.Present || prev.ObservedAt.IsZero()) {
+		next.MissingSince = &observedAt
+		next.ReturnedAt = nil
+		next.AlertIssued = nil
+	}
+
+	if present && !prev.Present && prev.MissingSince != nil {
+		next.ReturnedAt = &observedAt
+	}
+
+	if !present && next.AlertIssued == nil && observedAt.Sub(*next.MissingSince) >= alertAfter {
+		next.AlertIssued = &observedAt
+	}
+
+	return next
+}
+
+// awaitsAlert reports whether the lifebuoy is missing, but no alert has been issued about it yet
+func (s lifebuoyState) awaitsAlert() bool {
+	return !s.Present && s.MissingSince != nil && s.AlertIssued == nil
+}
+
+// missingFor returns how long the lifebuoy has been missing, or was missing the last time it went missing
+func (s lifebuoyState) missingFor() time.Duration {
+	if s.MissingSince == nil {
+		return 0
+	}
+
+	if s.ReturnedAt != nil {
+		return s.ReturnedAt.Sub(*s.MissingSince)
+	}
+
+	return s.ObservedAt.Sub(*s.MissingSince)
+}
+
+// missingProperties returns when the lifebuoy last went missing and how long it was, or has been, missing
+func (s lifebuoyState) missingProperties() []entities.EntityDecoratorFunc {
+	if s.MissingSince == nil {
+		return nil
+	}
+
+	return []entities.EntityDecoratorFunc{
+		decorators.DateTime("dateMissing", helpers.FormatTime(*s.MissingSince)),
+		decorators.Number("missingDuration", s.missingFor().Seconds(), UnitCode("SEC"), ObservedAt(helpers.FormatTime(s.ObservedAt))),
+	}
+}
+
+// missingLifebuoyAlert returns the alert about the latest time lb went missing, while it is missing and once
+// when it is returned to close the alert. Nothing is returned when no alert has been issued.
+func missingLifebuoyAlert(lb lifebuoy, prev, next lifebuoyState) (entity, bool) {
+	if next.AlertIssued == nil {
+		return entity{}, false
+	}
+
+	if next.Present && prev.Present {
+		// the alert was closed when the lifebuoy was returned
+		return entity{}, false
+	}
+
+	id := fmt.Sprintf("%sLifebuoy:%s:%s", alerts.AlertIDPrefix, lb.Key(), next.MissingSince.Format("20060102T150405Z"))
+
+	if next.Present {
+		props := []entities.EntityDecoratorFunc{
+			decorators.DateTime("validTo", helpers.FormatTime(*next.ReturnedAt)),
+		}
+		return entity{ID: id, TypeName: alerts.AlertTypeName, Properties: props, MergeOnly: true}, true
+	}
+
+	description := fmt.Sprintf("Lifebuoy %s has been missing since %s", lb.AlternativeNameOrNameOrID(), helpers.FormatTime(*next.MissingSince))
+
+	props := alerts.Properties("security", "lifebuoyMissing", "high", description, lifebuoyIDPrefix+lb.Key(), *next.MissingSince, *next.AlertIssued)
+	props = append(props, lb.Location.point())
+
+	return entity{ID: id, TypeName: alerts.AlertTypeName, Properties: props}, true
+}
+
+// missingLifebuoy is a lifebuoy that is missing, as it was last handled, with the key it was identified by
+type missingLifebuoy struct {
+	Lifebuoy lifebuoy `json:"lifebuoy"`
+	Key      string   `json:"key"`
+}
+
+var missingLifebuoysKey = state.NewKey("", lifebuoyTypeName, missingLifebuoysName)
+
+// trackMissingLifebuoy adds lb to, or removes it from, the lifebuoys that are swept for alerts
+func trackMissingLifebuoy(ctx context.Context, lb lifebuoy, missing bool) error {
+	store := state.GetFromContext(ctx)
+
+	unlock := state.Lock(missingLifebuoysKey)
+	defer unlock()
+
+	tracked := map[string]missingLifebuoy{}
+	_, err := store.Get(ctx, missingLifebuoysKey, &tracked)
+	if err != nil {
+		return fmt.Errorf("failed to load missing lifebuoys: %w", err)
+	}
+
+	id := state.NewKey(lb.Tenant, lb.ID, lifebuoyName).String()
+
+	if missing {
+		tracked[id] = missingLifebuoy{Lifebuoy: lb, Key: lb.Key()}
+	} else {
+		delete(tracked, id)
+	}
+
+	err = store.Set(ctx, missingLifebuoysKey, tracked, 0)
+	if err != nil {
+		return fmt.Errorf("failed to store missing lifebuoys: %w", err)
+	}
+
+	return nil
+}
+
+// forgetLifebuoy clears the state kept for the lifebuoy lb, and stops it from being swept for alerts
+func forgetLifebuoy(ctx context.Context, _ Config, lb lifebuoy, _ time.Time) ([]entity, error) {
+	key := state.NewKey(lb.Tenant, lb.ID, lifebuoyName)
+
+	unlock := state.Lock(key)
+	defer unlock()
+
+	err := state.GetFromContext(ctx).Delete(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to forget lifebuoy state: %w", err)
+	}
+
+	return nil, trackMissingLifebuoy(ctx, lb, false)
+}
+
+// WatchMissingLifebuoys issues the alerts about lifebuoys that have been missing for longer than
+// cfg.MissingLifebuoyAlert, also when they are not reported again, by sweeping the missing lifebuoys every interval
+// until ctx is done. The state store is taken from ctx.
+func WatchMissingLifebuoys(ctx context.Context, cbClientFn func(string) client.ContextBrokerClient, cfg Config, interval time.Duration) {
+	log := logging.GetFromContext(ctx)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			err := sweepMissingLifebuoys(ctx, cbClientFn, cfg.MissingLifebuoyAlert, now, log)
+			if err != nil {
+				log.Error("failed to sweep missing lifebuoys", "err", err.Error())
+			}
+		}
+	}
+}
+
+// sweepMissingLifebuoys writes an alert about each lifebuoy that has been missing for alertAfter at now. The alert
+// is only taken as issued once it has been written, so that an alert that failed to be written is retried.
+func sweepMissingLifebuoys(ctx context.Context, cbClientFn func(string) client.ContextBrokerClient, alertAfter time.Duration, now time.Time, log *slog.Logger) error {
+	tracked := map[string]missingLifebuoy{}
+
+	_, err := state.GetFromContext(ctx).Get(ctx, missingLifebuoysKey, &tracked)
+	if err != nil {
+		return fmt.Errorf("failed to load missing lifebuoys: %w", err)
+	}
+
+	for _, m := range tracked {
+		lb := m.Lifebuoy
+		lb.setKey(m.Key)
+
+		alert, ok, err := dueLifebuoyAlert(ctx, lb, alertAfter, now)
+		if err != nil {
+			log.Error("failed to check missing lifebuoy", slog.String("thing_id", lb.ID), "err", err.Error())
+			continue
+		}
+
+		if ok {
+			_ = write(ctx, cbClientFn(lb.Tenant), log.With(slog.String("tenant", lb.Tenant)), alert)
+		}
+	}
+
+	return nil
+}
+
+// dueLifebuoyAlert returns the alert about lb if it has been missing for alertAfter at now and no alert has been
+// issued about it yet. Lifebuoys that are no longer awaiting an alert stop being tracked.
+func dueLifebuoyAlert(ctx context.Context, lb lifebuoy, alertAfter time.Duration, now time.Time) (entity, bool, error) {
+	store := state.GetFromContext(ctx)
+	key := state.NewKey(lb.Tenant, lb.ID, lifebuoyName)
+
+	unlock := state.Lock(key)
+	defer unlock()
+
+	prev := lifebuoyState{}
+	_, err := store.Get(ctx, key, &prev)
+	if err != nil {
+		return entity{}, false, fmt.Errorf("failed to load lifebuoy state: %w", err)
+	}
+
+	if !prev.awaitsAlert() {
+		return entity{}, false, trackMissingLifebuoy(ctx, lb, false)
+	}
+
+	if now.Sub(*prev.MissingSince) < alertAfter {
+		return entity{}, false, nil
+	}
+
+	issued := now.UTC()
+	next := prev
+	next.AlertIssued = &issued
+
+	alert, _ := missingLifebuoyAlert(lb, prev, next)
+
+	alert.written = func(ctx context.Context) error {
+		unlock := state.Lock(key)
+		defer unlock()
+
+		current := lifebuoyState{}
+		_, err := store.Get(ctx, key, &current)
+		if err != nil {
+			return fmt.Errorf("failed to load lifebuoy state: %w", err)
+		}
+
+		// the lifebuoy may have been reported while the alert was written
+		if !current.awaitsAlert() || !current.MissingSince.Equal(*next.MissingSince) {
+			return nil
+		}
+
+		current.AlertIssued = &issued
+
+		err = store.Set(ctx, key, current, 0)
+		if err != nil {
+			return fmt.Errorf("failed to store lifebuoy state: %w", err)
+		}
+
+		return trackMissingLifebuoy(ctx, lb, false)
+	}
+
+	return alert, true, nil
+}
@@ -0,0 +1,134 @@
+package things
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/diwise/context-broker/pkg/ngsild"
+	"github.com/diwise/context-broker/pkg/ngsild/client"
+	"github.com/diwise/context-broker/pkg/ngsild/types"
+	testClient "github.com/diwise/context-broker/pkg/test"
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/matryer/is"
+)
+
+func TestThatTheTimeALifebuoyIsMissingIsTracked(t *testing.T) {
+	is := is.New(t)
+
+	t0 := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	s := lifebuoyState{}.next(true, t0, 10*time.Minute)
+	is.True(s.MissingSince == nil)
+
+	s = s.next(false, t0.Add(time.Minute), 10*time.Minute)
+	is.Equal(*s.MissingSince, t0.Add(time.Minute))
+	is.True(s.AlertIssued == nil)
+
+	s = s.next(false, t0.Add(11*time.Minute), 10*time.Minute)
+	is.Equal(*s.AlertIssued, t0.Add(11*time.Minute))
+	is.Equal(s.missingFor(), 10*time.Minute)
+
+	s = s.next(true, t0.Add(21*time.Minute), 10*time.Minute)
+	is.Equal(*s.ReturnedAt, t0.Add(21*time.Minute))
+	is.Equal(s.missingFor(), 20*time.Minute) // until it was returned
+
+	s = s.next(true, t0.Add(30*time.Minute), 10*time.Minute)
+	is.Equal(s.missingFor(), 20*time.Minute)
+}
+
+func TestThatMissingLifebuoysRaiseAndCloseAlerts(t *testing.T) {
+	is := is.New(t)
+
+	cb, merged := newMergeRecorder()
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+	handler := NewThingTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient { return cb }, DefaultConfig())
+
+	lifebuoy := func(presence bool, observedAt string) messaging.IncomingTopicMessage {
+		return thingMessage("application/vnd.diwise.lifebuoy+json", fmt.Sprintf(`{"id":"lb-1","type":"Lifebuoy","thing":{"id":"lb-1","type":"Lifebuoy","name":"Livboj 1","location":{"latitude":62.39,"longitude":17.31},"presence":%t,"observedAt":"%s","tenant":"default"},"tenant":"default"}`, presence, observedAt))
+	}
+
+	handler(ctx, lifebuoy(true, "2024-07-01T12:00:00Z"), slog.Default())
+	handler(ctx, lifebuoy(false, "2024-07-01T12:01:00Z"), slog.Default())
+	handler(ctx, lifebuoy(false, "2024-07-01T12:05:00Z"), slog.Default())
+
+	const alertID = "urn:ngsi-ld:Alert:Lifebuoy:lb-1:20240701T120100Z"
+	is.Equal(len(merged[alertID]), 0) // not missing for long enough
+
+	handler(ctx, lifebuoy(false, "2024-07-01T12:15:00Z"), slog.Default())
+	handler(ctx, lifebuoy(true, "2024-07-01T12:30:00Z"), slog.Default())
+	handler(ctx, lifebuoy(true, "2024-07-01T12:35:00Z"), slog.Default())
+
+	alert := merged[alertID]
+	is.Equal(len(alert), 2) // raised, then closed once
+	is.True(strings.Contains(alert[0], `"alertSource":{"type":"Relationship","object":"urn:ngsi-ld:Lifebuoy:lb-1"}`))
+	is.True(strings.Contains(alert[0], `"validFrom":{"type":"Property","value":{"@type":"DateTime","@value":"2024-07-01T12:01:00Z"}}`))
+	is.True(strings.Contains(alert[0], `"dateIssued":{"type":"Property","value":{"@type":"DateTime","@value":"2024-07-01T12:15:00Z"}}`))
+	is.True(strings.Contains(alert[1], `"validTo":{"type":"Property","value":{"@type":"DateTime","@value":"2024-07-01T12:30:00Z"}}`))
+
+	lb := merged["urn:ngsi-ld:Lifebuoy:lb-1"]
+	is.True(strings.Contains(lb[3], `"dateMissing":{"type":"Property","value":{"@type":"DateTime","@value":"2024-07-01T12:01:00Z"}}`))
+	is.True(strings.Contains(lb[3], `"missingDuration":{"type":"Property","value":840`))
+	is.True(strings.Contains(lb[5], `"missingDuration":{"type":"Property","value":1740`))
+}
+
+func TestThatLifebuoysThatStopReportingRaiseAlerts(t *testing.T) {
+	is := is.New(t)
+
+	cb, merged := newMergeRecorder()
+	cbClientFn := func(s string) client.ContextBrokerClient { return cb }
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+	handler := NewThingTopicMessageHandler(&messaging.MsgContextMock{}, cbClientFn, DefaultConfig())
+
+	handler(ctx, thingMessage("application/vnd.diwise.lifebuoy+json", `{"id":"lb-1","type":"Lifebuoy","thing":{"id":"lb-1","type":"Lifebuoy","name":"Livboj 1","presence":false,"observedAt":"2024-07-01T12:01:00Z","tenant":"default"},"tenant":"default"}`), slog.Default())
+
+	const alertID = "urn:ngsi-ld:Alert:Lifebuoy:lb-1:20240701T120100Z"
+
+	t0 := time.Date(2024, 7, 1, 12, 5, 0, 0, time.UTC)
+
+	is.NoErr(sweepMissingLifebuoys(ctx, cbClientFn, DefaultMissingLifebuoyAlert, t0, slog.Default()))
+	is.Equal(len(merged[alertID]), 0) // not missing for long enough
+
+	is.NoErr(sweepMissingLifebuoys(ctx, cbClientFn, DefaultMissingLifebuoyAlert, t0.Add(10*time.Minute), slog.Default()))
+	is.NoErr(sweepMissingLifebuoys(ctx, cbClientFn, DefaultMissingLifebuoyAlert, t0.Add(20*time.Minute), slog.Default()))
+
+	alert := merged[alertID]
+	is.Equal(len(alert), 1) // raised once
+	is.True(strings.Contains(alert[0], `"dateIssued":{"type":"Property","value":{"@type":"DateTime","@value":"2024-07-01T12:15:00Z"}}`))
+
+	tracked := map[string]missingLifebuoy{}
+	_, err := state.GetFromContext(ctx).Get(ctx, missingLifebuoysKey, &tracked)
+	is.NoErr(err)
+	is.Equal(len(tracked), 0) // no longer awaiting an alert
+}
+
+func TestThatAFailedAlertIsRetried(t *testing.T) {
+	is := is.New(t)
+
+	cb, _ := newMergeRecorder()
+	cbClientFn := func(s string) client.ContextBrokerClient { return cb }
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+
+	NewThingTopicMessageHandler(&messaging.MsgContextMock{}, cbClientFn, DefaultConfig())(ctx, thingMessage("application/vnd.diwise.lifebuoy+json", `{"id":"lb-1","type":"Lifebuoy","thing":{"id":"lb-1","type":"Lifebuoy","name":"Livboj 1","presence":false,"observedAt":"2024-07-01T12:01:00Z","tenant":"default"},"tenant":"default"}`), slog.Default())
+
+	failing := &testClient.ContextBrokerClientMock{
+		MergeEntityFunc: func(ctx context.Context, entityID string, fragment types.EntityFragment, headers map[string][]string) (*ngsild.MergeEntityResult, error) {
+			return nil, errors.New("unavailable")
+		},
+	}
+
+	t0 := time.Date(2024, 7, 1, 12, 15, 0, 0, time.UTC)
+
+	is.NoErr(sweepMissingLifebuoys(ctx, func(s string) client.ContextBrokerClient { return failing }, DefaultMissingLifebuoyAlert, t0, slog.Default()))
+	is.NoErr(sweepMissingLifebuoys(ctx, cbClientFn, DefaultMissingLifebuoyAlert, t0.Add(time.Minute), slog.Default()))
+
+	s := lifebuoyState{}
+	_, err := state.GetFromContext(ctx).Get(ctx, state.NewKey("default", "lb-1", lifebuoyName), &s)
+	is.NoErr(err)
+	is.Equal(*s.AlertIssued, t0.Add(time.Minute))
+}
@@ -0,0 +1,206 @@
+package things
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities"
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities/decorators"
+	helpers "github.com/diwise/iot-transform-fiware/internal/application/decorators"
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
+
+	. "github.com/diwise/context-broker/pkg/ngsild/types/properties"
+)
+
+// occupancy is whether each of the desks in a room or building is occupied, keyed by the id of the desk
+type occupancy struct {
+	Desks      map[string]bool `json:"desks"`
+	ObservedAt time.Time       `json:"observedAt"`
+}
+
+func (o occupancy) occupied() int {
+	n := 0
+	for _, occupied := range o.Desks {
+		if occupied {
+			n++
+		}
+	}
+	return n
+}
+
+// utilization returns the share of the desks that are occupied, in percent
+func (o occupancy) utilization() float64 {
+	if len(o.Desks) == 0 {
+		return 0
+	}
+	return float64(o.occupied()) / float64(len(o.Desks)) * 100
+}
+
+func (o occupancy) properties() []entities.EntityDecoratorFunc {
+	ts := ObservedAt(helpers.FormatTime(o.ObservedAt))
+
+	return []entities.EntityDecoratorFunc{
+		decorators.Number("occupiedDesks", float64(o.occupied()), ts),
+		decorators.Number("numberOfDesks", float64(len(o.Desks)), ts),
+		decorators.Number("deskUtilization", o.utilization(), UnitCode("P1"), ts),
+	}
+}
+
+// deskState is what a desk was when it last changed, occupied or not and the rooms and buildings it was in
+type deskState struct {
+	Occupied  bool     `json:"occupied"`
+	Ancestors []string `json:"ancestors"`
+}
+
+const (
+	occupancyName string = "occupancy"
+	deskName      string = "desk"
+)
+
+// occupancyEntities keeps the occupancy of the rooms and buildings that d is in, and returns their occupancy when d
+// has changed state, or moved, since it was last handled. Only rooms and buildings that have been handled, and
+// thus have entities, are returned, and only to be merged into the entities that exist.
+func occupancyEntities(ctx context.Context, d desk, observedAt time.Time) ([]entity, error) {
+	store := state.GetFromContext(ctx)
+
+	ancestors, err := ancestorsOf(ctx, d.thing)
+	if err != nil {
+		return nil, err
+	}
+
+	deskKey := state.NewKey(d.Tenant, d.ID, deskName)
+
+	unlock := state.Lock(deskKey)
+	defer unlock()
+
+	prev := deskState{}
+	found, err := store.Get(ctx, deskKey, &prev)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load desk state: %w", err)
+	}
+
+	if found && prev.Occupied == d.Presence && slices.Equal(prev.Ancestors, ancestors) {
+		return nil, nil
+	}
+
+	if observedAt.IsZero() {
+		observedAt = time.Now()
+	}
+
+	ents := []entity{}
+
+	// the rooms and buildings that the desk has left are updated as well as those it is in
+	affected := append(slices.Clone(ancestors), prev.Ancestors...)
+	slices.Sort(affected)
+
+	for _, id := range slices.Compact(affected) {
+		e, err := updateOccupancy(ctx, d.Tenant, id, d.ID, slices.Contains(ancestors, id), d.Presence, observedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		ents = append(ents, e...)
+	}
+
+	err = store.Set(ctx, deskKey, deskState{Occupied: d.Presence, Ancestors: ancestors}, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store desk state: %w", err)
+	}
+
+	return ents, nil
+}
+
+// forgetDesk removes d from the occupancy of the rooms and buildings that it was in, and returns their occupancy
+// without it, as occupancyEntities does
+func forgetDesk(ctx context.Context, _ Config, d desk, deletedAt time.Time) ([]entity, error) {
+	store := state.GetFromContext(ctx)
+
+	deskKey := state.NewKey(d.Tenant, d.ID, deskName)
+
+	unlock := state.Lock(deskKey)
+	defer unlock()
+
+	prev := deskState{}
+	found, err := store.Get(ctx, deskKey, &prev)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	ents := []entity{}
+
+	for _, id := range prev.Ancestors {
+		e, err := updateOccupancy(ctx, d.Tenant, id, d.ID, false, false, deletedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		ents = append(ents, e...)
+	}
+
+	err = store.Delete(ctx, deskKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete desk state: %w", err)
+	}
+
+	return ents, nil
+}
+
+// updateOccupancy sets whether the desk with id deskID is occupied in the room or building with id thingID, or
+// removes the desk from it unless it is in it, and returns the entity that the occupancy is to be merged into, if
+// the room or building has one. The occupancy is locked while it is changed, since desks in the same room or
+// building may be handled at the same time.
+func updateOccupancy(ctx context.Context, tenant, thingID, deskID string, in, occupied bool, observedAt time.Time) ([]entity, error) {
+	store := state.GetFromContext(ctx)
+	key := state.NewKey(tenant, thingID, occupancyName)
+
+	unlock := state.Lock(key)
+	defer unlock()
+
+	o := occupancy{}
+	_, err := store.Get(ctx, key, &o)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load occupancy of %s: %w", thingID, err)
+	}
+
+	if o.Desks == nil {
+		o.Desks = map[string]bool{}
+	}
+	o.ObservedAt = observedAt.UTC()
+
+	if in {
+		o.Desks[deskID] = occupied
+	} else {
+		delete(o.Desks, deskID)
+	}
+
+	err = store.Set(ctx, key, o, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store occupancy of %s: %w", thingID, err)
+	}
+
+	e, ok, err := entityOf(ctx, tenant, thingID)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	return []entity{{ID: e.ID, TypeName: e.TypeName, Properties: o.properties(), MergeOnly: true}}, nil
+}
+
+// occupancyProperties returns the occupancy of the room or building with id thingID, if any of its desks have
+// been handled, so that it is published with the room or building also when that is handled after its desks
+func occupancyProperties(ctx context.Context, tenant, thingID string) ([]entities.EntityDecoratorFunc, error) {
+	o := occupancy{}
+
+	found, err := state.GetFromContext(ctx).Get(ctx, state.NewKey(tenant, thingID, occupancyName), &o)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load occupancy of %s: %w", thingID, err)
+	}
+
+	if !found || len(o.Desks) == 0 {
+		return nil, nil
+	}
+
+	return o.properties(), nil
+}
@@ -0,0 +1,117 @@
+package things
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/diwise/context-broker/pkg/ngsild/client"
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/matryer/is"
+)
+
+func TestThatDeskOccupancyIsAggregatedToRoomAndBuilding(t *testing.T) {
+	is := is.New(t)
+
+	cb, merged := newMergeRecorder()
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+	handler := NewThingTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient { return cb }, DefaultConfig())
+
+	desk := func(id string, presence bool, observedAt string) messaging.IncomingTopicMessage {
+		return thingMessage("application/vnd.diwise.desk+json", fmt.Sprintf(`{"id":"%s","type":"Desk","thing":{"id":"%s","type":"Desk","name":"%s","parent":"room-1","presence":%t,"observedAt":"%s","tenant":"default"},"tenant":"default"}`, id, id, id, presence, observedAt))
+	}
+
+	handler(ctx, thingMessage("application/vnd.diwise.building+json", `{"id":"b-1","type":"Building","thing":{"id":"b-1","type":"Building","name":"Stadshuset","rooms":[{"id":"room-1","type":"Room","name":"Rum 1"}],"tenant":"default"},"tenant":"default"}`), slog.Default())
+	handler(ctx, thingMessage("application/vnd.diwise.room+json", `{"id":"room-1","type":"Room","thing":{"id":"room-1","type":"Room","name":"Rum 1","tenant":"default"},"tenant":"default"}`), slog.Default())
+
+	handler(ctx, desk("desk-1", true, "2024-11-19T08:00:00Z"), slog.Default())
+	handler(ctx, desk("desk-2", false, "2024-11-19T08:05:00Z"), slog.Default())
+	handler(ctx, desk("desk-1", true, "2024-11-19T08:10:00Z"), slog.Default()) // no change in occupancy
+
+	room := merged["urn:ngsi-ld:IndoorEnvironmentObserved:Room:room-1"]
+	building := merged["urn:ngsi-ld:Building:b-1"]
+
+	is.Equal(len(room), 3)     // the room itself and the two changes
+	is.Equal(len(building), 3) // the building itself and the two changes
+
+	for _, fragments := range [][]string{room, building} {
+		is.True(strings.Contains(fragments[1], `"occupiedDesks":{"type":"Property","value":1,"observedAt":"2024-11-19T08:00:00Z"}`))
+		is.True(strings.Contains(fragments[1], `"deskUtilization":{"type":"Property","value":100`))
+		is.True(strings.Contains(fragments[2], `"numberOfDesks":{"type":"Property","value":2,"observedAt":"2024-11-19T08:05:00Z"}`))
+		is.True(strings.Contains(fragments[2], `"deskUtilization":{"type":"Property","value":50`))
+	}
+}
+
+func TestThatOccupancyIsPublishedWithRoomsHandledAfterTheirDesks(t *testing.T) {
+	is := is.New(t)
+
+	cb, merged := newMergeRecorder()
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+	handler := NewThingTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient { return cb }, DefaultConfig())
+
+	handler(ctx, thingMessage("application/vnd.diwise.desk+json", `{"id":"desk-1","type":"Desk","thing":{"id":"desk-1","type":"Desk","name":"desk-1","parent":"room-1","presence":true,"observedAt":"2024-11-19T08:00:00Z","tenant":"default"},"tenant":"default"}`), slog.Default())
+	handler(ctx, thingMessage("application/vnd.diwise.room+json", `{"id":"room-1","type":"Room","thing":{"id":"room-1","type":"Room","name":"Rum 1","tenant":"default"},"tenant":"default"}`), slog.Default())
+
+	room := merged["urn:ngsi-ld:IndoorEnvironmentObserved:Room:room-1"]
+
+	is.Equal(len(room), 1)
+	is.True(strings.Contains(room[0], `"occupiedDesks":{"type":"Property","value":1,"observedAt":"2024-11-19T08:00:00Z"}`))
+}
+
+func TestThatDesksInTheSameRoomAreCountedWhenHandledConcurrently(t *testing.T) {
+	is := is.New(t)
+
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d := desk{thing: thing{ID: fmt.Sprintf("desk-%d", i), Parent: "room-1", Tenant: "default"}, Presence: i%2 == 0}
+			_, err := occupancyEntities(ctx, d, time.Now())
+			is.NoErr(err)
+		}()
+	}
+	wg.Wait()
+
+	o := occupancy{}
+	_, err := state.GetFromContext(ctx).Get(ctx, state.NewKey("default", "room-1", occupancyName), &o)
+	is.NoErr(err)
+	is.Equal(len(o.Desks), 20)
+	is.Equal(o.occupied(), 10)
+}
+
+func TestThatDeletedDesksAreNotCounted(t *testing.T) {
+	is := is.New(t)
+
+	cb, merged := newMergeRecorder()
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+	cbClientFn := func(s string) client.ContextBrokerClient { return cb }
+
+	desk := func(id string) messaging.IncomingTopicMessage {
+		return thingMessage("application/vnd.diwise.desk+json", fmt.Sprintf(`{"id":"%[1]s","type":"Desk","thing":{"id":"%[1]s","type":"Desk","name":"%[1]s","parent":"room-1","presence":true,"observedAt":"2024-11-19T08:00:00Z","tenant":"default"},"tenant":"default","timestamp":"2024-11-19T09:00:00Z"}`, id))
+	}
+
+	handler := NewThingTopicMessageHandler(&messaging.MsgContextMock{}, cbClientFn, DefaultConfig())
+	handler(ctx, thingMessage("application/vnd.diwise.room+json", `{"id":"room-1","type":"Room","thing":{"id":"room-1","type":"Room","name":"Rum 1","tenant":"default"},"tenant":"default"}`), slog.Default())
+	handler(ctx, desk("desk-1"), slog.Default())
+	handler(ctx, desk("desk-2"), slog.Default())
+
+	NewThingDeletedTopicMessageHandler(&messaging.MsgContextMock{}, cbClientFn, DefaultConfig())(ctx, desk("desk-1"), slog.Default())
+
+	room := merged["urn:ngsi-ld:IndoorEnvironmentObserved:Room:room-1"]
+
+	is.Equal(len(room), 4) // the room itself, the two desks and the deleted desk
+	is.True(strings.Contains(room[3], `"numberOfDesks":{"type":"Property","value":1,"observedAt":"2024-11-19T09:00:00Z"}`))
+	is.True(strings.Contains(room[3], `"occupiedDesks":{"type":"Property","value":1,`))
+
+	found, err := state.GetFromContext(ctx).Get(ctx, state.NewKey("default", "desk-1", deskName), &deskState{})
+	is.NoErr(err)
+	is.True(!found)
+}
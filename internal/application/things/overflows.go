@@ -0,0 +1,115 @@
+package things
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities"
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities/decorators"
+	"github.com/diwise/context-broker/pkg/ngsild/types/relationships"
+	helpers "github.com/diwise/iot-transform-fiware/internal/application/decorators"
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
+
+	. "github.com/diwise/context-broker/pkg/ngsild/types/properties"
+)
+
+const (
+	SewerOverflowTypeName string = "SewerOverflow"
+	SewerOverflowIDPrefix string = "urn:ngsi-ld:" + SewerOverflowTypeName + ":"
+
+	// overflowsName keys the daily overflow count of a sewer, overflowEntitiesName the overflows written for it
+	overflowsName        string = "overflows"
+	overflowEntitiesName string = "overflowEntities"
+)
+
+// overflowEntity returns a completed overflow of a sewer as an entity of its own, with the time it started,
+// the time it ended and how long it lasted
+func overflowEntity(s sewer) entity {
+	start := s.OverflowAt.UTC()
+	end := s.OverflowEndAt.UTC()
+
+	duration := end.Sub(start)
+	if s.Duration != nil {
+		duration = *s.Duration
+	}
+
+	props := []entities.EntityDecoratorFunc{
+		s.Location.point(),
+		decorators.DateObserved(helpers.FormatTime(end)),
+		decorators.DateTime("dateObservedFrom", helpers.FormatTime(start)),
+		decorators.DateTime("dateObservedTo", helpers.FormatTime(end)),
+		decorators.Number("duration", duration.Seconds(), UnitCode("SEC"), ObservedAt(helpers.FormatTime(end))),
+		entities.R("refSewer", relationships.NewSingleObjectRelationship(s.EntityID())),
+	}
+
+	props = append(props, deviceRefs(s.thing)...)
+
+	id := fmt.Sprintf("%s%s:%s", SewerOverflowIDPrefix, s.Key(), start.Format("20060102T150405Z"))
+
+	return entity{
+		ID:         id,
+		TypeName:   SewerOverflowTypeName,
+		Properties: props,
+		written: func(ctx context.Context) error {
+			return recordOverflow(ctx, s.thing, id)
+		},
+	}
+}
+
+// recordOverflow keeps the id of an overflow entity that has been written for the sewer s, so that it can be
+// removed with the sewer. The ids are kept per thing, rather than per entity id, as they do not change with
+// the key of the sewer.
+func recordOverflow(ctx context.Context, s thing, overflowID string) error {
+	store := state.GetFromContext(ctx)
+	key := state.NewKey(s.Tenant, s.ID, overflowEntitiesName)
+
+	unlock := state.Lock(key)
+	defer unlock()
+
+	overflowIDs := []string{}
+	_, err := store.Get(ctx, key, &overflowIDs)
+	if err != nil {
+		return fmt.Errorf("failed to load the overflows of sewer %s: %w", s.ID, err)
+	}
+
+	if slices.Contains(overflowIDs, overflowID) {
+		return nil
+	}
+
+	err = store.Set(ctx, key, append(overflowIDs, overflowID), 0)
+	if err != nil {
+		return fmt.Errorf("failed to store the overflows of sewer %s: %w", s.ID, err)
+	}
+
+	return nil
+}
+
+// sewerIDs returns the id of the entity that represents the sewer s, followed by the ids of the overflows that
+// have been written for it
+func sewerIDs(ctx context.Context, _ Config, s sewer) ([]string, error) {
+	overflowIDs := []string{}
+	_, err := state.GetFromContext(ctx).Get(ctx, state.NewKey(s.Tenant, s.ID, overflowEntitiesName), &overflowIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the overflows of sewer %s: %w", s.ID, err)
+	}
+
+	return append([]string{s.EntityID()}, overflowIDs...), nil
+}
+
+// forgetSewer clears the overflows and the daily overflow count kept for the sewer s
+func forgetSewer(ctx context.Context, _ Config, s sewer, _ time.Time) ([]entity, error) {
+	store := state.GetFromContext(ctx)
+
+	err := errors.Join(
+		store.Delete(ctx, state.NewKey(s.Tenant, s.ID, overflowEntitiesName)),
+		store.Delete(ctx, state.NewKey(s.Tenant, s.EntityID(), overflowsName)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to forget the overflows of sewer %s: %w", s.ID, err)
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,109 @@
+package things
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/diwise/context-broker/pkg/ngsild"
+	"github.com/diwise/context-broker/pkg/ngsild/client"
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/matryer/is"
+)
+
+func TestThatACompletedOverflowIsPublishedAsAnEntity(t *testing.T) {
+	is := is.New(t)
+
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+
+	cb, created := newCreateRecorder()
+
+	handler := NewSewerTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient {
+		return cb
+	})
+
+	handler(ctx, &messaging.IncomingTopicMessageMock{
+		BodyFunc:        func() []byte { return []byte(sewerOverflowStoppedJson) },
+		ContentTypeFunc: func() string { return "application/vnd.diwise.sewer+json" },
+		TopicNameFunc:   func() string { return "thing.updated" },
+	}, slog.Default())
+
+	is.Equal(len(created), 2) // the sewer and the overflow, but not the device that does not exist
+
+	sewer, ok := created["urn:ngsi-ld:CombinedSewerOverflow:25ba0559-3d49-4853-a537-3bbf7d2ae777"]
+	is.True(ok)
+	is.True(strings.Contains(sewer, `"overflowCount":{"type":"Property","value":1,"observedAt":"2024-11-27T06:40:00Z"}`))
+	is.True(strings.Contains(sewer, `"overflowCumulativeTime":{"type":"Property","value":3600,"observedAt":"2024-11-27T06:40:00Z","unitCode":"SEC"}`))
+
+	overflow, ok := created["urn:ngsi-ld:SewerOverflow:25ba0559-3d49-4853-a537-3bbf7d2ae777:20241127T061000Z"]
+	is.True(ok)
+	is.True(strings.Contains(overflow, `"duration":{"type":"Property","value":1800,"observedAt":"2024-11-27T06:40:00Z","unitCode":"SEC"}`))
+	is.True(strings.Contains(overflow, `"refSewer":{"type":"Relationship","object":"urn:ngsi-ld:CombinedSewerOverflow:25ba0559-3d49-4853-a537-3bbf7d2ae777"}`))
+}
+
+func TestThatTheOverflowsOfADeletedSewerAreDeleted(t *testing.T) {
+	is := is.New(t)
+
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+
+	cb, _ := newCreateRecorder()
+	deleted := []string{}
+	cb.DeleteEntityFunc = func(ctx context.Context, entityID string) (*ngsild.DeleteEntityResult, error) {
+		deleted = append(deleted, entityID)
+		return ngsild.NewDeleteEntityResult(), nil
+	}
+
+	cbClientFn := func(s string) client.ContextBrokerClient { return cb }
+	cfg := DefaultConfig()
+	cfg.Deletion = DeleteEntities
+
+	NewThingTopicMessageHandler(&messaging.MsgContextMock{}, cbClientFn, cfg)(ctx, thingMessage("application/vnd.diwise.sewer+json", sewerOverflowStoppedJson), slog.Default())
+	NewThingDeletedTopicMessageHandler(&messaging.MsgContextMock{}, cbClientFn, cfg)(ctx, deletedMessage("application/vnd.diwise.sewer+json", sewerOverflowStoppedJson), slog.Default())
+
+	is.Equal(deleted, []string{
+		"urn:ngsi-ld:SewerOverflow:25ba0559-3d49-4853-a537-3bbf7d2ae777:20241127T061000Z",
+		"urn:ngsi-ld:CombinedSewerOverflow:25ba0559-3d49-4853-a537-3bbf7d2ae777",
+	})
+
+	for _, key := range []state.Key{
+		state.NewKey("default", "25ba0559-3d49-4853-a537-3bbf7d2ae777", overflowEntitiesName),
+		state.NewKey("default", "urn:ngsi-ld:CombinedSewerOverflow:25ba0559-3d49-4853-a537-3bbf7d2ae777", overflowsName),
+	} {
+		found, err := state.GetFromContext(ctx).Get(ctx, key, &json.RawMessage{})
+		is.NoErr(err)
+		is.True(!found)
+	}
+}
+
+const sewerOverflowStoppedJson = `{
+	"id": "25ba0559-3d49-4853-a537-3bbf7d2ae777",
+	"type": "Sewer",
+	"thing": {
+		"id": "25ba0559-3d49-4853-a537-3bbf7d2ae777",
+		"type": "Sewer",
+		"subType": "CombinedSewerOverflow",
+		"name": "05",
+		"location": {
+			"latitude": 62.395275,
+			"longitude": 17.462769
+		},
+		"refDevices": [
+			{
+				"deviceID": "eef259d2-0cf9-5fa3-82e6-e8f95159e931"
+			}
+		],
+		"observedAt": "2024-11-27T06:40:00Z",
+		"tenant": "default",
+		"overflowObserved": false,
+		"overflowObservedAt": "2024-11-27T06:10:00Z",
+		"overflowEndedAt": "2024-11-27T06:40:00Z",
+		"overflowDuration": 1800000000000,
+		"overflowCumulativeTime": 3600000000000,
+		"lastAction": "overflow stopped"
+	},
+	"tenant": "default",
+	"timestamp": "2024-11-27T06:40:01Z"
+}`
@@ -0,0 +1,408 @@
+package things
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/diwise/context-broker/pkg/datamodels/fiware"
+	"github.com/diwise/context-broker/pkg/ngsild/client"
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities"
+	"github.com/diwise/context-broker/pkg/ngsild/types/relationships"
+	"github.com/diwise/iot-transform-fiware/internal/application/alerts"
+	"github.com/diwise/iot-transform-fiware/internal/application/cip"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// entity is one entity that a thing is published as
+type entity struct {
+	ID         string
+	TypeName   string
+	Properties []entities.EntityDecoratorFunc
+	// CreateOnly entities are created if they do not exist, but never updated
+	CreateOnly bool
+	// MergeOnly entities are updated if they exist, but never created
+	MergeOnly bool
+	// Unchanged entities are as they were when they were last written, and are not written again
+	Unchanged bool
+	// written, if any, is called once the entity has been written, to store state that is only to be kept if it was
+	written func(ctx context.Context) error
+	// failed, if any, is called if the entity could not be written, to undo state that was stored when it was mapped
+	failed func(ctx context.Context) error
+}
+
+// payload is implemented by every kind of thing through the thing it embeds
+type payload interface {
+	base() thing
+	DeviceIDs() []string
+}
+
+func (t thing) base() thing {
+	return t
+}
+
+// thingKind is a kind of thing that can be handled, see kind
+type thingKind interface {
+	ContentType() string
+	handle(ctx context.Context, itm messaging.IncomingTopicMessage, h handling, log *slog.Logger)
+	remove(ctx context.Context, itm messaging.IncomingTopicMessage, h handling, log *slog.Logger)
+	// supports returns whether the kind accepts version of its payload
+	supports(version int) bool
+}
+
+// Config is how things are handled
+type Config struct {
+	// IDs decides what identifies a thing in the ids of its entities
+	IDs IDStrategy
+	// Deletion decides what happens to the entities of deleted things
+	Deletion DeletionMode
+	// Containers are the fill levels that the status of waste containers is derived from
+	Containers ContainerThresholds
+	// MissingLifebuoyAlert is how long a lifebuoy may be missing before an alert is issued
+	MissingLifebuoyAlert time.Duration
+	// Decoding decides what happens to things whose payloads do not keep to their contracts
+	Decoding DecodingMode
+	// PointsOfInterest decides how points of interest are published, per sub type
+	PointsOfInterest PointOfInterestTypes
+	// Location is the time zone that the day that passages are counted for starts at midnight in
+	Location *time.Location
+}
+
+// DefaultTimeZone is the time zone that days start in unless configured otherwise
+const DefaultTimeZone string = "Europe/Stockholm"
+
+// DefaultConfig returns the configuration that things are handled with unless configured otherwise
+func DefaultConfig() Config {
+	loc, err := time.LoadLocation(DefaultTimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	return Config{
+		IDs:                  ThingIDs,
+		Deletion:             DeactivateEntities,
+		Containers:           DefaultContainerThresholds(),
+		MissingLifebuoyAlert: DefaultMissingLifebuoyAlert,
+		Decoding:             LenientDecoding,
+		PointsOfInterest:     DefaultPointOfInterestTypes(),
+		Location:             loc,
+	}
+}
+
+// startOfDay returns the midnight before ts in the configured time zone, or in UTC if there is none
+func (cfg Config) startOfDay(ts time.Time) time.Time {
+	loc := cfg.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+
+	ts = ts.In(loc)
+	return time.Date(ts.Year(), ts.Month(), ts.Day(), 0, 0, 0, 0, loc)
+}
+
+// handling is what every kind of thing is handled with
+type handling struct {
+	cbClientFn func(string) client.ContextBrokerClient
+	cfg        Config
+	// collisions counts the things whose entity ids were already used by other things
+	collisions metric.Int64Counter
+	// invalid counts the things whose payloads violated their contracts
+	invalid metric.Int64Counter
+}
+
+func newHandling(cbClientFn func(string) client.ContextBrokerClient, cfg Config) handling {
+	log := logging.GetFromContext(context.Background())
+	meter := otel.Meter("iot-transform-fiware/things")
+
+	collisions, err := meter.Int64Counter(
+		"diwise.transform.things.collisions",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of things whose entity ids were already used by other things"),
+	)
+
+	if err != nil {
+		log.Error("failed to create otel thing collisions counter", "err", err.Error())
+	}
+
+	invalid, err := meter.Int64Counter(
+		"diwise.transform.things.invalid",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of things whose payloads violated their contracts"),
+	)
+
+	if err != nil {
+		log.Error("failed to create otel invalid things counter", "err", err.Error())
+	}
+
+	return handling{cbClientFn: cbClientFn, cfg: cfg, collisions: collisions, invalid: invalid}
+}
+
+// count counts a payload of kind and version that violated its contract
+func (h handling) count(kind string, version int) {
+	if h.invalid != nil {
+		h.invalid.Add(context.Background(), 1, metric.WithAttributes(attribute.String("kind", kind), attribute.Int("version", version)))
+	}
+}
+
+// kind declares a kind of thing, the content type that it is sent with and how it maps to the entities it is
+// published as. The first entity is the one that represents the thing itself. The plumbing, i.e. unmarshalling,
+// logging, writing the entities and referencing the thing from its devices, is the same for every kind.
+type kind[T payload, P keyed[T]] struct {
+	name        string
+	contentType string
+	entities    func(ctx context.Context, cfg Config, t T) ([]entity, error)
+	// ids returns the ids of every entity that the thing may have been published as, the one that represents
+	// the thing first, so that they can be removed when the thing is deleted. Entities whose ids are not derived
+	// from the thing alone, such as the overflows of a sewer, are kept track of in the state store.
+	ids func(ctx context.Context, cfg Config, t T) ([]string, error)
+	// forget, if set, clears what is kept about the thing when it is deleted, and returns the entities of other
+	// things that are to be updated now that it is gone
+	forget func(ctx context.Context, cfg Config, t T, deletedAt time.Time) ([]entity, error)
+	// upgrades rewrite the versions of the payload, that there are schemas for, that differ from T, see decode
+	upgrades map[int]upgrade
+}
+
+func (k kind[T, P]) ContentType() string {
+	return k.contentType
+}
+
+func (k kind[T, P]) handle(ctx context.Context, itm messaging.IncomingTopicMessage, h handling, l *slog.Logger) {
+	log := l.With("content_type", itm.ContentType())
+	log.Debug(k.name + " received")
+
+	m, err := k.decode(itm.ContentType(), itm.Body(), h, log)
+	if err != nil {
+		log.Error("failed to decode message body", "err", err.Error())
+		return
+	}
+
+	tenant := m.Thing.base().Tenant
+	log = log.With(slog.String("tenant", tenant))
+
+	// the alert rules apply to the entities of a thing according to its kind
+	ctx = alerts.NewContextWithKind(ctx, k.name)
+
+	previous, err := k.identify(ctx, &m.Thing, h, log)
+	if err != nil {
+		log.Error("failed to identify "+k.name, "err", err.Error())
+		return
+	}
+
+	ents, err := k.entities(logging.NewContextWithLogger(ctx, log), h.cfg, m.Thing)
+	if err != nil {
+		log.Error("failed to map "+k.name+" to entities", "err", err.Error())
+		return
+	}
+
+	cbClient := h.cbClientFn(tenant)
+
+	for _, e := range ents {
+		err = write(ctx, cbClient, log, e)
+		if err != nil {
+			return
+		}
+	}
+
+	// the thing has been published even if its devices could not be updated, so these failures are only logged
+	refs, err := backReferences(ctx, tenant, m.Thing.DeviceIDs(), ents)
+	if err != nil {
+		log.Error("failed to reference "+k.name+" from its devices", "err", err.Error())
+	}
+
+	for _, e := range refs {
+		_ = write(ctx, cbClient, log, e)
+	}
+
+	if len(ents) > 0 {
+		err = remember(ctx, m.Thing.base(), ents[0])
+		if err != nil {
+			log.Error("failed to remember the entity of "+k.name, "err", err.Error())
+		}
+	}
+
+	if previous != "" {
+		old := m.Thing
+		P(&old).setKey(previous)
+
+		previousIDs, err := k.ids(ctx, h.cfg, old)
+		if err != nil {
+			log.Error("failed to list the previous entities of "+k.name, "err", err.Error())
+			return
+		}
+
+		currentIDs, err := k.ids(ctx, h.cfg, m.Thing)
+		if err != nil {
+			log.Error("failed to list the entities of "+k.name, "err", err.Error())
+			return
+		}
+
+		if link(ctx, cbClient, log, previousIDs, currentIDs) != nil {
+			return
+		}
+	}
+
+	err = storeKey(ctx, m.Thing.base())
+	if err != nil {
+		log.Error("failed to store the key of "+k.name, "err", err.Error())
+		return
+	}
+
+	log.Debug(k.name + " handled successfully")
+}
+
+// write merges or creates e, creates it if it is CreateOnly or merges it if it is MergeOnly, and logs any failure.
+// Unchanged entities are not written.
+func write(ctx context.Context, cbClient client.ContextBrokerClient, log *slog.Logger, e entity) error {
+	log = log.With(slog.String("entity_id", e.ID), slog.String("type_name", e.TypeName))
+	ctx = logging.NewContextWithLogger(ctx, log)
+
+	if e.Unchanged {
+		log.Debug("entity is unchanged, not written")
+		return nil
+	}
+
+	var err error
+
+	if e.CreateOnly {
+		err = cip.CreateNewEntity(ctx, cbClient, e.ID, e.TypeName, e.Properties)
+		if errors.Is(err, cip.ErrEntityAlreadyExists) {
+			err = nil
+		}
+	} else if e.MergeOnly {
+		err = cip.MergeIfExists(ctx, cbClient, e.ID, e.Properties)
+	} else {
+		err = cip.MergeOrCreate(ctx, cbClient, e.ID, e.TypeName, e.Properties)
+	}
+
+	if err != nil {
+		log.Error("failed to merge or create entity", "err", err.Error())
+
+		if e.failed != nil {
+			if err := e.failed(ctx); err != nil {
+				log.Error("failed to undo the state of entity that was not written", "err", err.Error())
+			}
+		}
+
+		return err
+	}
+
+	// the entity has been written even if its state could not be stored, so this failure is only logged
+	if e.written != nil {
+		if err := e.written(ctx); err != nil {
+			log.Error("failed to store the state of written entity", "err", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// backReferences returns the devices connected to a thing with a reference back to the entity that represents
+// the thing, and to every other asset that the device is connected to, so that the assets that a device is
+// attached to can be found from the device. Devices are only updated, never created from a thing. Every asset
+// is referenced each time, so a device that was written with an asset missing, because it raced with the write
+// of another asset, is corrected when either thing is handled again.
+func backReferences(ctx context.Context, tenant string, deviceIDs []string, ents []entity) ([]entity, error) {
+	if len(ents) == 0 {
+		return nil, nil
+	}
+
+	refs := make([]entity, 0, len(deviceIDs))
+
+	_, err := addDevices(ctx, tenant, ents[0].ID, deviceIDs)
+	if err != nil {
+		return refs, err
+	}
+
+	for _, deviceID := range deviceIDs {
+		if deviceID == ents[0].ID {
+			continue
+		}
+
+		assets, err := addControlledAsset(ctx, tenant, deviceID, ents[0].ID)
+		if err != nil {
+			return refs, err
+		}
+
+		refs = append(refs, entity{
+			ID:       deviceID,
+			TypeName: fiware.DeviceTypeName,
+			Properties: []entities.EntityDecoratorFunc{
+				entities.R("controlledAsset", relationships.NewMultiObjectRelationship(assets)),
+			},
+			MergeOnly: true,
+		})
+	}
+
+	return refs, nil
+}
+
+// handler returns a handler for messages of this kind only, regardless of their content type
+func (k kind[T, P]) handler(cbClientFn func(string) client.ContextBrokerClient) messaging.TopicMessageHandler {
+	h := newHandling(cbClientFn, DefaultConfig())
+
+	return func(ctx context.Context, itm messaging.IncomingTopicMessage, l *slog.Logger) {
+		k.handle(ctx, itm, h, l)
+	}
+}
+
+// kinds holds every kind of thing that is handled, keyed by lower case content type
+var kinds = byContentType(
+	buildings,
+	containers,
+	desks,
+	lifebuoys,
+	passages,
+	pointsOfInterest,
+	pumpingStations,
+	rooms,
+	sewers,
+	waterMeters,
+)
+
+func byContentType(ks ...thingKind) map[string]thingKind {
+	m := make(map[string]thingKind, len(ks))
+	for _, k := range ks {
+		m[strings.ToLower(k.ContentType())] = k
+	}
+	return m
+}
+
+// NewThingTopicMessageHandler returns a handler for updated things that passes every message on to the kind
+// of thing registered for its content type, to be handled according to cfg. Messages with a content type that
+// no kind is registered for are counted and logged.
+func NewThingTopicMessageHandler(messenger messaging.MsgContext, cbClientFn func(string) client.ContextBrokerClient, cfg Config) messaging.TopicMessageHandler {
+
+	log := logging.GetFromContext(context.Background())
+
+	unknownCounter, err := otel.Meter("iot-transform-fiware/things").Int64Counter(
+		"diwise.transform.things.unknown",
+		metric.WithUnit("1"),
+		metric.WithDescription("Total number of updated things with an unknown content type"),
+	)
+
+	if err != nil {
+		log.Error("failed to create otel unknown things counter", "err", err.Error())
+	}
+
+	h := newHandling(cbClientFn, cfg)
+
+	return func(ctx context.Context, itm messaging.IncomingTopicMessage, l *slog.Logger) {
+		k, ok := kindOf(itm.ContentType())
+		if !ok {
+			if unknownCounter != nil {
+				unknownCounter.Add(ctx, 1, metric.WithAttributes(attribute.String("content_type", itm.ContentType())))
+			}
+			l.Warn("no handler registered for content type", slog.String("content_type", itm.ContentType()))
+			return
+		}
+
+		k.handle(ctx, itm, h, l)
+	}
+}
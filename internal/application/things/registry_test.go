@@ -0,0 +1,160 @@
+package things
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/diwise/context-broker/pkg/ngsild"
+	"github.com/diwise/context-broker/pkg/ngsild/client"
+	"github.com/diwise/context-broker/pkg/ngsild/types"
+	testClient "github.com/diwise/context-broker/pkg/test"
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
+	"github.com/diwise/messaging-golang/pkg/messaging"
+	"github.com/matryer/is"
+)
+
+func TestThatThingsAreDispatchedByContentType(t *testing.T) {
+	is := is.New(t)
+
+	entityIDs := []string{}
+	cb := &testClient.ContextBrokerClientMock{
+		MergeEntityFunc: func(ctx context.Context, entityID string, fragment types.EntityFragment, headers map[string][]string) (*ngsild.MergeEntityResult, error) {
+			entityIDs = append(entityIDs, entityID)
+			return &ngsild.MergeEntityResult{}, nil
+		},
+	}
+
+	handler := NewThingTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient {
+		return cb
+	}, DefaultConfig())
+
+	messages := []struct {
+		contentType string
+		body        string
+	}{
+		{"application/vnd.diwise.container+json", wastecontainerJson},
+		{"application/vnd.diwise.Building+json", buildingJson},
+	}
+
+	for _, m := range messages {
+		handler(context.Background(), &messaging.IncomingTopicMessageMock{
+			BodyFunc:        func() []byte { return []byte(m.body) },
+			ContentTypeFunc: func() string { return m.contentType },
+			TopicNameFunc:   func() string { return "thing.updated" },
+		}, slog.Default())
+	}
+
+	is.Equal(len(entityIDs), 6) // each thing, its device and its name based predecessor
+	is.Equal(entityIDs[0], "urn:ngsi-ld:WasteContainer:2bf440f4")
+	is.True(strings.HasPrefix(entityIDs[3], BuildingIDPrefix))
+}
+
+func TestThatDevicesReferenceTheThingTheyAreAttachedTo(t *testing.T) {
+	is := is.New(t)
+
+	fragments := map[string]string{}
+	cb := &testClient.ContextBrokerClientMock{
+		MergeEntityFunc: func(ctx context.Context, entityID string, fragment types.EntityFragment, headers map[string][]string) (*ngsild.MergeEntityResult, error) {
+			b, _ := json.Marshal(fragment)
+			fragments[entityID] = string(b)
+			return &ngsild.MergeEntityResult{}, nil
+		},
+	}
+
+	handler := NewContainerTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient {
+		return cb
+	})
+
+	handler(context.Background(), &messaging.IncomingTopicMessageMock{
+		BodyFunc:        func() []byte { return []byte(wastecontainerJson) },
+		ContentTypeFunc: func() string { return "application/vnd.diwise.container+json" },
+		TopicNameFunc:   func() string { return "thing.updated" },
+	}, slog.Default())
+
+	is.True(strings.Contains(fragments["urn:ngsi-ld:WasteContainer:2bf440f4"], `"refDevice":{"type":"Relationship","object":"urn:ngsi-ld:Device:12345"}`))
+	is.True(strings.Contains(fragments["urn:ngsi-ld:Device:12345"], `"controlledAsset":{"type":"Relationship","object":["urn:ngsi-ld:WasteContainer:2bf440f4"]}`))
+}
+
+func TestThatDevicesReferenceEveryThingTheyAreAttachedTo(t *testing.T) {
+	is := is.New(t)
+
+	devices := []string{}
+	cb := &testClient.ContextBrokerClientMock{
+		MergeEntityFunc: func(ctx context.Context, entityID string, fragment types.EntityFragment, headers map[string][]string) (*ngsild.MergeEntityResult, error) {
+			if isDevice(entityID) {
+				b, _ := json.Marshal(fragment)
+				devices = append(devices, string(b))
+			}
+			return &ngsild.MergeEntityResult{}, nil
+		},
+	}
+
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+	handler := NewThingTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient { return cb }, DefaultConfig())
+
+	other := strings.NewReplacer(`"id": "2bf440f4"`, `"id": "2bf440f5"`, `"Soptunnor.XY"`, `"Soptunnor.Z"`).Replace(wastecontainerJson)
+
+	handler(ctx, thingMessage("application/vnd.diwise.container+json", wastecontainerJson), slog.Default())
+	handler(ctx, thingMessage("application/vnd.diwise.container+json", other), slog.Default())
+
+	is.Equal(len(devices), 2)
+	is.True(strings.Contains(devices[1], `"controlledAsset":{"type":"Relationship","object":["urn:ngsi-ld:WasteContainer:2bf440f4","urn:ngsi-ld:WasteContainer:2bf440f5"]}`))
+}
+
+func TestThatDevicesAreNotCreatedByTheirThings(t *testing.T) {
+	is := is.New(t)
+
+	cb, created := newCreateRecorder()
+
+	handler := NewThingTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient { return cb }, DefaultConfig())
+	handler(context.Background(), thingMessage("application/vnd.diwise.container+json", wastecontainerJson), slog.Default())
+
+	_, ok := created["urn:ngsi-ld:Device:12345"]
+	is.True(!ok)
+	is.Equal(len(created), 1)
+}
+
+func TestThatDeviceIDsAreEntityIDs(t *testing.T) {
+	is := is.New(t)
+
+	th := thing{RefDevices: []device{{DeviceID: "abc"}, {DeviceID: ":def"}, {DeviceID: "urn:ngsi-ld:Device:ghi"}, {DeviceID: "a::b"}}}
+
+	is.Equal(th.DeviceIDs(), []string{"urn:ngsi-ld:Device:abc", "urn:ngsi-ld:Device:def", "urn:ngsi-ld:Device:ghi", "urn:ngsi-ld:Device:a:b"})
+}
+
+func TestThatUnknownContentTypesAreLogged(t *testing.T) {
+	is := is.New(t)
+
+	cb := &testClient.ContextBrokerClientMock{}
+
+	handler := NewThingTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient {
+		return cb
+	}, DefaultConfig())
+
+	buf := &bytes.Buffer{}
+	log := slog.New(slog.NewTextHandler(buf, nil))
+
+	handler(context.Background(), &messaging.IncomingTopicMessageMock{
+		BodyFunc:        func() []byte { return []byte(wastecontainerJson) },
+		ContentTypeFunc: func() string { return "application/vnd.diwise.unknown+json" },
+		TopicNameFunc:   func() string { return "thing.updated" },
+	}, log)
+
+	is.Equal(len(cb.MergeEntityCalls()), 0)
+	is.Equal(len(cb.CreateEntityCalls()), 0)
+	is.True(strings.Contains(buf.String(), "content_type=application/vnd.diwise.unknown+json"))
+}
+
+func TestThatEveryKindHasAUniqueContentType(t *testing.T) {
+	is := is.New(t)
+
+	is.Equal(len(kinds), 10)
+
+	for ct, k := range kinds {
+		is.Equal(ct, strings.ToLower(k.ContentType()))
+	}
+}
@@ -0,0 +1,207 @@
+package things
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
+)
+
+// thingEntity is the entity that represents a thing
+type thingEntity struct {
+	ID       string `json:"id"`
+	TypeName string `json:"typeName"`
+}
+
+const (
+	entityName           string = "entity"
+	parentName           string = "parent"
+	controlledAssetsName string = "controlledAssets"
+	devicesName          string = "devices"
+)
+
+// maxAncestors limits how far up the parents of a thing are followed, should they form a cycle
+const maxAncestors int = 8
+
+// remember keeps the entity that represents t and the thing that t is part of, if any, so that things that
+// are handled later can find the entities of the things they are part of
+func remember(ctx context.Context, t thing, e entity) error {
+	store := state.GetFromContext(ctx)
+
+	err := store.Set(ctx, state.NewKey(t.Tenant, t.ID, entityName), thingEntity{ID: e.ID, TypeName: e.TypeName}, 0)
+	if err != nil {
+		return fmt.Errorf("failed to store the entity of thing %s: %w", t.ID, err)
+	}
+
+	if t.Parent != "" {
+		return rememberParent(ctx, t.Tenant, t.ID, t.Parent)
+	}
+
+	return nil
+}
+
+// rememberParent keeps that the thing with id thingID is part of the thing with id parentID
+func rememberParent(ctx context.Context, tenant, thingID, parentID string) error {
+	err := state.GetFromContext(ctx).Set(ctx, state.NewKey(tenant, thingID, parentName), parentID, 0)
+	if err != nil {
+		return fmt.Errorf("failed to store the parent of thing %s: %w", thingID, err)
+	}
+
+	return nil
+}
+
+// entityOf returns the entity that represents the thing with id thingID, if the thing has been handled
+func entityOf(ctx context.Context, tenant, thingID string) (thingEntity, bool, error) {
+	e := thingEntity{}
+
+	found, err := state.GetFromContext(ctx).Get(ctx, state.NewKey(tenant, thingID, entityName), &e)
+	if err != nil {
+		return thingEntity{}, false, fmt.Errorf("failed to load the entity of thing %s: %w", thingID, err)
+	}
+
+	return e, found, nil
+}
+
+// ancestorsOf returns the ids of the things that t is part of, its parent first, then the parent of its parent
+// and so on. The parent of t is taken from t itself, the parents of its ancestors from when they were handled.
+func ancestorsOf(ctx context.Context, t thing) ([]string, error) {
+	store := state.GetFromContext(ctx)
+	ancestors := []string{}
+
+	for parent := t.Parent; parent != "" && len(ancestors) < maxAncestors; {
+		if parent == t.ID || slices.Contains(ancestors, parent) {
+			break
+		}
+
+		ancestors = append(ancestors, parent)
+
+		next := ""
+		_, err := store.Get(ctx, state.NewKey(t.Tenant, parent, parentName), &next)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the parent of thing %s: %w", parent, err)
+		}
+
+		parent = next
+	}
+
+	return ancestors, nil
+}
+
+// addControlledAsset adds assetID to the assets that the device deviceID is connected to and returns them all,
+// so that a device that is connected to several things references each of them
+func addControlledAsset(ctx context.Context, tenant, deviceID, assetID string) ([]string, error) {
+	key := state.NewKey(tenant, deviceID, controlledAssetsName)
+
+	unlock := state.Lock(key)
+	defer unlock()
+
+	store := state.GetFromContext(ctx)
+
+	assets := []string{}
+	_, err := store.Get(ctx, key, &assets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the assets of device %s: %w", deviceID, err)
+	}
+
+	if slices.Contains(assets, assetID) {
+		return assets, nil
+	}
+
+	assets = append(assets, assetID)
+	slices.Sort(assets)
+
+	err = store.Set(ctx, key, assets, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store the assets of device %s: %w", deviceID, err)
+	}
+
+	return assets, nil
+}
+
+// removeControlledAsset removes assetID from the assets that the device deviceID is connected to and returns
+// the assets that remain
+func removeControlledAsset(ctx context.Context, tenant, deviceID, assetID string) ([]string, error) {
+	key := state.NewKey(tenant, deviceID, controlledAssetsName)
+
+	unlock := state.Lock(key)
+	defer unlock()
+
+	store := state.GetFromContext(ctx)
+
+	assets := []string{}
+	_, err := store.Get(ctx, key, &assets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the assets of device %s: %w", deviceID, err)
+	}
+
+	assets = slices.DeleteFunc(assets, func(id string) bool { return id == assetID })
+
+	if len(assets) == 0 {
+		err = store.Delete(ctx, key)
+	} else {
+		err = store.Set(ctx, key, assets, 0)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to store the assets of device %s: %w", deviceID, err)
+	}
+
+	return assets, nil
+}
+
+// addDevices adds deviceIDs to the devices that reference the asset assetID and returns them all, so that the
+// references can be removed when the asset is, even if the thing that it represents is deleted without its devices
+func addDevices(ctx context.Context, tenant, assetID string, deviceIDs []string) ([]string, error) {
+	key := state.NewKey(tenant, assetID, devicesName)
+
+	unlock := state.Lock(key)
+	defer unlock()
+
+	store := state.GetFromContext(ctx)
+
+	devices := []string{}
+	_, err := store.Get(ctx, key, &devices)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the devices of asset %s: %w", assetID, err)
+	}
+
+	devices = append(devices, deviceIDs...)
+	slices.Sort(devices)
+	devices = slices.Compact(devices)
+
+	err = store.Set(ctx, key, devices, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store the devices of asset %s: %w", assetID, err)
+	}
+
+	return devices, nil
+}
+
+// forgetDevices removes the devices that reference the asset assetID
+func forgetDevices(ctx context.Context, tenant, assetID string) error {
+	err := state.GetFromContext(ctx).Delete(ctx, state.NewKey(tenant, assetID, devicesName))
+	if err != nil {
+		return fmt.Errorf("failed to forget the devices of asset %s: %w", assetID, err)
+	}
+
+	return nil
+}
+
+// forgetRelations removes the entity and parent kept for the thing t, and its occupancy if it is a room or a
+// building, so that a thing that is handled later does not find them
+func forgetRelations(ctx context.Context, t thing) error {
+	store := state.GetFromContext(ctx)
+
+	err := errors.Join(
+		store.Delete(ctx, state.NewKey(t.Tenant, t.ID, entityName)),
+		store.Delete(ctx, state.NewKey(t.Tenant, t.ID, parentName)),
+		store.Delete(ctx, state.NewKey(t.Tenant, t.ID, occupancyName)),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to forget the relations of thing %s: %w", t.ID, err)
+	}
+
+	return nil
+}
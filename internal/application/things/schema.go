@@ -0,0 +1,105 @@
+package things
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// schemaFiles are the JSON Schemas of every version of the payload of every kind of thing, named
+// <name>.v<version>.json after the content type of the kind, and the definitions that they share
+//
+//go:embed schemas/*.json
+var schemaFiles embed.FS
+
+// schemaBaseURL is where the schemas in schemaFiles are found by each other, so that they can refer to one
+// another by file name
+const schemaBaseURL = "https://diwise.io/schemas/things/"
+
+// schemas holds every compiled schema in schemaFiles, keyed by file name
+type schemas map[string]*jsonschema.Schema
+
+// loadSchemas compiles every schema in fsys. Formats, such as date-time, are asserted rather than only
+// annotated, so that a payload with a malformed time violates its contract.
+func loadSchemas(fsys fs.FS) (schemas, error) {
+	files, err := fs.Glob(fsys, "schemas/*.json")
+	if err != nil {
+		return nil, err
+	}
+
+	c := jsonschema.NewCompiler()
+	c.DefaultDraft(jsonschema.Draft2020)
+	c.AssertFormat()
+
+	for _, f := range files {
+		b, err := fs.ReadFile(fsys, f)
+		if err != nil {
+			return nil, err
+		}
+
+		doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("invalid schema %s: %w", f, err)
+		}
+
+		if err := c.AddResource(schemaBaseURL+path.Base(f), doc); err != nil {
+			return nil, fmt.Errorf("invalid schema %s: %w", f, err)
+		}
+	}
+
+	all := make(schemas, len(files))
+
+	for _, f := range files {
+		s, err := c.Compile(schemaBaseURL + path.Base(f))
+		if err != nil {
+			return nil, fmt.Errorf("invalid schema %s: %w", f, err)
+		}
+
+		all[path.Base(f)] = s
+	}
+
+	return all, nil
+}
+
+// validate returns every violation of the schema in file by v, a value decoded from JSON into an any, one per
+// line with the location of the violating value first and in order of location
+func (all schemas) validate(file string, v any) error {
+	s, ok := all[file]
+	if !ok {
+		return fmt.Errorf("no schema %s", file)
+	}
+
+	err := s.Validate(v)
+
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return err
+	}
+
+	errs := violations(ve)
+	slices.SortFunc(errs, func(a, b error) int { return strings.Compare(a.Error(), b.Error()) })
+
+	return errors.Join(errs...)
+}
+
+// violations returns the causes of the validation error ve that have no causes of their own, i.e. the values
+// that violate the schema rather than the schemas that they were validated against
+func violations(ve *jsonschema.ValidationError) []error {
+	if len(ve.Causes) == 0 {
+		return []error{ve}
+	}
+
+	errs := []error{}
+	for _, cause := range ve.Causes {
+		errs = append(errs, violations(cause)...)
+	}
+
+	return errs
+}
@@ -3,17 +3,20 @@ package things
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/diwise/context-broker/pkg/ngsild/client"
 	"github.com/diwise/context-broker/pkg/ngsild/types/entities"
 	"github.com/diwise/context-broker/pkg/ngsild/types/entities/decorators"
-	"github.com/diwise/iot-transform-fiware/internal/application/cip"
+	"github.com/diwise/context-broker/pkg/ngsild/types/relationships"
 	helpers "github.com/diwise/iot-transform-fiware/internal/application/decorators"
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
+	"github.com/diwise/iot-transform-fiware/internal/application/watermeter"
 	"github.com/diwise/messaging-golang/pkg/messaging"
 	"github.com/diwise/service-chassis/pkg/infrastructure/o11y/logging"
 
@@ -29,490 +32,994 @@ type msg[T any] struct {
 	Timestamp time.Time `json:"timestamp"`
 }
 
+const (
+	BuildingTypeName string = "Building"
+	BuildingIDPrefix string = "urn:ngsi-ld:" + BuildingTypeName + ":"
+)
+
+var buildings = kind[building, *building]{
+	name:        "building",
+	contentType: "application/vnd.diwise.building+json",
+	entities:    buildingEntities,
+	ids: func(_ context.Context, _ Config, b building) ([]string, error) {
+		return []string{BuildingIDPrefix + b.Key()}, nil
+	},
+}
+
 func NewBuildingTopicMessageHandler(messenger messaging.MsgContext, cbClientFn func(string) client.ContextBrokerClient) messaging.TopicMessageHandler {
-	return func(ctx context.Context, itm messaging.IncomingTopicMessage, l *slog.Logger) {
-	}
+	return buildings.handler(cbClientFn)
 }
 
-func NewContainerTopicMessageHandler(messenger messaging.MsgContext, cbClientFn func(string) client.ContextBrokerClient) messaging.TopicMessageHandler {
-	return func(ctx context.Context, itm messaging.IncomingTopicMessage, l *slog.Logger) {
-		log := l.With("content_type", itm.ContentType())
-		log.Debug("container received")
-
-		m := msg[container]{}
-		err := json.Unmarshal(itm.Body(), &m)
-		if err != nil {
-			log.Error("failed to unmarshal message body", "err", err.Error())
-			return
+func buildingEntities(ctx context.Context, cfg Config, b building) ([]entity, error) {
+	props := make([]entities.EntityDecoratorFunc, 0, 10)
+
+	if len(b.Footprint) > 2 {
+		// a footprint is a closed ring of coordinates, in longitude, latitude order
+		ring := make([][]float64, 0, len(b.Footprint)+1)
+		for _, p := range b.Footprint {
+			ring = append(ring, []float64{p.Longitude, p.Latitude})
 		}
+		if ring[0][0] != ring[len(ring)-1][0] || ring[0][1] != ring[len(ring)-1][1] {
+			ring = append(ring, ring[0])
+		}
+		props = append(props, decorators.LocationMP([][][][]float64{{ring}}))
+	} else {
+		props = append(props, b.Location.geoProperty())
+	}
+
+	if b.Name != "" {
+		props = append(props, helpers.Name(b.Name))
+	}
+
+	if b.AlternativeName != "" {
+		props = append(props, helpers.AlternativeName(b.AlternativeName))
+	}
+
+	if b.Description != nil && *b.Description != "" {
+		props = append(props, decorators.Description(*b.Description))
+	}
+
+	if !b.Address.IsZero() {
+		props = append(props, helpers.Structured("address", b.Address))
+	}
 
-		c := m.Thing
+	category := b.Category
+	if len(category) == 0 && b.SubType != nil && *b.SubType != "" {
+		category = []string{strings.ToLower(*b.SubType)}
+	}
+	if len(category) > 0 {
+		props = append(props, decorators.TextList("category", category))
+	}
 
-		props := make([]entities.EntityDecoratorFunc, 0)
+	props = append(props, deviceRefs(b.thing)...)
 
-		props = append(props, helpers.FillingLevel(c.Percent, c.ObservedAt))
-		props = append(props, decorators.Location(c.Location.Latitude, c.Location.Longitude))
-		props = append(props, decorators.DateObserved(c.ObservedAt.UTC().Format(time.RFC3339)))
+	if len(b.Rooms) > 0 {
+		rooms := make([]string, 0, len(b.Rooms))
+		for _, r := range b.Rooms {
+			r.Tenant = b.Tenant
 
-		log = log.With(slog.String("entity_id", c.EntityID()), slog.String("type_name", c.TypeName()), slog.String("tenant", c.Tenant))
-		ctx = logging.NewContextWithLogger(ctx, log)
+			id, err := roomRef(ctx, cfg, r)
+			if err != nil {
+				return nil, err
+			}
+			rooms = append(rooms, id)
 
-		err = cip.MergeOrCreate(ctx, cbClientFn(c.Tenant), c.EntityID(), c.TypeName(), props)
-		if err != nil {
-			log.Error("failed to merge or create entity", slog.String("type_name", c.TypeName()), "err", err.Error())
-			return
+			// the rooms of a building are part of it, so that the desks in them count towards its occupancy
+			err = rememberParent(ctx, b.Tenant, r.ID, b.ID)
+			if err != nil {
+				return nil, err
+			}
 		}
+		props = append(props, entities.R("refRooms", relationships.NewMultiObjectRelationship(rooms)))
+	}
+
+	occupancy, err := occupancyProperties(ctx, b.Tenant, b.ID)
+	if err != nil {
+		return nil, err
+	}
+	props = append(props, occupancy...)
 
-		log.Debug("container handled successfully")
+	if !b.ObservedAt.IsZero() {
+		props = append(props, decorators.DateModified(b.ObservedAt.UTC().Format(time.RFC3339)))
 	}
+
+	return []entity{{ID: BuildingIDPrefix + b.Key(), TypeName: BuildingTypeName, Properties: props}}, nil
 }
 
-func NewLifebuoyTopicMessageHandler(messenger messaging.MsgContext, cbClientFn func(string) client.ContextBrokerClient) messaging.TopicMessageHandler {
-	return func(ctx context.Context, itm messaging.IncomingTopicMessage, l *slog.Logger) {
-		log := l.With("content_type", itm.ContentType())
-		log.Debug("lifebuoy received")
-
-		m := msg[lifebuoy]{}
-		err := json.Unmarshal(itm.Body(), &m)
-		if err != nil {
-			l.Error("failed to unmarshal message body", "err", err.Error())
-			return
-		}
+var containers = kind[container, *container]{
+	name:        "container",
+	contentType: "application/vnd.diwise.container+json",
+	entities:    containerEntities,
+	ids: func(_ context.Context, _ Config, c container) ([]string, error) {
+		return []string{c.EntityID()}, nil
+	},
+	forget: forgetContainer,
+}
 
-		lb := m.Thing
+func NewContainerTopicMessageHandler(messenger messaging.MsgContext, cbClientFn func(string) client.ContextBrokerClient) messaging.TopicMessageHandler {
+	return containers.handler(cbClientFn)
+}
 
-		statusValue := map[bool]string{true: "on", false: "off"}
-		props := make([]entities.EntityDecoratorFunc, 0, 5)
+func containerEntities(ctx context.Context, cfg Config, c container) ([]entity, error) {
+	thresholds := cfg.Containers
 
-		props = append(props, decorators.DateLastValueReported(lb.ObservedAt.UTC().Format(time.RFC3339)))
-		props = append(props, decorators.Status(statusValue[lb.Presence], TxtObservedAt(lb.ObservedAt.UTC().Format(time.RFC3339))))
-		props = append(props, decorators.Location(lb.Location.Latitude, lb.Location.Longitude))
+	ts := c.ObservedAt.UTC()
+	if ts.IsZero() {
+		ts = time.Now().UTC()
+	}
 
-		typeName := "Lifebuoy"
-		entityID := fmt.Sprintf("urn:ngsi-ld:%s:%s", typeName, lb.AlternativeNameOrNameOrID())
+	observedAt := helpers.FormatTime(ts)
+	percent := c.fillPercent()
 
-		log = log.With(slog.String("entity_id", entityID), slog.String("type_name", typeName), slog.String("tenant", lb.Tenant))
-		ctx = logging.NewContextWithLogger(ctx, log)
+	fill, err := nextFillState(ctx, c.Tenant, c.EntityID(), percent, ts, thresholds)
+	if err != nil {
+		return nil, err
+	}
 
-		err = cip.MergeOrCreate(ctx, cbClientFn(lb.Tenant), entityID, typeName, props)
-		if err != nil {
-			log.Error("failed to merge or create entity", slog.String("type_name", typeName), "err", err.Error())
-			return
-		}
+	props := make([]entities.EntityDecoratorFunc, 0)
+
+	props = append(props, helpers.FillingLevel(percent, ts))
+	props = append(props, decorators.Number("currentLevel", c.CurrentLevel, UnitCode("MTR"), ObservedAt(observedAt)))
+	props = append(props, decorators.Status(thresholds.status(percent), TxtObservedAt(observedAt)))
+	props = append(props, c.Location.geoProperty())
+	props = append(props, decorators.DateObserved(observedAt))
 
-		log.Debug("lifebuoy handled successfully")
+	if fill.LastEmptying != nil {
+		props = append(props, decorators.DateTime("dateLastEmptying", helpers.FormatTime(*fill.LastEmptying)))
 	}
+
+	if full, ok := fill.predictedFull(thresholds.Full); ok {
+		props = append(props, decorators.DateTime("nextActuationDeadline", helpers.FormatTime(full)))
+	}
+
+	if c.Parent != "" {
+		props = append(props, entities.R("refWasteContainerIsle", relationships.NewSingleObjectRelationship(wasteContainerIsleID(c.Parent))))
+	}
+
+	props = append(props, deviceRefs(c.thing)...)
+
+	return []entity{{ID: c.EntityID(), TypeName: c.TypeName(), Properties: props}}, nil
+}
+
+const (
+	lifebuoyTypeName string = "Lifebuoy"
+	lifebuoyIDPrefix string = "urn:ngsi-ld:" + lifebuoyTypeName + ":"
+)
+
+var lifebuoys = kind[lifebuoy, *lifebuoy]{
+	name:        "lifebuoy",
+	contentType: "application/vnd.diwise.lifebuoy+json",
+	entities:    lifebuoyEntities,
+	ids: func(_ context.Context, _ Config, lb lifebuoy) ([]string, error) {
+		return []string{lifebuoyIDPrefix + lb.Key()}, nil
+	},
+	forget: forgetLifebuoy,
+}
+
+func NewLifebuoyTopicMessageHandler(messenger messaging.MsgContext, cbClientFn func(string) client.ContextBrokerClient) messaging.TopicMessageHandler {
+	return lifebuoys.handler(cbClientFn)
+}
+
+func lifebuoyEntities(ctx context.Context, cfg Config, lb lifebuoy) ([]entity, error) {
+	statusValue := map[bool]string{true: "on", false: "off"}
+	props := make([]entities.EntityDecoratorFunc, 0, 5)
+
+	props = append(props, decorators.DateLastValueReported(lb.ObservedAt.UTC().Format(time.RFC3339)))
+	props = append(props, decorators.Status(statusValue[lb.Presence], TxtObservedAt(lb.ObservedAt.UTC().Format(time.RFC3339))))
+	props = append(props, lb.Location.geoProperty())
+	props = append(props, deviceRefs(lb.thing)...)
+
+	prev, next, err := nextLifebuoyState(ctx, lb, cfg.MissingLifebuoyAlert)
+	if err != nil {
+		return nil, err
+	}
+
+	props = append(props, next.missingProperties()...)
+
+	ents := []entity{{ID: lifebuoyIDPrefix + lb.Key(), TypeName: lifebuoyTypeName, Properties: props}}
+
+	if alert, ok := missingLifebuoyAlert(lb, prev, next); ok {
+		ents = append(ents, alert)
+	}
+
+	return ents, nil
+}
+
+var desks = kind[desk, *desk]{
+	name:        "desk",
+	contentType: "application/vnd.diwise.desk+json",
+	entities:    deskEntities,
+	ids: func(_ context.Context, _ Config, d desk) ([]string, error) {
+		return []string{fiware.DeviceIDPrefix + d.Key()}, nil
+	},
+	forget: forgetDesk,
 }
 
 func NewDeskTopicMessageHandler(messenger messaging.MsgContext, cbClientFn func(string) client.ContextBrokerClient) messaging.TopicMessageHandler {
-	return func(ctx context.Context, itm messaging.IncomingTopicMessage, l *slog.Logger) {
-		log := l.With("content_type", itm.ContentType())
-		log.Debug("desk received")
-
-		m := msg[desk]{}
-		err := json.Unmarshal(itm.Body(), &m)
-		if err != nil {
-			log.Error("failed to unmarshal message body", "err", err.Error())
-			return
-		}
+	return desks.handler(cbClientFn)
+}
 
-		desk := m.Thing
+func deskEntities(ctx context.Context, cfg Config, desk desk) ([]entity, error) {
+	statusValue := map[bool]string{true: "on", false: "off"}
+	props := make([]entities.EntityDecoratorFunc, 0, 5)
 
-		statusValue := map[bool]string{true: "on", false: "off"}
-		props := make([]entities.EntityDecoratorFunc, 0, 5)
+	props = append(props, decorators.DateLastValueReported(desk.ObservedAt.UTC().Format(time.RFC3339)))
+	props = append(props, decorators.Status(statusValue[desk.Presence], TxtObservedAt(desk.ObservedAt.UTC().Format(time.RFC3339))))
+	props = append(props, desk.Location.geoProperty())
+	props = append(props, deviceRefs(desk.thing)...)
 
-		props = append(props, decorators.DateLastValueReported(desk.ObservedAt.UTC().Format(time.RFC3339)))
-		props = append(props, decorators.Status(statusValue[desk.Presence], TxtObservedAt(desk.ObservedAt.UTC().Format(time.RFC3339))))
-		props = append(props, decorators.Location(desk.Location.Latitude, desk.Location.Longitude))
+	entityID := fmt.Sprintf("%s%s", fiware.DeviceIDPrefix, desk.Key())
 
-		entityID := fmt.Sprintf("%s%s", fiware.DeviceIDPrefix, desk.AlternativeNameOrNameOrID())
+	// the occupancy of the rooms and buildings that the desk is in is published along with the desk
+	occupancy, err := occupancyEntities(ctx, desk, desk.ObservedAt)
+	if err != nil {
+		return nil, err
+	}
 
-		log = log.With(slog.String("entity_id", entityID), slog.String("type_name", fiware.DeviceTypeName), slog.String("tenant", desk.Tenant))
-		ctx = logging.NewContextWithLogger(ctx, log)
+	return append([]entity{{ID: entityID, TypeName: fiware.DeviceTypeName, Properties: props}}, occupancy...), nil
+}
 
-		err = cip.MergeOrCreate(ctx, cbClientFn(desk.Tenant), entityID, fiware.DeviceTypeName, props)
-		if err != nil {
-			log.Error("failed to merge or create entity", slog.String("type_name", fiware.DeviceTypeName), "err", err.Error())
-			return
-		}
+const (
+	CrowdFlowObservedTypeName string = "CrowdFlowObserved"
+	CrowdFlowObservedIDPrefix string = "urn:ngsi-ld:" + CrowdFlowObservedTypeName + ":"
+)
 
-		log.Debug("desk handled successfully")
+// passageVehicleTypes maps the sub types of passages that count vehicles to the vehicle types of
+// TrafficFlowObserved. Passages of any other sub type count people.
+var passageVehicleTypes = map[string]string{
+	"bicycle":    "bicycle",
+	"bike":       "bicycle",
+	"bus":        "bus",
+	"car":        "car",
+	"lorry":      "lorry",
+	"motorcycle": "motorcycle",
+	"truck":      "lorry",
+	"vehicle":    "car",
+}
+
+func (p passage) subType() string {
+	if p.SubType == nil {
+		return ""
 	}
+
+	return strings.ToLower(*p.SubType)
+}
+
+// passageIDs returns the ids of every entity that a passage may be published as
+func passageIDs(_ context.Context, _ Config, p passage) ([]string, error) {
+	if _, ok := passageVehicleTypes[p.subType()]; ok {
+		id := fiware.TrafficFlowObservedIDPrefix + p.Key()
+		return []string{id, id + ":forward", id + ":backward"}, nil
+	}
+
+	return []string{CrowdFlowObservedIDPrefix + p.Key()}, nil
+}
+
+var passages = kind[passage, *passage]{
+	name:        "passage",
+	contentType: "application/vnd.diwise.passage+json",
+	entities:    passageEntities,
+	ids:         passageIDs,
 }
 
+// NewPassageTopicMessageHandler publishes the counts of a passage for the current day, as a TrafficFlowObserved
+// for passages that count vehicles and as a CrowdFlowObserved for passages that count people
 func NewPassageTopicMessageHandler(messenger messaging.MsgContext, cbClientFn func(string) client.ContextBrokerClient) messaging.TopicMessageHandler {
-	return func(ctx context.Context, itm messaging.IncomingTopicMessage, l *slog.Logger) {
+	return passages.handler(cbClientFn)
+}
+
+func passageEntities(ctx context.Context, cfg Config, p passage) ([]entity, error) {
+	observedAt := p.ObservedAt.UTC()
+	if observedAt.IsZero() {
+		observedAt = time.Now().UTC()
+	}
+
+	// counts are reset at local midnight, so the observed interval is from the start of the day until now
+	from := cfg.startOfDay(observedAt).UTC().Format(time.RFC3339)
+	to := observedAt.Format(time.RFC3339)
+
+	common := []entities.EntityDecoratorFunc{
+		p.Location.geoProperty(),
+		decorators.DateObserved(from + "/" + to),
+		decorators.DateTime("dateObservedFrom", from),
+		decorators.DateTime("dateObservedTo", to),
+	}
+
+	if p.Name != "" {
+		common = append(common, helpers.Name(p.Name))
+	}
+
+	if p.Description != nil && *p.Description != "" {
+		common = append(common, decorators.Description(*p.Description))
+	}
+
+	common = append(common, deviceRefs(p.thing)...)
+
+	if p.LastPassageAt != nil {
+		common = append(common, decorators.DateTime("dateLastPassage", p.LastPassageAt.UTC().Format(time.RFC3339)))
+	}
+
+	flows := make([]entity, 0, 3)
+
+	if vehicleType, ok := passageVehicleTypes[p.subType()]; ok {
+		id := fiware.TrafficFlowObservedIDPrefix + p.Key()
+
+		flows = append(flows, entity{ID: id, TypeName: fiware.TrafficFlowObservedTypeName, Properties: append(slices.Clone(common),
+			decorators.Number("intensity", float64(p.PassagesToday), ObservedAt(to)),
+			decorators.Number("cumulatedNumberOfPassages", float64(p.CumulatedNumberOfPassages), ObservedAt(to)),
+			decorators.Text("vehicleType", vehicleType),
+		)})
+
+		// traffic is counted per direction, in the same way as per lane, in entities of their own
+		directions := []struct {
+			name  string
+			count *int
+		}{{"forward", p.PassagesIn}, {"backward", p.PassagesOut}}
+
+		for _, d := range directions {
+			if d.count == nil {
+				continue
+			}
+
+			flows = append(flows, entity{ID: id + ":" + d.name, TypeName: fiware.TrafficFlowObservedTypeName, Properties: append(slices.Clone(common),
+				decorators.Number("intensity", float64(*d.count), ObservedAt(to)),
+				decorators.Text("vehicleType", vehicleType),
+				decorators.Text("laneDirection", d.name),
+			)})
+		}
+	} else {
+		props := append(slices.Clone(common),
+			decorators.Number("peopleCount", float64(p.PassagesToday), ObservedAt(to)),
+			decorators.Number("cumulatedNumberOfPassages", float64(p.CumulatedNumberOfPassages), ObservedAt(to)),
+		)
+
+		// the payload has no direction of its own, so only the counts per direction are published
+		if p.PassagesIn != nil && p.PassagesOut != nil {
+			props = append(props,
+				decorators.Number("peopleCountTowards", float64(*p.PassagesIn), ObservedAt(to)),
+				decorators.Number("peopleCountAway", float64(*p.PassagesOut), ObservedAt(to)),
+			)
+		}
+
+		flows = append(flows, entity{ID: CrowdFlowObservedIDPrefix + p.Key(), TypeName: CrowdFlowObservedTypeName, Properties: props})
 	}
+
+	return flows, nil
+}
+
+var pointsOfInterest = kind[pointOfInterest, *pointOfInterest]{
+	name:        "point of interest",
+	contentType: "application/vnd.diwise.pointofinterest+json",
+	entities:    pointOfInterestEntities,
+	ids:         pointOfInterestIDs,
+	forget:      forgetPointOfInterest,
 }
 
 func NewPointOfInterestTopicMessageHandler(messenger messaging.MsgContext, cbClientFn func(string) client.ContextBrokerClient) messaging.TopicMessageHandler {
-	return func(ctx context.Context, itm messaging.IncomingTopicMessage, l *slog.Logger) {
-		log := l.With("content_type", itm.ContentType())
-
-		m := msg[pointOfInterest]{}
-		err := json.Unmarshal(itm.Body(), &m)
-		if err != nil {
-			log.Error("failed to unmarshal message body", "err", err.Error())
-			return
+	return pointsOfInterest.handler(cbClientFn)
+}
+
+// PointOfInterestType describes how a sub type of point of interest is published, as an entity of its own and
+// as the observations made at it
+type PointOfInterestType struct {
+	// TypeName is the type of the entity that represents the point of interest
+	TypeName string `json:"typeName"`
+	// Create is set when the entity that represents the point of interest should be created. It is only
+	// created, as it is maintained elsewhere, but its status is kept up to date.
+	Create bool `json:"create,omitempty"`
+	// Sync is set when the entity that represents the point of interest is maintained here, rather than
+	// only created, and kept in sync with the point of interest and the observations made at it
+	Sync bool `json:"sync,omitempty"`
+	// Category is the category of the entity, for models that have one
+	Category []string `json:"category,omitempty"`
+	// Status is set for models that have a status, such as open or closed
+	Status bool `json:"status,omitempty"`
+	// ObservationTypeName is the type of the observations made at the point of interest
+	ObservationTypeName string `json:"observationTypeName"`
+	// ObservationPerDevice is set when each device makes observations of its own, rather than one
+	// observation for the whole point of interest
+	ObservationPerDevice bool `json:"observationPerDevice,omitempty"`
+}
+
+// PointOfInterestTypes maps sub types of points of interest, in lower case and without spaces, dashes or
+// underscores, to how they are published. Sub types that are not listed are published as PointOfInterest.
+type PointOfInterestTypes map[string]PointOfInterestType
+
+// DefaultPointOfInterestTypes returns the sub types of points of interest that are published as models of their
+// own unless configured otherwise
+func DefaultPointOfInterestTypes() PointOfInterestTypes {
+	return PointOfInterestTypes{
+		"beach":         {TypeName: fiware.BeachTypeName, Create: true, Sync: true, ObservationTypeName: fiware.WaterQualityObservedTypeName, ObservationPerDevice: true},
+		"bathingplace":  {TypeName: fiware.BeachTypeName, Create: true, Sync: true, ObservationTypeName: fiware.WaterQualityObservedTypeName, ObservationPerDevice: true},
+		"park":          {TypeName: "Park", Create: true, ObservationTypeName: fiware.WeatherObservedTypeName},
+		"sportsfield":   {TypeName: "SportsField", Create: true, Status: true, ObservationTypeName: fiware.WeatherObservedTypeName},
+		"icerink":       {TypeName: "SportsField", Create: true, Category: []string{"ice-rink"}, Status: true, ObservationTypeName: fiware.WeatherObservedTypeName},
+		"exercisetrail": {TypeName: "ExerciseTrail", Create: true, Status: true, ObservationTypeName: fiware.WeatherObservedTypeName},
+	}
+}
+
+// LoadPointOfInterestTypes reads the sub types of points of interest, in the format described by
+// PointOfInterestTypes, from r. The sub types are used instead of the default ones, and may be written in any case
+// and with spaces, dashes or underscores.
+func LoadPointOfInterestTypes(r io.Reader) (PointOfInterestTypes, error) {
+	loaded := PointOfInterestTypes{}
+
+	err := json.NewDecoder(r).Decode(&loaded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode point of interest types: %w", err)
+	}
+
+	types := make(PointOfInterestTypes, len(loaded))
+
+	for subType, pt := range loaded {
+		if pt.TypeName == "" || pt.ObservationTypeName == "" {
+			return nil, fmt.Errorf("point of interest type %s needs both a type name and an observation type name", subType)
 		}
 
-		poi := m.Thing
+		types[poiSubTypeReplacer.Replace(strings.ToLower(subType))] = pt
+	}
 
-		var poiTypePrefix, observationID, observationTypePrefix, observationTypeName string
-		observation := make([]entities.EntityDecoratorFunc, 0)
+	return types, nil
+}
 
-		switch strings.ToLower(poi.TypeName()) {
-		case "beach":
-			observationTypePrefix = fiware.WaterQualityObservedIDPrefix
-			observationTypeName = fiware.WaterQualityObservedTypeName
-			poiTypePrefix = fiware.BeachIDPrefix
+var defaultPOIType = PointOfInterestType{TypeName: fiware.PointOfInterestTypeName, ObservationTypeName: fiware.WeatherObservedTypeName}
 
-			if poi.Current.Ref != "" {
-				observationID = fmt.Sprintf("%s%s", observationTypePrefix, poi.Current.Ref)
-				observation = append(observation, decorators.RefDevice(fmt.Sprintf("%s%s", fiware.DeviceIDPrefix, poi.Current.Ref)))
-			} else {
-				observationID = fmt.Sprintf("%s%s", observationTypePrefix, poi.AlternativeNameOrNameOrID())
-			}
+var poiSubTypeReplacer = strings.NewReplacer(" ", "", "-", "", "_", "")
 
-			poiEntityID := fmt.Sprintf("%s%s", poiTypePrefix, poi.AlternativeNameOrNameOrID())
+var defaultPointOfInterestTypes = DefaultPointOfInterestTypes()
 
-			if poi.Description != nil && *poi.Description != "" {
-				observation = append(observation, decorators.Description(*poi.Description))
-			}
+// of returns how poi is published, according to its sub type or else its type. Unless there are types of
+// points of interest, the default ones are used.
+func (types PointOfInterestTypes) of(poi pointOfInterest) PointOfInterestType {
+	if types == nil {
+		types = defaultPointOfInterestTypes
+	}
 
-			err = cip.CreateNewEntity(ctx, cbClientFn(poi.Tenant), poiEntityID, poi.TypeName(), []entities.EntityDecoratorFunc{
-				decorators.Location(poi.Location.Latitude, poi.Location.Longitude),
-			})
-			if err != nil {
-				if !errors.Is(err, cip.ErrEntityAlreadyExists) {
-					log.Error(fmt.Sprintf("failed to create beach with id %s", poiEntityID), "err", err.Error())
-					return
-				}
-			}
-		default:
-			observationTypePrefix = fiware.WeatherObservedIDPrefix
-			observationTypeName = fiware.WeatherObservedTypeName
-			poiTypePrefix = fiware.PointOfInterestIDPrefix
+	subType := poi.Type
+	if poi.SubType != nil && *poi.SubType != "" {
+		subType = *poi.SubType
+	}
+
+	if t, ok := types[poiSubTypeReplacer.Replace(strings.ToLower(subType))]; ok {
+		return t
+	}
 
-			observationID = fmt.Sprintf("%s%s", observationTypePrefix, poi.AlternativeNameOrNameOrID())
+	return defaultPOIType
+}
+
+// pointOfInterestIDs returns the ids of the entity that represents a point of interest, if it is created here,
+// and of the observations that may have been made at it
+func pointOfInterestIDs(_ context.Context, cfg Config, poi pointOfInterest) ([]string, error) {
+	pt := cfg.PointsOfInterest.of(poi)
+	ids := make([]string, 0, 2+len(poi.RefDevices))
+
+	if pt.Create {
+		ids = append(ids, fmt.Sprintf("urn:ngsi-ld:%s:%s", pt.TypeName, poi.Key()))
+	}
+
+	observationIDPrefix := "urn:ngsi-ld:" + pt.ObservationTypeName + ":"
+	ids = append(ids, observationIDPrefix+poi.Key())
+
+	if pt.ObservationPerDevice {
+		for _, d := range poi.RefDevices {
+			ids = append(ids, observationIDPrefix+d.DeviceID)
 		}
+		if poi.Current.Ref != "" && !slices.Contains(ids, observationIDPrefix+poi.Current.Ref) {
+			ids = append(ids, observationIDPrefix+poi.Current.Ref)
+		}
+	}
 
-		poiEntityID := fmt.Sprintf("%s%s", poiTypePrefix, poi.AlternativeNameOrNameOrID())
+	return ids, nil
+}
 
-		log = log.With(slog.String("entity_id", observationID), slog.String("ref_location", poiEntityID), slog.String("type_name", observationTypeName), slog.String("tenant", poi.Tenant))
-		ctx = logging.NewContextWithLogger(ctx, log)
+func pointOfInterestEntities(ctx context.Context, cfg Config, poi pointOfInterest) ([]entity, error) {
+	pt := cfg.PointsOfInterest.of(poi)
+	result := make([]entity, 0, 3)
 
-		observation = append(observation,
-			helpers.RefLocation(poiEntityID),
-			decorators.Location(poi.Location.Latitude, poi.Location.Longitude),
-			decorators.DateObserved(poi.ObservedAt.UTC().Format(time.RFC3339)),
-		)
+	poiEntityID := fmt.Sprintf("urn:ngsi-ld:%s:%s", pt.TypeName, poi.Key())
+
+	observationIDPrefix := "urn:ngsi-ld:" + pt.ObservationTypeName + ":"
+	observationID := observationIDPrefix + poi.Key()
+	observation := make([]entities.EntityDecoratorFunc, 0)
+
+	if pt.ObservationPerDevice && poi.Current.Ref != "" {
+		observationID = observationIDPrefix + poi.Current.Ref
+		observation = append(observation, decorators.RefDevice(fiware.DeviceIDPrefix+poi.Current.Ref))
+	} else {
+		observation = append(observation, deviceRefs(poi.thing)...)
+	}
 
-		if poi.Current.Value != nil {
-			observation = append(observation, helpers.Temperature(*poi.Current.Value, poi.Current.Timestamp.UTC()))
+	if pt.Create {
+		props := []entities.EntityDecoratorFunc{poi.Location.geoProperty()}
+
+		if poi.Name != "" {
+			props = append(props, helpers.Name(poi.Name))
 		}
 
-		if poi.Description != nil && *poi.Description != "" {
-			observation = append(observation, decorators.Description(*poi.Description))
+		if len(pt.Category) > 0 {
+			props = append(props, decorators.TextList("category", pt.Category))
 		}
 
-		if poi.Current.Source != nil {
-			observation = append(observation, decorators.Source(*poi.Current.Source))
+		if pt.Sync {
+			e, err := syncedPointOfInterest(ctx, poi, entity{ID: poiEntityID, TypeName: pt.TypeName, Properties: props}, observationID)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, e)
+		} else {
+			result = append(result, entity{ID: poiEntityID, TypeName: pt.TypeName, Properties: props, CreateOnly: true})
 		}
 
-		err = cip.MergeOrCreate(ctx, cbClientFn(poi.Tenant), observationID, observationTypeName, observation)
-		if err != nil {
-			log.Error("could not merge or create point of interest", "err", err.Error())
-			return
+		if pt.Status && poi.Status != nil && *poi.Status != "" {
+			status := decorators.Status(*poi.Status, TxtObservedAt(poi.ObservedAt.UTC().Format(time.RFC3339)))
+			result = append(result, entity{ID: poiEntityID, TypeName: pt.TypeName, Properties: []entities.EntityDecoratorFunc{status}})
 		}
+	}
+
+	observation = append(observation,
+		helpers.RefLocation(poiEntityID),
+		poi.Location.point(),
+		decorators.DateObserved(poi.ObservedAt.UTC().Format(time.RFC3339)),
+	)
+
+	if poi.Current.Value != nil {
+		observation = append(observation, observedTemperature("temperature", poi.Current, poi.ObservedAt))
+	}
+
+	if pt.Sync && poi.Temperature.Value != nil {
+		observation = append(observation, observedTemperature("referenceTemperature", poi.Temperature, poi.ObservedAt))
+	}
+
+	if poi.Description != nil && *poi.Description != "" {
+		observation = append(observation, decorators.Description(*poi.Description))
+	}
 
-		log.Debug("point of interest handled successfully")
+	if poi.Current.Source != nil {
+		observation = append(observation, decorators.Source(*poi.Current.Source))
 	}
+
+	return append(result, entity{ID: observationID, TypeName: pt.ObservationTypeName, Properties: observation}), nil
+}
+
+const (
+	SewagePumpingStationTypeName string = "SewagePumpingStation"
+	SewagePumpingStationIDPrefix string = "urn:ngsi-ld:" + SewagePumpingStationTypeName + ":"
+
+	pumpCyclesName string = "pumpcycles"
+)
+
+var pumpingStations = kind[pumpingStation, *pumpingStation]{
+	name:        "pumpingstation",
+	contentType: "application/vnd.diwise.pumpingstation+json",
+	entities:    pumpingStationEntities,
+	ids: func(_ context.Context, _ Config, p pumpingStation) ([]string, error) {
+		return []string{SewagePumpingStationIDPrefix + p.Key()}, nil
+	},
+	forget: forgetPumpingStation,
+}
+
+// forgetPumpingStation clears the daily pump cycle count kept for the pumping station p
+func forgetPumpingStation(ctx context.Context, _ Config, p pumpingStation, _ time.Time) ([]entity, error) {
+	entityID := SewagePumpingStationIDPrefix + p.Key()
+
+	err := state.GetFromContext(ctx).Delete(ctx, state.NewKey(p.Tenant, entityID, pumpCyclesName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to forget the pump cycles of %s: %w", entityID, err)
+	}
+
+	return nil, nil
 }
 
 func NewPumpingstationTopicMessageHandler(messenger messaging.MsgContext, cbClientFn func(string) client.ContextBrokerClient) messaging.TopicMessageHandler {
-	return func(ctx context.Context, itm messaging.IncomingTopicMessage, l *slog.Logger) {
-		log := l.With("content_type", itm.ContentType())
-		log.Debug("pumpingstation received")
+	return pumpingStations.handler(cbClientFn)
+}
 
-		var statusValue = map[bool]string{true: "on", false: "off"}
+// pumpingStationEntities publishes the pump status together with the duration of the latest pump cycle, the
+// cumulative runtime and the number of pump cycles that started during the current day
+func pumpingStationEntities(ctx context.Context, cfg Config, p pumpingStation) ([]entity, error) {
+	var statusValue = map[bool]string{true: "on", false: "off"}
 
-		m := msg[pumpingStation]{}
-		err := json.Unmarshal(itm.Body(), &m)
-		if err != nil {
-			log.Error("failed to unmarshal message body", "err", err.Error())
-			return
-		}
+	props := make([]entities.EntityDecoratorFunc, 0, 12)
 
-		props := make([]entities.EntityDecoratorFunc, 0, 5)
+	ts := p.ObservedAt.UTC()
+	if ts.IsZero() {
+		ts = time.Now().UTC()
+	}
 
-		p := m.Thing
+	observedAt := ts.Format(time.RFC3339)
 
-		observedAt := time.Now().UTC().Format(time.RFC3339)
-		if !p.ObservedAt.IsZero() {
-			observedAt = p.ObservedAt.UTC().Format(time.RFC3339)
-		}
+	props = append(props, decorators.DateObserved(observedAt))
 
-		if p.PumpingAt == nil {
-			props = append(props, decorators.DateObserved(observedAt))
-		} else {
-			props = append(props, decorators.DateObserved(observedAt))
-			pumpingAt := p.PumpingAt.UTC().Format(time.RFC3339)
-			props = append(props, decorators.Status(statusValue[p.Pumping], TxtObservedAt(pumpingAt)))
-		}
+	if p.PumpingAt != nil {
+		pumpingAt := p.PumpingAt.UTC().Format(time.RFC3339)
+		props = append(props, decorators.Status(statusValue[p.Pumping], TxtObservedAt(pumpingAt)))
+	}
 
-		//timestamp := p.PumpingAt.UTC().Format(time.RFC3339)
-		//props = append(props, decorators.DateObserved(timestamp))
-		//props = append(props, decorators.Status(statusValue[p.Pumping], TxtObservedAt(timestamp)))
-		props = append(props, decorators.Location(p.Location.Latitude, p.Location.Longitude))
+	props = append(props, p.Location.geoProperty())
 
-		typeName := "SewagePumpingStation"
-		entityID := fmt.Sprintf("urn:ngsi-ld:%s:%s", typeName, p.AlternativeNameOrNameOrID())
+	entityID := SewagePumpingStationIDPrefix + p.Key()
 
-		log = log.With(slog.String("entity_id", entityID), slog.String("type_name", typeName), slog.String("tenant", p.Tenant))
-		ctx = logging.NewContextWithLogger(ctx, log)
+	var cycleStart *time.Time
+	if p.Pumping {
+		cycleStart = p.PumpingAt
+	}
 
-		err = cip.MergeOrCreate(ctx, cbClientFn(p.Tenant), entityID, "SewagePumpingStation", props)
-		if err != nil {
-			log.Error("failed to merge or create SewagePumpingStation", slog.String("type_name", "SewagePumpingStation"), "err", err.Error())
-			return
-		}
+	cycles, err := countPerDay(ctx, p.Tenant, entityID, pumpCyclesName, cycleStart, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Duration != nil {
+		props = append(props, decorators.Number("pumpingDuration", p.Duration.Seconds(), UnitCode("SEC"), ObservedAt(observedAt)))
+	}
+
+	props = append(props,
+		decorators.Number("pumpingCumulativeTime", p.CumulativeTime.Seconds(), UnitCode("SEC"), ObservedAt(observedAt)),
+		decorators.Number("pumpingCycles", float64(cycles.Count), ObservedAt(observedAt)),
+		decorators.DateTime("datePumpingPeriodStart", helpers.FormatTime(cycles.PeriodStart)),
+	)
+
+	if p.Name != "" {
+		props = append(props, helpers.Name(p.Name))
+	}
 
-		log.Debug("pumpingstation handled handled successfully")
+	if p.AlternativeName != "" {
+		props = append(props, helpers.AlternativeName(p.AlternativeName))
 	}
+
+	if p.Description != nil && *p.Description != "" {
+		props = append(props, decorators.Description(*p.Description))
+	}
+
+	props = append(props, deviceRefs(p.thing)...)
+	props = append(props, deviceSource(p.thing)...)
+
+	return []entity{{ID: entityID, TypeName: SewagePumpingStationTypeName, Properties: props}}, nil
 }
+
+var rooms = kind[room, *room]{
+	name:        "room",
+	contentType: "application/vnd.diwise.room+json",
+	entities:    roomEntities,
+	ids: func(_ context.Context, _ Config, r room) ([]string, error) {
+		return []string{roomEntityID(r.thing)}, nil
+	},
+}
+
 func NewRoomTopicMessageHandler(messenger messaging.MsgContext, cbClientFn func(string) client.ContextBrokerClient) messaging.TopicMessageHandler {
-	return func(ctx context.Context, itm messaging.IncomingTopicMessage, l *slog.Logger) {
-		log := l.With("content_type", itm.ContentType())
-		log.Debug("room received")
-
-		m := msg[room]{}
-		err := json.Unmarshal(itm.Body(), &m)
-		if err != nil {
-			log.Error("failed to unmarshal message body", "err", err.Error())
-			return
-		}
+	return rooms.handler(cbClientFn)
+}
 
-		r := m.Thing
+// roomUnitCodes maps the SenML units of room sensors to UN/CEFACT unit codes
+var roomUnitCodes = map[string]string{
+	"Cel": "CEL",
+	"%RH": "P1",
+	"lx":  "LUX",
+	"ppm": "59",
+}
 
-		var entityID string
-		props := make([]entities.EntityDecoratorFunc, 0)
+// roomEntities publishes the sensors that are present in a room, i.e. the measurements that have a value, each
+// with the time it was observed and the device that observed it
+func roomEntities(ctx context.Context, cfg Config, r room) ([]entity, error) {
+	props := make([]entities.EntityDecoratorFunc, 0)
 
-		entityID = fmt.Sprintf("%s%s:%s", fiware.IndoorEnvironmentObservedIDPrefix, r.TypeName(), r.AlternativeNameOrNameOrID())
+	ts := r.ObservedAt
 
-		ts := r.ObservedAt
+	if ts.IsZero() {
+		ts = time.Now()
+	}
 
-		if ts.IsZero() {
-			ts = time.Now()
+	number := func(name string, value float64, m measurement) entities.EntityDecoratorFunc {
+		observedAt := m.Timestamp
+		if observedAt.IsZero() {
+			observedAt = ts
 		}
 
-		props = append(props, decorators.Location(r.Location.Latitude, r.Location.Longitude))
-		props = append(props, decorators.DateObserved(helpers.FormatTime(ts)))
-		if r.Temperature.Value != nil {
-			props = append(props, helpers.Temperature(*r.Temperature.Value, ts))
-		}
-		props = append(props, helpers.Humidity(r.Humidity, ts))
-		props = append(props, helpers.Illuminance(r.Illuminance, ts))
-		props = append(props, helpers.CO2(r.CO2, ts))
-		if len(r.Name) > 0 {
-			props = append(props, helpers.Name(r.Name))
+		propDecorators := []NumberPropertyDecoratorFunc{ObservedAt(helpers.FormatTime(observedAt))}
+		if by := m.observedBy(); by != "" {
+			propDecorators = append(propDecorators, ObservedBy(by))
 		}
-		if len(r.AlternativeName) > 0 {
-			props = append(props, helpers.AlternativeName(r.AlternativeName))
+		if code, ok := roomUnitCodes[m.Unit]; ok {
+			propDecorators = append(propDecorators, UnitCode(code))
 		}
 
-		log = log.With(slog.String("entity_id", entityID), slog.String("type_name", fiware.IndoorEnvironmentObservedTypeName), slog.String("tenant", r.Tenant))
-		ctx = logging.NewContextWithLogger(ctx, log)
+		return decorators.Number(name, value, propDecorators...)
+	}
+
+	props = append(props, r.Location.geoProperty())
+	props = append(props, decorators.DateObserved(helpers.FormatTime(ts)))
+
+	sensors := []struct {
+		name string
+		m    measurement
+	}{
+		{"temperature", r.Temperature},
+		{"humidity", r.Humidity},
+		{"illuminance", r.Illuminance},
+		{"CO2", r.CO2},
+	}
+
+	for _, s := range sensors {
+		if s.m.Value != nil {
+			props = append(props, number(s.name, *s.m.Value, s.m))
+		}
+	}
 
-		err = cip.MergeOrCreate(ctx, cbClientFn(r.Tenant), entityID, fiware.IndoorEnvironmentObservedTypeName, props)
-		if err != nil {
-			log.Error("failed to merge or create entity", "err", err.Error())
-			return
+	// the sensors of a room are assumed to share their source, so the first one that has one is published
+	for _, m := range []measurement{r.Temperature, r.Humidity, r.Illuminance, r.CO2, r.Presence} {
+		if m.Source != nil && *m.Source != "" {
+			props = append(props, decorators.Source(*m.Source))
+			break
 		}
+	}
+
+	presenceValue := map[bool]float64{true: 1, false: 0}
 
-		log.Debug("room handled handled successfully")
+	if r.Presence.BoolValue != nil {
+		props = append(props, number("presence", presenceValue[*r.Presence.BoolValue], r.Presence))
+	} else if r.Presence.Value != nil {
+		props = append(props, number("presence", *r.Presence.Value, r.Presence))
 	}
+
+	if len(r.Name) > 0 {
+		props = append(props, helpers.Name(r.Name))
+	}
+	if len(r.AlternativeName) > 0 {
+		props = append(props, helpers.AlternativeName(r.AlternativeName))
+	}
+	props = append(props, deviceRefs(r.thing)...)
+
+	occupancy, err := occupancyProperties(ctx, r.Tenant, r.ID)
+	if err != nil {
+		return nil, err
+	}
+	props = append(props, occupancy...)
+
+	return []entity{{ID: roomEntityID(r.thing), TypeName: fiware.IndoorEnvironmentObservedTypeName, Properties: props}}, nil
 }
 
-func NewSewerTopicMessageHandler(messenger messaging.MsgContext, cbClientFn func(string) client.ContextBrokerClient) messaging.TopicMessageHandler {
-	return func(ctx context.Context, itm messaging.IncomingTopicMessage, l *slog.Logger) {
-		log := l.With("content_type", itm.ContentType())
-		log.Debug("sewer received")
-
-		m := msg[sewer]{}
-		err := json.Unmarshal(itm.Body(), &m)
-		if err != nil {
-			log.Error("failed to unmarshal message body", "err", err.Error())
-			return
-		}
+// roomEntityID returns the id of the entity that observations in a room are published to
+func roomEntityID(r thing) string {
+	return fmt.Sprintf("%s%s:%s", fiware.IndoorEnvironmentObservedIDPrefix, r.TypeName(), r.Key())
+}
 
-		s := m.Thing
+// roomRef returns the id of the entity that the room r is published as, if it has been handled, or else the id
+// that it will be published as according to the id strategy
+func roomRef(ctx context.Context, cfg Config, r thing) (string, error) {
+	e, ok, err := entityOf(ctx, r.Tenant, r.ID)
+	if err != nil {
+		return "", err
+	}
 
-		entityID := s.EntityID()
-		typeName := s.TypeName()
+	if ok {
+		return e.ID, nil
+	}
 
-		log = log.With(slog.String("entity_id", entityID), slog.String("type_name", typeName), slog.String("tenant", s.Tenant), slog.String("action", s.LastAction))
-		ctx = logging.NewContextWithLogger(ctx, log)
+	key, _, err := resolveKey(ctx, r, cfg.IDs)
+	if err != nil {
+		return "", err
+	}
 
-		props := make([]entities.EntityDecoratorFunc, 0, 4)
-		props = append(props, decorators.Location(s.Location.Latitude, s.Location.Longitude))
+	r.setKey(key)
 
-		if s.Name != "" {
-			props = append(props, helpers.Name(s.Name))
-		}
+	return roomEntityID(r), nil
+}
 
-		if s.AlternativeName != "" {
-			props = append(props, helpers.AlternativeName(s.AlternativeName))
-		}
+var sewers = kind[sewer, *sewer]{
+	name:        "sewer",
+	contentType: "application/vnd.diwise.sewer+json",
+	entities:    sewerEntities,
+	ids:         sewerIDs,
+	forget:      forgetSewer,
+	upgrades:    map[int]upgrade{2: upgradeSewerV2},
+}
 
-		var observedAt string
+func NewSewerTopicMessageHandler(messenger messaging.MsgContext, cbClientFn func(string) client.ContextBrokerClient) messaging.TopicMessageHandler {
+	return sewers.handler(cbClientFn)
+}
 
-		if s.ObservedAt.IsZero() {
-			observedAt = time.Now().UTC().Format(time.RFC3339)
-		} else {
-			observedAt = s.ObservedAt.UTC().Format(time.RFC3339)
-		}
+func sewerEntities(ctx context.Context, cfg Config, s sewer) ([]entity, error) {
+	log := logging.GetFromContext(ctx).With(slog.String("action", s.LastAction))
 
-		const (
-			OverflowStarted string = "overflow started"
-			OverflowStopped string = "overflow stopped"
-			OverflowUpdated string = "overflow updated"
-			OverflowUnknown string = "overflow unknown"
-		)
+	props := make([]entities.EntityDecoratorFunc, 0, 4)
+	props = append(props, s.Location.geoProperty())
 
-		if s.Measured != nil {
-			ob := s.Measured.ObservedAt.UTC().Format(time.RFC3339)
-			props = append(props, decorators.Number("level", s.Measured.Level, ObservedAt(ob)))
-			props = append(props, decorators.Number("percent", s.Measured.Percent, ObservedAt(ob)))
-			props = append(props, decorators.DateObserved(observedAt))
+	if s.Name != "" {
+		props = append(props, helpers.Name(s.Name))
+	}
 
-			log.Debug("measured level and percent", "sewer", s, "observedAt", observedAt)
-		}
+	if s.AlternativeName != "" {
+		props = append(props, helpers.AlternativeName(s.AlternativeName))
+	}
 
-		/*
-			if s.CurrentLevel != 0 {
-				props = append(props, decorators.Number("level", s.CurrentLevel, ObservedAt(observedAt)))
-			}
+	ts := s.ObservedAt.UTC()
+	if ts.IsZero() {
+		ts = time.Now().UTC()
+	}
 
-			if s.Percent != 0 {
-				props = append(props, decorators.Number("percent", s.Percent, ObservedAt(observedAt)))
-			}
-		*/
+	observedAt := ts.Format(time.RFC3339)
 
-		if s.LastAction == OverflowUnknown {
-			props = append(props, decorators.DateObserved(observedAt))
-		}
+	const (
+		OverflowStarted string = "overflow started"
+		OverflowStopped string = "overflow stopped"
+		OverflowUpdated string = "overflow updated"
+		OverflowUnknown string = "overflow unknown"
+	)
+
+	if s.Measured != nil {
+		ob := s.Measured.ObservedAt.UTC().Format(time.RFC3339)
+		props = append(props, decorators.Number("level", s.Measured.Level, ObservedAt(ob)))
+		props = append(props, decorators.Number("percent", s.Measured.Percent, ObservedAt(ob)))
+		props = append(props, decorators.DateObserved(observedAt))
 
-		if s.LastAction == OverflowStarted || s.LastAction == OverflowUpdated {
-			props = append(props, decorators.DateObserved(observedAt))
-			overflowAt := s.OverflowAt.UTC().Format(time.RFC3339)
+		log.Debug("measured level and percent", "sewer", s, "observedAt", observedAt)
+	}
 
-			overflow := fmt.Sprintf("%t", s.Overflow)
-			props = append(props, decorators.Status(overflow, TxtObservedAt(overflowAt)))
+	if s.LastAction == OverflowUnknown {
+		props = append(props, decorators.DateObserved(observedAt))
+	}
 
-			log.Debug("overflow started", slog.String("overflow", overflow), slog.String("observedAt", observedAt), slog.String("overflowAt", overflowAt))
-		}
+	if s.LastAction == OverflowStarted || s.LastAction == OverflowUpdated {
+		props = append(props, decorators.DateObserved(observedAt))
+		overflowAt := s.OverflowAt.UTC().Format(time.RFC3339)
 
-		if s.LastAction == OverflowStopped {
-			endAt := s.OverflowEndAt.UTC().Format(time.RFC3339)
-			overflowAt := s.OverflowAt.UTC().Format(time.RFC3339)
-			overflow := fmt.Sprintf("%t", s.Overflow)
+		overflow := fmt.Sprintf("%t", s.Overflow)
+		props = append(props, decorators.Status(overflow, TxtObservedAt(overflowAt)))
 
-			props = append(props, decorators.DateObserved(observedAt))
-			props = append(props, decorators.Status(overflow, TxtObservedAt(endAt)))
+		log.Debug("overflow started", slog.String("overflow", overflow), slog.String("observedAt", observedAt), slog.String("overflowAt", overflowAt))
+	}
 
-			log.Debug("overflow ended", slog.String("overflow", overflow), slog.String("observedAt", observedAt), slog.String("overflowAt", overflowAt), slog.String("endAt", endAt))
-		}
+	if s.LastAction == OverflowStopped {
+		endAt := s.OverflowEndAt.UTC().Format(time.RFC3339)
+		overflowAt := s.OverflowAt.UTC().Format(time.RFC3339)
+		overflow := fmt.Sprintf("%t", s.Overflow)
 
-		if s.Description != nil && *s.Description != "" {
-			props = append(props, decorators.Description(*s.Description))
-		}
+		props = append(props, decorators.DateObserved(observedAt))
+		props = append(props, decorators.Status(overflow, TxtObservedAt(endAt)))
 
-		if len(s.RefDevices) > 0 {
-			devices := []string{}
-			for _, d := range s.RefDevices {
-				devices = append(devices, d.DeviceID)
-			}
+		log.Debug("overflow ended", slog.String("overflow", overflow), slog.String("observedAt", observedAt), slog.String("overflowAt", overflowAt), slog.String("endAt", endAt))
+	}
 
-			if len(devices) == 1 {
-				urn := fmt.Sprintf("%s%s", fiware.DeviceIDPrefix, devices[0])
+	overflows, err := countPerDay(ctx, s.Tenant, s.EntityID(), overflowsName, s.OverflowAt, ts)
+	if err != nil {
+		return nil, err
+	}
 
-				//TODO: find :: and remove it in the right place...
-				if strings.Contains(urn, "::") {
-					log.Debug("replacing :: with : in URN (1)", slog.String("urn", urn))
-					urn = strings.ReplaceAll(urn, "::", ":")
-				}
+	props = append(props,
+		decorators.Number("overflowCount", float64(overflows.Count), ObservedAt(observedAt)),
+		decorators.DateTime("dateOverflowPeriodStart", helpers.FormatTime(overflows.PeriodStart)),
+		decorators.Number("overflowCumulativeTime", s.CumulativeTime.Seconds(), UnitCode("SEC"), ObservedAt(observedAt)),
+	)
 
-				props = append(props, decorators.RefDevice(urn))
-				props = append(props, decorators.Source(urn))
-			} else {
-				urns := []string{}
-				for _, d := range devices {
-					urn := fmt.Sprintf("%s%s", fiware.DeviceIDPrefix, d)
+	if s.Description != nil && *s.Description != "" {
+		props = append(props, decorators.Description(*s.Description))
+	}
 
-					if strings.Contains(urn, "::") {
-						log.Debug("replacing :: with : in URN (2)", slog.String("urn", urn))
-						urn = strings.ReplaceAll(urn, "::", ":")
-					}
+	props = append(props, deviceRefs(s.thing)...)
+	props = append(props, deviceSource(s.thing)...)
 
-					urns = append(urns, urn)
-				}
+	result := []entity{{ID: s.EntityID(), TypeName: s.TypeName(), Properties: props}}
 
-				props = append(props, helpers.RefDevices(urns))
-				props = append(props, decorators.Source(urns[0]))
-			}
-		}
+	// every completed overflow is kept as an entity of its own
+	if s.LastAction == OverflowStopped && s.OverflowAt != nil && s.OverflowEndAt != nil {
+		result = append(result, overflowEntity(s))
+	}
 
-		err = cip.MergeOrCreate(ctx, cbClientFn(s.Tenant), entityID, typeName, props)
-		if err != nil {
-			log.Error("failed to merge or create Sewer", "err", err.Error())
-			return
-		}
+	return result, nil
+}
 
-		log.Debug("sewer handled handled successfully")
+// deviceRefs returns the relationships to the devices connected to a thing, refDevice when there is a single
+// device and refDevices otherwise
+func deviceRefs(t thing) []entities.EntityDecoratorFunc {
+	ids := t.DeviceIDs()
+
+	switch len(ids) {
+	case 0:
+		return nil
+	case 1:
+		return []entities.EntityDecoratorFunc{decorators.RefDevice(ids[0])}
+	default:
+		return []entities.EntityDecoratorFunc{helpers.RefDevices(ids)}
 	}
 }
 
-/*
+// deviceSource returns the first device connected to a thing as the source of its data
+func deviceSource(t thing) []entities.EntityDecoratorFunc {
+	ids := t.DeviceIDs()
+	if len(ids) == 0 {
+		return nil
+	}
+
+	return []entities.EntityDecoratorFunc{decorators.Source(ids[0])}
+}
+
+var waterMeters = kind[waterMeter, *waterMeter]{
+	name:        "watermeter",
+	contentType: "application/vnd.diwise.watermeter+json",
+	entities:    waterMeterEntities,
+	ids: func(_ context.Context, _ Config, w waterMeter) ([]string, error) {
+		return []string{fiware.WaterConsumptionObservedIDPrefix + w.Key()}, nil
+	},
+	forget: forgetWaterMeter,
+}
+
+// NewWaterMeterTopicMessageHandler publishes water meters as WaterConsumptionObserved entities keyed by the thing,
+// with the same properties as the measurements from the meters themselves
 func NewWaterMeterTopicMessageHandler(messenger messaging.MsgContext, cbClientFn func(string) client.ContextBrokerClient) messaging.TopicMessageHandler {
-	return func(ctx context.Context, itm messaging.IncomingTopicMessage, l *slog.Logger) {
-		m := msg[watermeter]{}
-		err := json.Unmarshal(itm.Body(), &m)
-		if err != nil {
-			l.Error("failed to unmarshal message body", "err", err.Error())
-			return
-		}
+	return waterMeters.handler(cbClientFn)
+}
+
+// forgetWaterMeter clears the previous reading kept for the water meter w
+func forgetWaterMeter(ctx context.Context, _ Config, w waterMeter, _ time.Time) ([]entity, error) {
+	err := watermeter.Forget(ctx, w.Tenant, fiware.WaterConsumptionObservedIDPrefix+w.Key())
+	return nil, err
+}
 
-		w := m.Thing
+func waterMeterEntities(ctx context.Context, cfg Config, w waterMeter) ([]entity, error) {
+	entityID := fmt.Sprintf("%s%s", fiware.WaterConsumptionObservedIDPrefix, w.Key())
 
-		toLtr := func(m3 float64) float64 {
-			return math.Floor((m3 + 0.0005) * 1000)
+	ts := w.ObservedAt.UTC()
+	if ts.IsZero() {
+		ts = time.Now().UTC()
+	}
+	observedAt := ts.Format(time.RFC3339)
+
+	observedBy := ""
+	if len(w.RefDevices) == 1 {
+		observedBy = w.DeviceIDs()[0]
+	}
+
+	litres := watermeter.ToLitres(w.CumulativeVolume)
+
+	reading, readingOk, err := watermeter.Update(ctx, w.Tenant, entityID, litres, ts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update water meter state: %w", err)
+	}
+
+	alarm := func(name string, active bool, at *time.Time) entities.EntityDecoratorFunc {
+		alarmAt := observedAt
+		if at != nil && !at.IsZero() {
+			alarmAt = at.UTC().Format(time.RFC3339)
 		}
+		return decorators.Number(name, watermeter.AlarmValue[active], ObservedAt(alarmAt))
+	}
 
-		props := make([]entities.EntityDecoratorFunc, 0, 4)
+	alarmInProgress := w.Leakage || w.Backflow || w.Fraud || w.Burst || reading.LeakSuspected || reading.CounterReset
 
-		entityID := fmt.Sprintf("%s%s", fiware.WaterConsumptionObservedIDPrefix, w.AlternativeNameOrNameOrID())
+	cumulative := []NumberPropertyDecoratorFunc{UnitCode("LTR"), ObservedAt(observedAt)}
+	if observedBy != "" {
+		cumulative = append(cumulative, ObservedBy(observedBy))
+	}
 
-		props = append(props, decorators.Location(w.Location.Latitude, w.Location.Longitude))
-		props = append(props, decorators.DateObserved(w.ObservedAt.UTC().Format(time.RFC3339)))
-		props = append(props, decorators.Number("waterConsumption", toLtr(w.CumulativeVolume), UnitCode("LTR"), ObservedAt(w.ObservedAt.UTC().Format(time.RFC3339))))
+	props := make([]entities.EntityDecoratorFunc, 0, 16)
 
-		alarmValues := map[bool]float64{true: 1, false: 0}
+	props = append(props,
+		w.Location.geoProperty(),
+		decorators.DateObserved(observedAt),
+		decorators.Number("cumulativeWaterConsumption", litres, cumulative...),
+		decorators.Number("alarmInProgress", watermeter.AlarmValue[alarmInProgress], ObservedAt(observedAt)),
+		alarm("alarmStopsLeaks", w.Leakage, w.LeakageObservedAt),
+		alarm("alarmWaterQuality", w.Backflow, w.BackflowObservedAt),
+		alarm("alarmTamper", w.Fraud, w.FraudObservedAt),
+		alarm("alarmBurst", w.Burst, w.BurstObservedAt),
+	)
 
-		props = append(props, decorators.Number("alarmStopsLeaks", alarmValues[w.Leakage], ObservedAt(w.ObservedAt.UTC().Format(time.RFC3339))))
-		props = append(props, decorators.Number("alarmWaterQuality", alarmValues[w.Backflow], ObservedAt(w.ObservedAt.UTC().Format(time.RFC3339))))
-		props = append(props, decorators.Number("alarmTamper", alarmValues[w.Fraud], ObservedAt(w.ObservedAt.UTC().Format(time.RFC3339))))
-		//props = append(props, decorators.Number("alarmBurst", alarmValues[w.Burst]))
+	props = append(props, watermeter.Decorators(reading, readingOk, observedAt, observedBy)...)
 
-		if w.Description != nil && *w.Description != "" {
-			props = append(props, decorators.Description(*w.Description))
-		}
+	if w.Name != "" {
+		props = append(props, helpers.Name(w.Name))
+	}
 
-		err = cip.MergeOrCreate(ctx, cbClientFn(w.Tenant), entityID, fiware.WaterConsumptionObservedTypeName, props)
-		if err != nil {
-			l.Error("failed to merge or create entity", slog.String("type_name", fiware.WaterConsumptionObservedTypeName), "err", err.Error())
-			return
-		}
+	if w.Description != nil && *w.Description != "" {
+		props = append(props, decorators.Description(*w.Description))
 	}
+
+	props = append(props, deviceRefs(w.thing)...)
+
+	// a reading that could not be published is restored, so that its consumption and alarms are derived again
+	failed := func(ctx context.Context) error {
+		return watermeter.Restore(ctx, reading)
+	}
+
+	return []entity{{ID: entityID, TypeName: fiware.WaterConsumptionObservedTypeName, Properties: props, failed: failed}}, nil
 }
-*/
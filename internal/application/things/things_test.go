@@ -2,13 +2,19 @@ package things
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"log/slog"
+	"strings"
 	"testing"
 
+	"github.com/diwise/context-broker/pkg/datamodels/fiware"
 	"github.com/diwise/context-broker/pkg/ngsild"
 	"github.com/diwise/context-broker/pkg/ngsild/client"
+	ngsierrors "github.com/diwise/context-broker/pkg/ngsild/errors"
 	"github.com/diwise/context-broker/pkg/ngsild/types"
 	testClient "github.com/diwise/context-broker/pkg/test"
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
 	"github.com/diwise/messaging-golang/pkg/messaging"
 	"github.com/matryer/is"
 )
@@ -21,14 +27,18 @@ func TestContainerTopicMessageHandler(t *testing.T) {
 	e := ""
 	cb := &testClient.ContextBrokerClientMock{
 		MergeEntityFunc: func(ctx context.Context, entityID string, fragment types.EntityFragment, headers map[string][]string) (*ngsild.MergeEntityResult, error) {
-			e = entityID
+			if !isDevice(entityID) {
+				e = entityID
+			}
 			return &ngsild.MergeEntityResult{}, nil
 		},
 		RetrieveEntityFunc: func(ctx context.Context, entityID string, headers map[string][]string) (types.Entity, error) {
 			return nil, nil
 		},
 		CreateEntityFunc: func(ctx context.Context, entity types.Entity, headers map[string][]string) (*ngsild.CreateEntityResult, error) {
-			e = entity.ID()
+			if !isDevice(entity.ID()) {
+				e = entity.ID()
+			}
 			return &ngsild.CreateEntityResult{}, nil
 		},
 	}
@@ -45,7 +55,7 @@ func TestContainerTopicMessageHandler(t *testing.T) {
 
 	handler(ctx, itm, slog.Default())
 
-	is.Equal(e, "urn:ngsi-ld:WasteContainer:Soptunnor.XY")
+	is.Equal(e, "urn:ngsi-ld:WasteContainer:2bf440f4")
 }
 
 func TestSewerMessage(t *testing.T) {
@@ -56,14 +66,18 @@ func TestSewerMessage(t *testing.T) {
 	e := ""
 	cb := &testClient.ContextBrokerClientMock{
 		MergeEntityFunc: func(ctx context.Context, entityID string, fragment types.EntityFragment, headers map[string][]string) (*ngsild.MergeEntityResult, error) {
-			e = entityID
+			if !isDevice(entityID) {
+				e = entityID
+			}
 			return &ngsild.MergeEntityResult{}, nil
 		},
 		RetrieveEntityFunc: func(ctx context.Context, entityID string, headers map[string][]string) (types.Entity, error) {
 			return nil, nil
 		},
 		CreateEntityFunc: func(ctx context.Context, entity types.Entity, headers map[string][]string) (*ngsild.CreateEntityResult, error) {
-			e = entity.ID()
+			if !isDevice(entity.ID()) {
+				e = entity.ID()
+			}
 			return &ngsild.CreateEntityResult{}, nil
 		},
 	}
@@ -91,14 +105,18 @@ func TestPumpingStationMessage(t *testing.T) {
 	e := ""
 	cb := &testClient.ContextBrokerClientMock{
 		MergeEntityFunc: func(ctx context.Context, entityID string, fragment types.EntityFragment, headers map[string][]string) (*ngsild.MergeEntityResult, error) {
-			e = entityID
+			if !isDevice(entityID) {
+				e = entityID
+			}
 			return &ngsild.MergeEntityResult{}, nil
 		},
 		RetrieveEntityFunc: func(ctx context.Context, entityID string, headers map[string][]string) (types.Entity, error) {
 			return nil, nil
 		},
 		CreateEntityFunc: func(ctx context.Context, entity types.Entity, headers map[string][]string) (*ngsild.CreateEntityResult, error) {
-			e = entity.ID()
+			if !isDevice(entity.ID()) {
+				e = entity.ID()
+			}
 			return &ngsild.CreateEntityResult{}, nil
 		},
 	}
@@ -232,23 +250,26 @@ const sewerJson = `
 
 const pumpingStationJson = `{"id":"pump-001","type":"PumpingStation","thing":{"id":"pump-001","location":{"latitude":0,"longitude":0},"name":"","observedAt":"2025-01-15T07:47:38Z","pumpingCumulativeTime":0,"pumpingDuration":null,"pumpingObserved":false,"pumpingObservedAt":null,"refDevices":[{"deviceID":"ce3acc09ab62"}],"tenant":"default","type":"PumpingStation","validURN":["urn:oma:lwm2m:ext:3200"]},"tenant":"default","timestamp":"2025-01-15T07:47:40.360378603Z"}`
 
-
 func TestBeachMessage(t *testing.T) {
 	is := is.New(t)
 
 	ctx := context.Background()
 
-	observationID := ""
+	observations := map[string]bool{}
 	cb := &testClient.ContextBrokerClientMock{
 		MergeEntityFunc: func(ctx context.Context, entityID string, fragment types.EntityFragment, headers map[string][]string) (*ngsild.MergeEntityResult, error) {
-			observationID = entityID
+			if !isDevice(entityID) {
+				observations[entityID] = true
+			}
 			return &ngsild.MergeEntityResult{}, nil
 		},
 		RetrieveEntityFunc: func(ctx context.Context, entityID string, headers map[string][]string) (types.Entity, error) {
 			return nil, nil
 		},
 		CreateEntityFunc: func(ctx context.Context, entity types.Entity, headers map[string][]string) (*ngsild.CreateEntityResult, error) {
-			observationID = entity.ID()
+			if !isDevice(entity.ID()) {
+				observations[entity.ID()] = true
+			}
 			return &ngsild.CreateEntityResult{}, nil
 		},
 	}
@@ -265,10 +286,9 @@ func TestBeachMessage(t *testing.T) {
 
 	handler(ctx, itm, slog.Default())
 
-	is.Equal(observationID, "urn:ngsi-ld:WaterQualityObserved:09089d61-8f40-5ac8-a631-c940dab1fc9b")
+	is.True(observations["urn:ngsi-ld:WaterQualityObserved:09089d61-8f40-5ac8-a631-c940dab1fc9b"])
 }
 
-
 const pointOfInterestJson = `{
   "id": "71ed07e4-52c0-417c-be15-3110b8e1f4e8",
   "type": "PointOfInterest",
@@ -311,3 +331,474 @@ const pointOfInterestJson = `{
   "tenant": "default",
   "timestamp": "2026-03-23T16:21:34.397588165Z"
 }`
+
+func TestBuildingMessage(t *testing.T) {
+	is := is.New(t)
+
+	ctx := context.Background()
+
+	cb, created := newCreateRecorder()
+	msgCtx := &messaging.MsgContextMock{}
+	itm := &messaging.IncomingTopicMessageMock{
+		BodyFunc:        func() []byte { return []byte(buildingJson) },
+		ContentTypeFunc: func() string { return "application/vnd.diwise.building+json" },
+		TopicNameFunc:   func() string { return "thing.updated" },
+	}
+
+	handler := NewBuildingTopicMessageHandler(msgCtx, func(s string) client.ContextBrokerClient {
+		return cb
+	})
+
+	handler(ctx, itm, slog.Default())
+
+	body, ok := created["urn:ngsi-ld:Building:b7a5d3e0"]
+	is.True(ok)
+	is.True(strings.Contains(body, `"type":"Building"`))
+
+	is.True(strings.Contains(body, `"address":{"type":"Property","value":{"streetAddress":"Norrmalmsgatan 4","postalCode":"851 85","addressLocality":"Sundsvall","addressCountry":"SE"}}`))
+	is.True(strings.Contains(body, `"category":{"type":"Property","value":["office"]}`))
+	is.True(strings.Contains(body, `"location":{"type":"GeoProperty","value":{"type":"MultiPolygon","coordinates":[[[[17.3,62.39],[17.31,62.39],[17.31,62.4],[17.3,62.39]]]]}}`))
+	is.True(strings.Contains(body, `"refDevice":{"type":"Relationship","object":"urn:ngsi-ld:Device:a81758fffe0d1234"}`))
+	is.True(strings.Contains(body, `"refRooms":{"type":"Relationship","object":["urn:ngsi-ld:IndoorEnvironmentObserved:Room:r-001"]}`))
+}
+
+const buildingJson = `{
+	"id": "b7a5d3e0",
+	"type": "Building",
+	"thing": {
+		"id": "b7a5d3e0",
+		"type": "Building",
+		"subType": "Office",
+		"name": "Stadshuset",
+		"description": "",
+		"address": {
+			"streetAddress": "Norrmalmsgatan 4",
+			"postalCode": "851 85",
+			"addressLocality": "Sundsvall",
+			"addressCountry": "SE"
+		},
+		"location": {
+			"latitude": 62.39,
+			"longitude": 17.3
+		},
+		"footprint": [
+			{"latitude": 62.39, "longitude": 17.3},
+			{"latitude": 62.39, "longitude": 17.31},
+			{"latitude": 62.4, "longitude": 17.31}
+		],
+		"refDevices": [
+			{
+				"deviceID": "a81758fffe0d1234"
+			}
+		],
+		"rooms": [
+			{
+				"id": "r-001",
+				"type": "Room",
+				"name": "Sammantradesrum"
+			}
+		],
+		"observedAt": "2025-02-01T10:00:00Z",
+		"tenant": "default"
+	},
+	"tenant": "default",
+	"timestamp": "2025-02-01T10:00:01Z"
+}`
+
+func TestPassageMessageForPeople(t *testing.T) {
+	is := is.New(t)
+
+	cb, entities := newCreateRecorder()
+	itm := &messaging.IncomingTopicMessageMock{
+		BodyFunc:        func() []byte { return []byte(passageJson) },
+		ContentTypeFunc: func() string { return "application/vnd.diwise.passage+json" },
+		TopicNameFunc:   func() string { return "thing.updated" },
+	}
+
+	handler := NewPassageTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient {
+		return cb
+	})
+
+	handler(context.Background(), itm, slog.Default())
+
+	is.Equal(len(entities), 1) // the crowd flow, but not the device that counts it since it does not exist
+
+	body, ok := entities["urn:ngsi-ld:CrowdFlowObserved:c1d2e3f4"]
+	is.True(ok)
+	is.True(strings.Contains(body, `"refDevice":{"type":"Relationship","object":"urn:ngsi-ld:Device:a81758fffe0d5678"}`))
+	is.True(strings.Contains(body, `"peopleCount":{"type":"Property","value":17,"observedAt":"2025-03-01T14:00:00Z"}`))
+	is.True(strings.Contains(body, `"peopleCountTowards":{"type":"Property","value":10,"observedAt":"2025-03-01T14:00:00Z"}`))
+	is.True(strings.Contains(body, `"peopleCountAway":{"type":"Property","value":7,"observedAt":"2025-03-01T14:00:00Z"}`))
+	is.True(strings.Contains(body, `"cumulatedNumberOfPassages":{"type":"Property","value":4711,"observedAt":"2025-03-01T14:00:00Z"}`))
+	is.True(!strings.Contains(body, `"direction"`)) // not a part of the payload
+	// the counts are for the day since midnight in Stockholm
+	is.True(strings.Contains(body, `"dateObservedFrom":{"type":"Property","value":{"@type":"DateTime","@value":"2025-02-28T23:00:00Z"}}`))
+	is.True(strings.Contains(body, `"dateLastPassage":{"type":"Property","value":{"@type":"DateTime","@value":"2025-03-01T13:58:12Z"}}`))
+}
+
+func TestPassageMessageForBicycles(t *testing.T) {
+	is := is.New(t)
+
+	bicycles := strings.Replace(passageJson, `"subType": "People"`, `"subType": "Bicycle"`, 1)
+
+	cb, entities := newCreateRecorder()
+	itm := &messaging.IncomingTopicMessageMock{
+		BodyFunc:        func() []byte { return []byte(bicycles) },
+		ContentTypeFunc: func() string { return "application/vnd.diwise.passage+json" },
+		TopicNameFunc:   func() string { return "thing.updated" },
+	}
+
+	handler := NewPassageTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient {
+		return cb
+	})
+
+	handler(context.Background(), itm, slog.Default())
+
+	is.Equal(len(entities), 3) // one for all the traffic and one per direction
+
+	body := entities["urn:ngsi-ld:TrafficFlowObserved:c1d2e3f4"]
+	is.True(strings.Contains(body, `"intensity":{"type":"Property","value":17,"observedAt":"2025-03-01T14:00:00Z"}`))
+	is.True(strings.Contains(body, `"vehicleType":{"type":"Property","value":"bicycle"}`))
+	is.True(strings.Contains(body, `"cumulatedNumberOfPassages":{"type":"Property","value":4711,"observedAt":"2025-03-01T14:00:00Z"}`))
+
+	body = entities["urn:ngsi-ld:TrafficFlowObserved:c1d2e3f4:backward"]
+	is.True(strings.Contains(body, `"intensity":{"type":"Property","value":7,"observedAt":"2025-03-01T14:00:00Z"}`))
+	is.True(strings.Contains(body, `"laneDirection":{"type":"Property","value":"backward"}`))
+}
+
+const passageJson = `{
+	"id": "c1d2e3f4",
+	"type": "Passage",
+	"thing": {
+		"id": "c1d2e3f4",
+		"type": "Passage",
+		"subType": "People",
+		"name": "Entre badhuset",
+		"location": {
+			"latitude": 62.39,
+			"longitude": 17.3
+		},
+		"refDevices": [
+			{
+				"deviceID": "a81758fffe0d5678"
+			}
+		],
+		"passagesToday": 17,
+		"passagesIn": 10,
+		"passagesOut": 7,
+		"cumulatedNumberOfPassages": 4711,
+		"lastPassageAt": "2025-03-01T13:58:12Z",
+		"observedAt": "2025-03-01T14:00:00Z",
+		"tenant": "default"
+	},
+	"tenant": "default",
+	"timestamp": "2025-03-01T14:00:01Z"
+}`
+
+func TestWaterMeterMessage(t *testing.T) {
+	is := is.New(t)
+
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+
+	bodies := []string{}
+	cb := &testClient.ContextBrokerClientMock{
+		MergeEntityFunc: func(ctx context.Context, entityID string, fragment types.EntityFragment, headers map[string][]string) (*ngsild.MergeEntityResult, error) {
+			if entityID != "urn:ngsi-ld:WaterConsumptionObserved:d4e5f6a7" {
+				return &ngsild.MergeEntityResult{}, nil // its device and the name based entity it supersedes
+			}
+			b, _ := json.Marshal(fragment)
+			bodies = append(bodies, string(b))
+			return &ngsild.MergeEntityResult{}, nil
+		},
+	}
+
+	handler := NewWaterMeterTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient {
+		return cb
+	})
+
+	for _, body := range []string{waterMeterJson, strings.NewReplacer(`"cumulativeVolume": 12.3`, `"cumulativeVolume": 12.4`, `"observedAt": "2025-02-01T10:00:00Z"`, `"observedAt": "2025-02-01T11:00:00Z"`).Replace(waterMeterJson)} {
+		itm := &messaging.IncomingTopicMessageMock{
+			BodyFunc:        func() []byte { return []byte(body) },
+			ContentTypeFunc: func() string { return "application/vnd.diwise.watermeter+json" },
+			TopicNameFunc:   func() string { return "thing.updated" },
+		}
+		handler(ctx, itm, slog.Default())
+	}
+
+	is.Equal(len(bodies), 2)
+
+	is.True(strings.Contains(bodies[0], `"cumulativeWaterConsumption":{"type":"Property","value":12300,"observedAt":"2025-02-01T10:00:00Z","observedBy":{"type":"Relationship","object":"urn:ngsi-ld:Device:a81758fffe0d9999"},"unitCode":"LTR"}`))
+	is.True(strings.Contains(bodies[0], `"alarmStopsLeaks":{"type":"Property","value":1,"observedAt":"2025-02-01T09:45:00Z"}`))
+	is.True(strings.Contains(bodies[0], `"alarmBurst":{"type":"Property","value":0,"observedAt":"2025-02-01T10:00:00Z"}`))
+	is.True(strings.Contains(bodies[0], `"alarmInProgress":{"type":"Property","value":1,"observedAt":"2025-02-01T10:00:00Z"}`))
+	is.True(!strings.Contains(bodies[0], `"waterConsumption"`))
+
+	is.True(strings.Contains(bodies[1], `"waterConsumption":{"type":"Property","value":100,"observedAt":"2025-02-01T11:00:00Z"`))
+	is.True(strings.Contains(bodies[1], `"flow":{"type":"Property","value":100,"observedAt":"2025-02-01T11:00:00Z"`))
+}
+
+const waterMeterJson = `{
+	"id": "d4e5f6a7",
+	"type": "WaterMeter",
+	"thing": {
+		"id": "d4e5f6a7",
+		"type": "WaterMeter",
+		"name": "VM-4711",
+		"location": {
+			"latitude": 62.39,
+			"longitude": 17.3
+		},
+		"refDevices": [
+			{
+				"deviceID": "a81758fffe0d9999"
+			}
+		],
+		"cumulativeVolume": 12.3,
+		"leakage": true,
+		"leakageObservedAt": "2025-02-01T09:45:00Z",
+		"backflow": false,
+		"fraud": false,
+		"burst": false,
+		"observedAt": "2025-02-01T10:00:00Z",
+		"tenant": "default"
+	},
+	"tenant": "default",
+	"timestamp": "2025-02-01T10:00:01Z"
+}`
+
+func TestRoomMessage(t *testing.T) {
+	is := is.New(t)
+
+	ctx := context.Background()
+
+	cb, created := newCreateRecorder()
+	itm := &messaging.IncomingTopicMessageMock{
+		BodyFunc:        func() []byte { return []byte(roomJson) },
+		ContentTypeFunc: func() string { return "application/vnd.diwise.room+json" },
+		TopicNameFunc:   func() string { return "thing.updated" },
+	}
+
+	handler := NewRoomTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient {
+		return cb
+	})
+
+	handler(ctx, itm, slog.Default())
+
+	body, ok := created["urn:ngsi-ld:IndoorEnvironmentObserved:Room:r-001"]
+	is.True(ok)
+
+	is.True(strings.Contains(body, `"temperature":{"type":"Property","value":21.5,"observedAt":"2025-02-01T09:58:00Z","observedBy":{"type":"Relationship","object":"urn:ngsi-ld:Device:a81758fffe0d1234"},"unitCode":"CEL"}`))
+	is.True(strings.Contains(body, `"CO2":{"type":"Property","value":650,"observedAt":"2025-02-01T09:59:00Z","observedBy":{"type":"Relationship","object":"urn:ngsi-ld:Device:a81758fffe0d5678"},"unitCode":"59"}`))
+	is.True(strings.Contains(body, `"presence":{"type":"Property","value":1,"observedAt":"2025-02-01T10:00:00Z","observedBy":{"type":"Relationship","object":"urn:ngsi-ld:Device:a81758fffe0d5678"}}`))
+	is.True(!strings.Contains(body, `"humidity"`))    // no humidity sensor in the room
+	is.True(!strings.Contains(body, `"illuminance"`)) // nor an illuminance sensor
+}
+
+const roomJson = `{
+	"id": "r-001",
+	"type": "Room",
+	"thing": {
+		"id": "r-001",
+		"type": "Room",
+		"name": "Sammantradesrum",
+		"location": {
+			"latitude": 62.39,
+			"longitude": 17.3
+		},
+		"temperature": {
+			"v": 21.5,
+			"unit": "Cel",
+			"timestamp": "2025-02-01T09:58:00Z",
+			"ref": "a81758fffe0d1234"
+		},
+		"co2": {
+			"v": 650,
+			"unit": "ppm",
+			"timestamp": "2025-02-01T09:59:00Z",
+			"ref": "a81758fffe0d5678"
+		},
+		"presence": {
+			"vb": true,
+			"timestamp": "2025-02-01T10:00:00Z",
+			"ref": "a81758fffe0d5678"
+		},
+		"observedAt": "2025-02-01T10:00:00Z",
+		"tenant": "default"
+	},
+	"tenant": "default",
+	"timestamp": "2025-02-01T10:00:01Z"
+}`
+
+func TestThatRoomSensorsMayBePlainValues(t *testing.T) {
+	is := is.New(t)
+
+	cb, created := newCreateRecorder()
+
+	handler := NewRoomTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient {
+		return cb
+	})
+
+	body := strings.NewReplacer(`"co2": {
+			"v": 650,
+			"unit": "ppm",
+			"timestamp": "2025-02-01T09:59:00Z",
+			"ref": "a81758fffe0d5678"
+		}`, `"co2": 650, "humidity": 45.5, "illuminance": null`, `"presence": {
+			"vb": true,
+			"timestamp": "2025-02-01T10:00:00Z",
+			"ref": "a81758fffe0d5678"
+		}`, `"presence": true`, `"ref": "a81758fffe0d1234"`, `"source": "Fastighetssystem"`).Replace(roomJson)
+	is.True(body != roomJson)
+
+	handler(context.Background(), thingMessage("application/vnd.diwise.room+json", body), slog.Default())
+
+	room, ok := created["urn:ngsi-ld:IndoorEnvironmentObserved:Room:r-001"]
+	is.True(ok)
+	is.True(strings.Contains(room, `"CO2":{"type":"Property","value":650,"observedAt":"2025-02-01T10:00:00Z"}`))
+	is.True(strings.Contains(room, `"humidity":{"type":"Property","value":45.5,"observedAt":"2025-02-01T10:00:00Z"}`))
+	is.True(strings.Contains(room, `"presence":{"type":"Property","value":1,"observedAt":"2025-02-01T10:00:00Z"}`))
+	is.True(!strings.Contains(room, `"illuminance"`))
+	is.True(strings.Contains(room, `"temperature":{"type":"Property","value":21.5,"observedAt":"2025-02-01T09:58:00Z","unitCode":"CEL"}`)) // not observed by its source
+	is.True(strings.Contains(room, `"source":{"type":"Property","value":"Fastighetssystem"}`))
+}
+
+func TestPumpingStationMessageWithRuntime(t *testing.T) {
+	is := is.New(t)
+
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+
+	cb, created := newCreateRecorder()
+
+	handler := NewPumpingstationTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient {
+		return cb
+	})
+
+	handler(ctx, &messaging.IncomingTopicMessageMock{
+		BodyFunc:        func() []byte { return []byte(pumpingStationPumpingJson) },
+		ContentTypeFunc: func() string { return "application/vnd.diwise.pumpingstation+json" },
+		TopicNameFunc:   func() string { return "thing.updated" },
+	}, slog.Default())
+
+	body, ok := created[SewagePumpingStationIDPrefix+"pump-002"]
+	is.True(ok)
+	is.True(strings.Contains(body, `"type":"`+SewagePumpingStationTypeName+`"`))
+
+	is.True(strings.Contains(body, `"pumpingDuration":{"type":"Property","value":300,"observedAt":"2025-01-15T08:05:00Z","unitCode":"SEC"}`))
+	is.True(strings.Contains(body, `"pumpingCumulativeTime":{"type":"Property","value":5400,"observedAt":"2025-01-15T08:05:00Z","unitCode":"SEC"}`))
+	is.True(strings.Contains(body, `"pumpingCycles":{"type":"Property","value":1,"observedAt":"2025-01-15T08:05:00Z"}`))
+	is.True(strings.Contains(body, `"name":{"type":"Property","value":"Pumpstation Norr"}`))
+	is.True(strings.Contains(body, `"refDevice":{"type":"Relationship","object":"urn:ngsi-ld:Device:ce3acc09ab62"}`))
+}
+
+const pumpingStationPumpingJson = `{"id":"pump-002","type":"PumpingStation","thing":{"id":"pump-002","location":{"latitude":62.4,"longitude":17.3},"name":"Pumpstation Norr","alternativeName":"pump-002","observedAt":"2025-01-15T08:05:00Z","pumpingCumulativeTime":5400000000000,"pumpingDuration":300000000000,"pumpingObserved":true,"pumpingObservedAt":"2025-01-15T08:00:00Z","refDevices":[{"deviceID":"ce3acc09ab62"}],"tenant":"default","type":"PumpingStation"},"tenant":"default","timestamp":"2025-01-15T08:05:01Z"}`
+
+func isDevice(entityID string) bool {
+	return strings.HasPrefix(entityID, fiware.DeviceIDPrefix)
+}
+
+// newCreateRecorder returns a context broker client that has no entities, so that every entity is created,
+// and the bodies of the entities that were created, devices included, keyed by entity id
+func newCreateRecorder() (*testClient.ContextBrokerClientMock, map[string]string) {
+	created := map[string]string{}
+
+	return &testClient.ContextBrokerClientMock{
+		MergeEntityFunc: func(ctx context.Context, entityID string, fragment types.EntityFragment, headers map[string][]string) (*ngsild.MergeEntityResult, error) {
+			return nil, ngsierrors.ErrNotFound
+		},
+		CreateEntityFunc: func(ctx context.Context, e types.Entity, headers map[string][]string) (*ngsild.CreateEntityResult, error) {
+			b, _ := json.Marshal(e)
+			created[e.ID()] = string(b)
+			return &ngsild.CreateEntityResult{}, nil
+		},
+	}, created
+}
+
+func TestThatPointOfInterestTypesCanBeConfigured(t *testing.T) {
+	is := is.New(t)
+
+	types, err := LoadPointOfInterestTypes(strings.NewReader(`{"Swimming-Pool": {"typeName": "SportsFacility", "create": true, "observationTypeName": "WaterQualityObserved"}}`))
+	is.NoErr(err)
+
+	cfg := DefaultConfig()
+	cfg.PointsOfInterest = types
+
+	cb, created := newCreateRecorder()
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+	handler := NewThingTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient { return cb }, cfg)
+
+	for _, subType := range []string{"Swimming pool", "Beach"} {
+		body := strings.Replace(pointOfInterestJson, `"subType": "Beach"`, fmt.Sprintf(`"subType": %q`, subType), 1)
+		handler(ctx, thingMessage("application/vnd.diwise.pointofinterest+json", body), slog.Default())
+	}
+
+	_, ok := created["urn:ngsi-ld:SportsFacility:71ed07e4-52c0-417c-be15-3110b8e1f4e8"]
+	is.True(ok)
+	_, ok = created["urn:ngsi-ld:WaterQualityObserved:71ed07e4-52c0-417c-be15-3110b8e1f4e8"]
+	is.True(ok)
+	_, ok = created["urn:ngsi-ld:Beach:71ed07e4-52c0-417c-be15-3110b8e1f4e8"]
+	is.True(!ok) // the configured types replace the default ones
+
+	_, err = LoadPointOfInterestTypes(strings.NewReader(`{"pool": {"typeName": "SportsFacility"}}`))
+	is.True(err != nil) // the type of the observations is missing
+}
+
+func TestPointOfInterestSubTypes(t *testing.T) {
+	is := is.New(t)
+
+	ctx := context.Background()
+
+	testCases := []struct {
+		subType     string
+		status      string
+		expected    []string
+		contains    string
+		observation string
+	}{
+		{"Beach", "", []string{"urn:ngsi-ld:Beach:71ed07e4-52c0-417c-be15-3110b8e1f4e8"}, `"location"`, "urn:ngsi-ld:WaterQualityObserved:09089d61-8f40-5ac8-a631-c940dab1fc9b"},
+		{"Ice rink", "open", []string{"urn:ngsi-ld:SportsField:71ed07e4-52c0-417c-be15-3110b8e1f4e8"}, `"category":{"type":"Property","value":["ice-rink"]}`, "urn:ngsi-ld:WeatherObserved:71ed07e4-52c0-417c-be15-3110b8e1f4e8"},
+		{"ExerciseTrail", "closed", []string{"urn:ngsi-ld:ExerciseTrail:71ed07e4-52c0-417c-be15-3110b8e1f4e8"}, `"status":{"type":"Property","value":"closed","observedAt":"2026-03-23T16:20:30Z"}`, "urn:ngsi-ld:WeatherObserved:71ed07e4-52c0-417c-be15-3110b8e1f4e8"},
+		{"Park", "", []string{"urn:ngsi-ld:Park:71ed07e4-52c0-417c-be15-3110b8e1f4e8"}, `"name":{"type":"Property","value":"Teststrand"}`, "urn:ngsi-ld:WeatherObserved:71ed07e4-52c0-417c-be15-3110b8e1f4e8"},
+		{"Unknown", "", []string{}, "", "urn:ngsi-ld:WeatherObserved:71ed07e4-52c0-417c-be15-3110b8e1f4e8"},
+	}
+
+	for _, tc := range testCases {
+		// beaches that have not changed are not written again, so every case starts from a state of its own
+		ctx := state.NewContextWithStore(ctx, state.NewInMemoryStore())
+		written := map[string]string{}
+		cb := &testClient.ContextBrokerClientMock{
+			MergeEntityFunc: func(ctx context.Context, entityID string, fragment types.EntityFragment, headers map[string][]string) (*ngsild.MergeEntityResult, error) {
+				b, _ := json.Marshal(fragment)
+				written[entityID] += string(b)
+				return &ngsild.MergeEntityResult{}, nil
+			},
+			CreateEntityFunc: func(ctx context.Context, e types.Entity, headers map[string][]string) (*ngsild.CreateEntityResult, error) {
+				b, _ := json.Marshal(e)
+				written[e.ID()] += string(b)
+				return &ngsild.CreateEntityResult{}, nil
+			},
+		}
+
+		body := strings.Replace(pointOfInterestJson, `"subType": "Beach"`, fmt.Sprintf(`"subType": %q, "status": %q`, tc.subType, tc.status), 1)
+
+		handler := NewPointOfInterestTopicMessageHandler(&messaging.MsgContextMock{}, func(s string) client.ContextBrokerClient {
+			return cb
+		})
+
+		handler(ctx, &messaging.IncomingTopicMessageMock{
+			BodyFunc:        func() []byte { return []byte(body) },
+			ContentTypeFunc: func() string { return "application/vnd.diwise.pointofinterest+json" },
+			TopicNameFunc:   func() string { return "thing.updated" },
+		}, slog.Default())
+
+		for _, id := range tc.expected {
+			is.True(strings.Contains(written[id], tc.contains))
+		}
+
+		is.True(strings.Contains(written[tc.observation], `"refLocation"`))
+
+		if len(tc.expected) == 0 {
+			_, ok := written["urn:ngsi-ld:PointOfInterest:71ed07e4-52c0-417c-be15-3110b8e1f4e8"]
+			is.True(!ok) // points of interest of unknown sub types are not created
+		}
+	}
+}
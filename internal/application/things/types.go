@@ -1,9 +1,14 @@
 package things
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"regexp"
+	"strings"
 	"time"
+
+	"github.com/diwise/context-broker/pkg/datamodels/fiware"
 )
 
 type thing struct {
@@ -17,12 +22,31 @@ type thing struct {
 	RefDevices      []device  `json:"refDevices,omitempty"`
 	ObservedAt      time.Time `json:"observedAt"`
 	Tenant          string    `json:"tenant"`
+	// Parent is the id of the thing that the thing is part of, such as the room that a desk is in or the isle
+	// that a waste container stands in
+	Parent string `json:"parent,omitempty"`
+	// key is resolved when the thing is handled, see Key
+	key string
 }
 
 var nonSafeUriRegExp = regexp.MustCompile(`[^\w\-~:/?#\[\]@!$&'()*+,;=%.]+`)
 
 func (t thing) EntityID() string {
-	return fmt.Sprintf("urn:ngsi-ld:%s:%s", t.TypeName(), t.AlternativeNameOrNameOrID())
+	return fmt.Sprintf("urn:ngsi-ld:%s:%s", t.TypeName(), t.Key())
+}
+
+// Key returns the part of the entity ids of the thing that identifies the thing, as resolved according to the
+// IDStrategy in use, or else its alternative name, name or id
+func (t thing) Key() string {
+	if t.key != "" {
+		return t.key
+	}
+
+	return t.AlternativeNameOrNameOrID()
+}
+
+func (t *thing) setKey(key string) {
+	t.key = key
 }
 
 func (t thing) AlternativeNameOrNameOrID() string {
@@ -53,18 +77,55 @@ func (t thing) TypeName() string {
 	return typeName
 }
 
+// DeviceIDs returns the entity ids of the devices connected to the thing. Device ids that already are
+// entity ids are kept as they are, and the empty segments that some device ids give rise to are removed.
+func (t thing) DeviceIDs() []string {
+	ids := make([]string, 0, len(t.RefDevices))
+
+	for _, d := range t.RefDevices {
+		id := strings.TrimPrefix(d.DeviceID, fiware.DeviceIDPrefix)
+		id = fiware.DeviceIDPrefix + strings.TrimPrefix(id, ":")
+		ids = append(ids, strings.ReplaceAll(id, "::", ":"))
+	}
+
+	return ids
+}
+
+// location is where a thing is, as a point and optionally as a GeoJSON geometry, see UnmarshalJSON
 type location struct {
-	Latitude  float64 `json:"latitude"`
-	Longitude float64 `json:"longitude"`
+	Latitude  float64   `json:"latitude"`
+	Longitude float64   `json:"longitude"`
+	Geometry  *geometry `json:"-"`
 }
 
 type device struct {
 	DeviceID string `json:"deviceID"`
 }
 
+type address struct {
+	StreetAddress   string `json:"streetAddress,omitempty"`
+	PostalCode      string `json:"postalCode,omitempty"`
+	AddressLocality string `json:"addressLocality,omitempty"`
+	AddressRegion   string `json:"addressRegion,omitempty"`
+	AddressCountry  string `json:"addressCountry,omitempty"`
+}
+
+func (a address) IsZero() bool {
+	return a == address{}
+}
+
+type building struct {
+	thing
+	Address   address    `json:"address"`
+	Category  []string   `json:"category,omitempty"`
+	Footprint []location `json:"footprint,omitempty"`
+	Rooms     []thing    `json:"rooms,omitempty"`
+}
+
 type container struct {
 	thing
 	CurrentLevel float64 `json:"currentLevel"`
+	MaxLevel     float64 `json:"maxl,omitempty"` // as named by iot-core, alongside maxd, in the level configuration of the container
 	Percent      float64 `json:"percent"`
 }
 
@@ -97,10 +158,40 @@ type measured struct {
 	ObservedAt time.Time `json:"observedAt"`
 }
 
+type passage struct {
+	thing
+	PassagesToday             int        `json:"passagesToday"`
+	PassagesIn                *int       `json:"passagesIn,omitempty"`
+	PassagesOut               *int       `json:"passagesOut,omitempty"`
+	CumulatedNumberOfPassages int64      `json:"cumulatedNumberOfPassages"`
+	LastPassageAt             *time.Time `json:"lastPassageAt,omitempty"`
+}
+
+type waterMeter struct {
+	thing
+	CumulativeVolume   float64    `json:"cumulativeVolume"`
+	Leakage            bool       `json:"leakage"`
+	LeakageObservedAt  *time.Time `json:"leakageObservedAt,omitempty"`
+	Backflow           bool       `json:"backflow"`
+	BackflowObservedAt *time.Time `json:"backflowObservedAt,omitempty"`
+	Fraud              bool       `json:"fraud"`
+	FraudObservedAt    *time.Time `json:"fraudObservedAt,omitempty"`
+	Burst              bool       `json:"burst"`
+	BurstObservedAt    *time.Time `json:"burstObservedAt,omitempty"`
+}
+
 type pointOfInterest struct {
 	thing
 	Temperature measurement `json:"temperature"`
 	Current     measurement `json:"current"`
+	Status      *string     `json:"status,omitempty"`
+	// BathingSeason is the part of the year when a beach is open for bathing
+	BathingSeason *season `json:"bathingSeason,omitempty"`
+}
+
+type season struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
 }
 
 type measurement struct {
@@ -115,13 +206,48 @@ type measurement struct {
 	Ref         string    `json:"ref,omitzero"`
 }
 
+// UnmarshalJSON accepts either a measurement or, as some things report the values of their sensors, a plain
+// number or boolean. A plain value has no timestamp of its own and is observed when the thing was.
+func (m *measurement) UnmarshalJSON(b []byte) error {
+	*m = measurement{}
+
+	switch b = bytes.TrimSpace(b); {
+	case bytes.Equal(b, []byte("null")):
+		return nil
+	case bytes.Equal(b, []byte("true")), bytes.Equal(b, []byte("false")):
+		v := bytes.Equal(b, []byte("true"))
+		m.BoolValue = &v
+		return nil
+	case len(b) > 0 && b[0] != '{':
+		var v float64
+		if err := json.Unmarshal(b, &v); err != nil {
+			return fmt.Errorf("invalid measurement: %w", err)
+		}
+		m.Value = &v
+		return nil
+	}
+
+	type plain measurement
+	return json.Unmarshal(b, (*plain)(m))
+}
+
+// observedBy returns the device that made the measurement, if it refers to one. The source of a measurement is
+// free text rather than an entity, and is published as a property of its own.
+func (m measurement) observedBy() string {
+	if m.Ref != "" {
+		return fiware.DeviceIDPrefix + m.Ref
+	}
+
+	return ""
+}
+
 type room struct {
 	thing
 	Temperature measurement `json:"temperature"`
-	Humidity    float64     `json:"humidity"`
-	Illuminance float64     `json:"illuminance"`
-	CO2         float64     `json:"co2"`
-	Presence    bool        `json:"presence"`
+	Humidity    measurement `json:"humidity"`
+	Illuminance measurement `json:"illuminance"`
+	CO2         measurement `json:"co2"`
+	Presence    measurement `json:"presence"`
 }
 
 type pumpingStation struct {
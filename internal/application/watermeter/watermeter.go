@@ -0,0 +1,311 @@
+// Package watermeter derives consumption, flow and alarms from consecutive readings of a water meter.
+// It is shared by the measurement and thing handlers so that both publish water meters the same way.
+package watermeter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities"
+	"github.com/diwise/context-broker/pkg/ngsild/types/entities/decorators"
+	p "github.com/diwise/context-broker/pkg/ngsild/types/properties"
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
+)
+
+// LitresPerHour is the UN/CEFACT unit code used for water flow
+const LitresPerHour string = "E32"
+
+// DefaultTimeZone is the time zone that the night is in unless configured otherwise
+const DefaultTimeZone string = "Europe/Stockholm"
+
+// LeakDetection configures the night-time flow heuristic used to flag suspected leaks.
+// A meter that has reported continuous flow since NightStart, for at least MinDuration,
+// is considered to be leaking. Hours are given in the local time of Location.
+type LeakDetection struct {
+	NightStart  int
+	NightEnd    int
+	MinDuration time.Duration
+	Location    *time.Location
+}
+
+// DefaultLeakDetection returns the leak detection that is used unless configured otherwise
+func DefaultLeakDetection() LeakDetection {
+	loc, err := time.LoadLocation(DefaultTimeZone)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	return LeakDetection{
+		NightStart:  0,
+		NightEnd:    4,
+		MinDuration: 2 * time.Hour,
+		Location:    loc,
+	}
+}
+
+// Validate returns an error if the night is not a window within a day, or if there is no time zone
+func (ld LeakDetection) Validate() error {
+	if ld.NightStart < 0 || ld.NightEnd > 24 || ld.NightStart >= ld.NightEnd {
+		return fmt.Errorf("night from %d to %d is not within a day", ld.NightStart, ld.NightEnd)
+	}
+
+	if ld.MinDuration <= 0 {
+		return errors.New("the minimum duration of night-time flow must be positive")
+	}
+
+	if ld.Location == nil {
+		return errors.New("missing time zone")
+	}
+
+	return nil
+}
+
+type leakDetectionContextKey struct{}
+
+// NewContextWithLeakDetection returns a copy of ctx that water meters are checked for leaks in with ld
+func NewContextWithLeakDetection(ctx context.Context, ld LeakDetection) context.Context {
+	return context.WithValue(ctx, leakDetectionContextKey{}, ld)
+}
+
+func leakDetectionFromContext(ctx context.Context) LeakDetection {
+	if ld, ok := ctx.Value(leakDetectionContextKey{}).(LeakDetection); ok {
+		return ld
+	}
+
+	return DefaultLeakDetection()
+}
+
+type waterMeterState struct {
+	Volume      float64    `json:"volume"`
+	ObservedAt  time.Time  `json:"observedAt"`
+	FlowSince   *time.Time `json:"flowSince,omitempty"`
+	PeriodStart time.Time  `json:"periodStart"`
+	MinFlow     *float64   `json:"minFlow,omitempty"`
+	MaxFlow     *float64   `json:"maxFlow,omitempty"`
+}
+
+// Reading is what could be derived from a new reading of a meter compared to the previous one
+type Reading struct {
+	Consumption   *float64
+	Flow          *float64
+	MinFlow       *float64
+	MaxFlow       *float64
+	PeriodStart   time.Time
+	LeakSuspected bool
+	CounterReset  bool
+
+	// key, prev and next are the stored readings before and after this one, so that it can be restored
+	key  state.Key
+	prev *waterMeterState
+	next *waterMeterState
+}
+
+// waterMeterStateTTL is how long the previous reading of a meter is kept. A meter that has been silent
+// for longer than this starts over as if it was new, rather than reporting its whole absence as one reading.
+const waterMeterStateTTL = 30 * 24 * time.Hour
+
+// Update compares a reading (in litres) with the previous reading of the meter published as entityID and returns
+// the consumption, flow and alarms derived from the difference. The reading is stored at once, under a lock, so that
+// readings of the same meter that are handled at the same time are derived from each other rather than from the same
+// previous reading. A reading that could not be published is to be restored, see Restore. Readings that are not newer
+// than the stored reading are ignored and reported as not ok.
+func Update(ctx context.Context, tenant, entityID string, litres float64, ts time.Time) (Reading, bool, error) {
+	store := state.GetFromContext(ctx)
+	key := state.NewKey(tenant, entityID, "watermeter")
+
+	unlock := state.Lock(key)
+	defer unlock()
+
+	prev := waterMeterState{}
+	found, err := store.Get(ctx, key, &prev)
+	if err != nil {
+		return Reading{}, false, fmt.Errorf("failed to load water meter state: %w", err)
+	}
+
+	if found && !ts.After(prev.ObservedAt) {
+		return Reading{}, false, nil
+	}
+
+	next, reading := prev.next(found, litres, ts, leakDetectionFromContext(ctx))
+
+	err = store.Set(ctx, key, next, waterMeterStateTTL)
+	if err != nil {
+		return Reading{}, false, fmt.Errorf("failed to store water meter state: %w", err)
+	}
+
+	reading.key = key
+	reading.next = &next
+	if found {
+		reading.prev = &prev
+	}
+
+	return reading, true, nil
+}
+
+// Restore puts back the reading that was stored before r, once r could not be published, so that the consumption
+// and alarms derived from r are derived again from the next reading. A reading that has been stored since r is kept.
+func Restore(ctx context.Context, r Reading) error {
+	if r.next == nil {
+		return nil
+	}
+
+	store := state.GetFromContext(ctx)
+
+	unlock := state.Lock(r.key)
+	defer unlock()
+
+	current := waterMeterState{}
+	found, err := store.Get(ctx, r.key, &current)
+	if err != nil {
+		return fmt.Errorf("failed to load water meter state: %w", err)
+	}
+
+	if !found || !current.ObservedAt.Equal(r.next.ObservedAt) {
+		return nil
+	}
+
+	if r.prev == nil {
+		err = store.Delete(ctx, r.key)
+	} else {
+		err = store.Set(ctx, r.key, *r.prev, waterMeterStateTTL)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to restore water meter state: %w", err)
+	}
+
+	return nil
+}
+
+// Forget removes the previous reading of the meter published as entityID, so that a meter that is published as
+// entityID again starts over as if it was new
+func Forget(ctx context.Context, tenant, entityID string) error {
+	err := state.GetFromContext(ctx).Delete(ctx, state.NewKey(tenant, entityID, "watermeter"))
+	if err != nil {
+		return fmt.Errorf("failed to forget water meter state: %w", err)
+	}
+
+	return nil
+}
+
+func (prev waterMeterState) next(found bool, litres float64, ts time.Time, ld LeakDetection) (waterMeterState, Reading) {
+	periodStart := startOfDay(ts, ld.Location)
+
+	next := waterMeterState{
+		Volume:      litres,
+		ObservedAt:  ts,
+		PeriodStart: periodStart,
+	}
+
+	if prev.PeriodStart.Equal(periodStart) {
+		next.MinFlow = prev.MinFlow
+		next.MaxFlow = prev.MaxFlow
+	}
+
+	reading := Reading{PeriodStart: periodStart}
+
+	if !found {
+		return next, reading
+	}
+
+	delta := litres - prev.Volume
+	if delta < 0 {
+		// the counter has been rolled back or the meter has been reset or replaced
+		reading.CounterReset = true
+		return next, reading
+	}
+
+	flow := delta / ts.Sub(prev.ObservedAt).Hours()
+
+	if flow > 0 {
+		next.FlowSince = prev.FlowSince
+		if next.FlowSince == nil {
+			next.FlowSince = &prev.ObservedAt
+		}
+	}
+
+	if next.MinFlow == nil || flow < *next.MinFlow {
+		next.MinFlow = &flow
+	}
+
+	if next.MaxFlow == nil || flow > *next.MaxFlow {
+		next.MaxFlow = &flow
+	}
+
+	reading.Consumption = &delta
+	reading.Flow = &flow
+	reading.MinFlow = next.MinFlow
+	reading.MaxFlow = next.MaxFlow
+	reading.LeakSuspected = ld.isNightTimeFlow(next.FlowSince, ts)
+
+	return next, reading
+}
+
+func (ld LeakDetection) isNightTimeFlow(flowSince *time.Time, ts time.Time) bool {
+	if flowSince == nil {
+		return false
+	}
+
+	local := ts.In(ld.Location)
+	if local.Hour() < ld.NightStart || local.Hour() >= ld.NightEnd {
+		return false
+	}
+
+	nightStart := time.Date(local.Year(), local.Month(), local.Day(), ld.NightStart, 0, 0, 0, ld.Location)
+
+	return !flowSince.After(nightStart) && ts.Sub(nightStart) >= ld.MinDuration
+}
+
+// startOfDay returns the midnight before ts in loc, so that the flow is tracked per day in the same time zone as the night
+func startOfDay(ts time.Time, loc *time.Location) time.Time {
+	ts = ts.In(loc)
+	return time.Date(ts.Year(), ts.Month(), ts.Day(), 0, 0, 0, 0, loc)
+}
+
+// ToLitres converts a volume in m3, as reported by lwm2m, to the litres that the context broker expects
+func ToLitres(m3 float64) float64 {
+	return math.Floor((m3 + 0.0005) * 1000)
+}
+
+// Decorators returns the properties derived from a reading. The alarms are only included if ok, i.e.
+// if the reading was newer than the previous one.
+func Decorators(r Reading, ok bool, observedAt, observedBy string) []entities.EntityDecoratorFunc {
+	props := make([]entities.EntityDecoratorFunc, 0, 7)
+
+	observed := func(unitCode string) []p.NumberPropertyDecoratorFunc {
+		d := []p.NumberPropertyDecoratorFunc{p.UnitCode(unitCode), p.ObservedAt(observedAt)}
+		if observedBy != "" {
+			d = append(d, p.ObservedBy(observedBy))
+		}
+		return d
+	}
+
+	if ok {
+		props = append(props,
+			decorators.Number("alarmFlowPersistence", AlarmValue[r.LeakSuspected], p.ObservedAt(observedAt)),
+			decorators.Number("alarmMetrology", AlarmValue[r.CounterReset], p.ObservedAt(observedAt)),
+		)
+	}
+
+	if r.Consumption != nil {
+		props = append(props, decorators.Number("waterConsumption", *r.Consumption, observed("LTR")...))
+	}
+
+	if r.Flow != nil {
+		props = append(props,
+			decorators.Number("flow", *r.Flow, observed(LitresPerHour)...),
+			decorators.Number("minFlow", *r.MinFlow, p.UnitCode(LitresPerHour), p.ObservedAt(observedAt)),
+			decorators.Number("maxFlow", *r.MaxFlow, p.UnitCode(LitresPerHour), p.ObservedAt(observedAt)),
+			decorators.DateTime("dateFlowPeriodStart", r.PeriodStart.Format(time.RFC3339)),
+		)
+	}
+
+	return props
+}
+
+// AlarmValue maps an alarm state to the numeric value used by WaterConsumptionObserved
+var AlarmValue = map[bool]float64{true: 1, false: 0}
@@ -0,0 +1,202 @@
+package watermeter
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/diwise/iot-transform-fiware/internal/application/state"
+	"github.com/matryer/is"
+)
+
+func TestThatTheNightIsInLocalTime(t *testing.T) {
+	is := is.New(t)
+
+	ld := DefaultLeakDetection()
+	is.Equal(ld.Location.String(), DefaultTimeZone)
+
+	flowSince, _ := time.Parse(time.RFC3339, "2026-01-14T22:30:00Z") // 23:30 in Stockholm
+
+	at := func(ts string) time.Time {
+		t, _ := time.Parse(time.RFC3339, ts)
+		return t
+	}
+
+	is.True(ld.isNightTimeFlow(&flowSince, at("2026-01-15T01:00:00Z")))  // 02:00 in Stockholm, flow for two hours since midnight
+	is.True(!ld.isNightTimeFlow(&flowSince, at("2026-01-15T00:30:00Z"))) // 01:30 in Stockholm, not long enough
+	is.True(!ld.isNightTimeFlow(&flowSince, at("2026-01-15T03:30:00Z"))) // 04:30 in Stockholm, the night has ended
+
+	ld.Location = time.UTC
+	is.True(!ld.isNightTimeFlow(&flowSince, at("2026-01-15T01:00:00Z"))) // 01:00 UTC, not long enough
+	is.True(ld.isNightTimeFlow(&flowSince, at("2026-01-15T03:30:00Z")))  // 03:30 UTC
+}
+
+func TestThatTheLeakDetectionIsValidated(t *testing.T) {
+	is := is.New(t)
+
+	ld := DefaultLeakDetection()
+	is.NoErr(ld.Validate())
+
+	ld.NightStart, ld.NightEnd = 4, 2
+	is.True(ld.Validate() != nil)
+
+	ld = DefaultLeakDetection()
+	ld.Location = nil
+	is.True(ld.Validate() != nil)
+}
+
+func TestThatAReadingIsRestoredIfNotPublished(t *testing.T) {
+	is := is.New(t)
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+
+	t0, _ := time.Parse(time.RFC3339, "2026-01-15T12:00:00Z")
+
+	_, ok, err := Update(ctx, "default", "urn:ngsi-ld:WaterConsumptionObserved:01", 1000, t0)
+	is.NoErr(err)
+	is.True(ok)
+
+	r, ok, err := Update(ctx, "default", "urn:ngsi-ld:WaterConsumptionObserved:01", 1030, t0.Add(time.Hour))
+	is.NoErr(err)
+	is.True(ok)
+	is.NoErr(Restore(ctx, r)) // e.g. because it could not be published
+
+	r, ok, err = Update(ctx, "default", "urn:ngsi-ld:WaterConsumptionObserved:01", 1040, t0.Add(2*time.Hour))
+	is.NoErr(err)
+	is.True(ok)
+	is.Equal(*r.Consumption, 40.0) // since the reading that was published
+	is.Equal(*r.Flow, 20.0)
+}
+
+func TestThatANewerReadingIsNotRestored(t *testing.T) {
+	is := is.New(t)
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+
+	t0, _ := time.Parse(time.RFC3339, "2026-01-15T12:00:00Z")
+
+	failed, _, err := Update(ctx, "default", "urn:ngsi-ld:WaterConsumptionObserved:01", 1000, t0)
+	is.NoErr(err)
+
+	_, _, err = Update(ctx, "default", "urn:ngsi-ld:WaterConsumptionObserved:01", 1030, t0.Add(time.Hour))
+	is.NoErr(err)
+	is.NoErr(Restore(ctx, failed))
+
+	r, _, err := Update(ctx, "default", "urn:ngsi-ld:WaterConsumptionObserved:01", 1040, t0.Add(2*time.Hour))
+	is.NoErr(err)
+	is.Equal(*r.Consumption, 10.0) // since the reading that was stored after the one that failed
+}
+
+// overlappingStore is a store in which a load waits a while for another load to overlap with before it returns, so
+// that readings that are handled at the same time load the same previous reading, unless they are kept apart
+type overlappingStore struct {
+	state.Store
+	gets chan struct{}
+}
+
+func (s overlappingStore) Get(ctx context.Context, k state.Key, v any) (bool, error) {
+	found, err := s.Store.Get(ctx, k, v)
+
+	select {
+	case s.gets <- struct{}{}:
+	case <-s.gets:
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	return found, err
+}
+
+func TestThatConcurrentReadingsAreCountedOnce(t *testing.T) {
+	is := is.New(t)
+	ctx := state.NewContextWithStore(context.Background(), overlappingStore{state.NewInMemoryStore(), make(chan struct{})})
+
+	t0, _ := time.Parse(time.RFC3339, "2026-01-15T12:00:00Z")
+
+	_, _, err := Update(ctx, "default", "urn:ngsi-ld:WaterConsumptionObserved:01", 1000, t0)
+	is.NoErr(err)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	consumption := 0.0
+
+	for i := 1; i <= 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			r, ok, err := Update(ctx, "default", "urn:ngsi-ld:WaterConsumptionObserved:01", 1000+float64(i*10), t0.Add(time.Duration(i)*time.Hour))
+			if err != nil || !ok || r.Consumption == nil {
+				return
+			}
+
+			mu.Lock()
+			consumption += *r.Consumption
+			mu.Unlock()
+		}(i)
+	}
+
+	wg.Wait()
+
+	r, _, err := Update(ctx, "default", "urn:ngsi-ld:WaterConsumptionObserved:01", 1030, t0.Add(3*time.Hour))
+	is.NoErr(err)
+	consumption += *r.Consumption
+
+	// whichever reading is handled first, the consumption derived from them adds up to what the meter has counted
+	is.Equal(consumption, 30.0)
+}
+
+func TestThatAnOlderReadingIsIgnored(t *testing.T) {
+	is := is.New(t)
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+
+	t0, _ := time.Parse(time.RFC3339, "2026-01-15T12:00:00Z")
+
+	_, _, err := Update(ctx, "default", "urn:ngsi-ld:WaterConsumptionObserved:01", 1000, t0)
+	is.NoErr(err)
+
+	_, ok, err := Update(ctx, "default", "urn:ngsi-ld:WaterConsumptionObserved:01", 990, t0)
+	is.NoErr(err)
+	is.True(!ok)
+}
+
+func TestThatACounterResetIsFlagged(t *testing.T) {
+	is := is.New(t)
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+
+	t0, _ := time.Parse(time.RFC3339, "2026-01-15T12:00:00Z")
+
+	_, _, err := Update(ctx, "default", "urn:ngsi-ld:WaterConsumptionObserved:01", 11899, t0)
+	is.NoErr(err)
+
+	r, ok, err := Update(ctx, "default", "urn:ngsi-ld:WaterConsumptionObserved:01", 2, t0.Add(time.Hour))
+	is.NoErr(err)
+	is.True(ok)
+	is.True(r.CounterReset)
+	is.True(r.Consumption == nil) // no consumption can be derived across a reset
+}
+
+func TestThatTheFlowIsTrackedPerDay(t *testing.T) {
+	is := is.New(t)
+	ctx := state.NewContextWithStore(context.Background(), state.NewInMemoryStore())
+
+	t0, _ := time.Parse(time.RFC3339, "2026-01-15T21:00:00Z") // 22:00 in Stockholm
+
+	var r Reading
+	for i, litres := range []float64{1000, 1060, 1080} {
+		var err error
+		r, _, err = Update(ctx, "default", "urn:ngsi-ld:WaterConsumptionObserved:01", litres, t0.Add(time.Duration(i)*time.Hour))
+		is.NoErr(err)
+	}
+
+	// the last reading is the first of a new day in Stockholm, so the flows of the previous day are forgotten
+	is.Equal(r.PeriodStart.Format(time.RFC3339), "2026-01-16T00:00:00+01:00")
+	is.Equal(*r.Flow, 20.0)
+	is.Equal(*r.MinFlow, 20.0)
+	is.Equal(*r.MaxFlow, 20.0) // rather than the 60 l/h of the previous day
+}
+
+func TestThatLitresAreRounded(t *testing.T) {
+	is := is.New(t)
+
+	is.Equal(ToLitres(1.009), 1009.0)
+	is.Equal(ToLitres(0.0004999), 0.0)
+}